@@ -0,0 +1,534 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// bootstrapFile is the path of the file describing the organizations to create
+var bootstrapFile string
+
+// apiToken is the OAuth access token used to call the Quay API
+var apiToken string
+
+// robotTokensFile is where the tokens of the bootstrapped robot accounts are written
+var robotTokensFile string
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Create the organizations, teams, robot accounts and permissions described in a bootstrap file.",
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		apply(cobraCmd)
+	},
+}
+
+func init() {
+
+	// Add apply command
+	rootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	applyCmd.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	applyCmd.Flags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	applyCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	applyCmd.Flags().StringVarP(&quayHostname, "quayHostname", "", "", "The SERVER_HOSTNAME of Quay. This defaults to the value used by the last install, or <targetHostname>:8443")
+	applyCmd.Flags().StringVarP(&bootstrapFile, "bootstrap", "", "", "The path of the bootstrap file describing the organizations to create.")
+	applyCmd.Flags().StringVarP(&apiToken, "token", "", "", "The OAuth access token of a superuser. Can also be set with $MIRROR_REGISTRY_TOKEN. This defaults to the token of the init user stored by install.")
+	applyCmd.Flags().StringVarP(&robotTokensFile, "robot-tokens-file", "", "", "The file the robot account tokens are written to. This defaults to robot-tokens.json in the state directory of the target.")
+	applyCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+	applyCmd.MarkFlagRequired("bootstrap")
+
+}
+
+// bootstrapConfig is the content of a bootstrap file
+type bootstrapConfig struct {
+	Organizations []bootstrapOrganization `yaml:"organizations"`
+}
+
+// bootstrapOrganization is an organization with its robot accounts, teams and repositories
+type bootstrapOrganization struct {
+	Name               string                `yaml:"name"`
+	Email              string                `yaml:"email"`
+	TagExpiration      string                `yaml:"tagExpiration"`
+	Robots             []bootstrapRobot      `yaml:"robots"`
+	Teams              []bootstrapTeam       `yaml:"teams"`
+	Repositories       []bootstrapRepository `yaml:"repositories"`
+	DefaultPermissions []bootstrapPermission `yaml:"defaultPermissions"`
+}
+
+// bootstrapRobot is a robot account of an organization
+type bootstrapRobot struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+}
+
+// bootstrapTeam is a team of an organization. Members are user names or robot
+// account names of the form <organization>+<robot>.
+type bootstrapTeam struct {
+	Name        string   `yaml:"name"`
+	Role        string   `yaml:"role"`
+	Description string   `yaml:"description"`
+	Members     []string `yaml:"members"`
+}
+
+// bootstrapRepository is a repository of an organization and who can access it
+type bootstrapRepository struct {
+	Name        string                `yaml:"name"`
+	Visibility  string                `yaml:"visibility"`
+	Description string                `yaml:"description"`
+	Permissions []bootstrapPermission `yaml:"permissions"`
+}
+
+// bootstrapPermission grants a role to exactly one of a user, a robot account of the organization or a team
+type bootstrapPermission struct {
+	User  string `yaml:"user"`
+	Robot string `yaml:"robot"`
+	Team  string `yaml:"team"`
+	Role  string `yaml:"role"`
+}
+
+// tagExpirationPattern is the duration format of Quay, such as 2w
+var tagExpirationPattern = regexp.MustCompile(`^([0-9]+)([smhdw])$`)
+
+// parseTagExpiration converts a Quay duration such as 2w to seconds
+func parseTagExpiration(s string) (int, error) {
+	match := tagExpirationPattern.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("Invalid tag expiration %q. Use a number followed by s, m, h, d or w, such as 2w", s)
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, err
+	}
+	unit := map[string]int{"s": 1, "m": 60, "h": 3600, "d": 86400, "w": 604800}[match[2]]
+	return n * unit, nil
+}
+
+// loadBootstrap reads and validates a bootstrap file
+func loadBootstrap(file string) (*bootstrapConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &bootstrapConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("Could not read bootstrap file %s: %w", file, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid bootstrap file %s: %w", file, err)
+	}
+	return config, nil
+}
+
+// validate checks the bootstrap file before anything is created
+func (c *bootstrapConfig) validate() error {
+	organizations := map[string]bool{}
+	for _, org := range c.Organizations {
+		if org.Name == "" {
+			return errors.New("every organization needs a name")
+		}
+		if organizations[org.Name] {
+			return fmt.Errorf("organization %s is listed twice", org.Name)
+		}
+		organizations[org.Name] = true
+		if org.TagExpiration != "" {
+			if _, err := parseTagExpiration(org.TagExpiration); err != nil {
+				return fmt.Errorf("organization %s: %w", org.Name, err)
+			}
+		}
+		for _, robot := range org.Robots {
+			if robot.Name == "" || strings.Contains(robot.Name, "+") {
+				return fmt.Errorf("organization %s: robot names are required and must not include the organization", org.Name)
+			}
+		}
+		for _, team := range org.Teams {
+			if team.Name == "" {
+				return fmt.Errorf("organization %s: every team needs a name", org.Name)
+			}
+			if !oneOf(team.Role, "", "member", "creator", "admin") {
+				return fmt.Errorf("team %s: role must be member, creator or admin", team.Name)
+			}
+		}
+		for _, repo := range org.Repositories {
+			if repo.Name == "" {
+				return fmt.Errorf("organization %s: every repository needs a name", org.Name)
+			}
+			if !oneOf(repo.Visibility, "", "private", "public") {
+				return fmt.Errorf("repository %s: visibility must be private or public", repo.Name)
+			}
+			for _, permission := range repo.Permissions {
+				if err := permission.validate(); err != nil {
+					return fmt.Errorf("repository %s: %w", repo.Name, err)
+				}
+			}
+		}
+		for _, permission := range org.DefaultPermissions {
+			if err := permission.validate(); err != nil {
+				return fmt.Errorf("organization %s default permissions: %w", org.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p bootstrapPermission) validate() error {
+	set := 0
+	for _, name := range []string{p.User, p.Robot, p.Team} {
+		if name != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("each permission needs exactly one of user, robot or team")
+	}
+	if !oneOf(p.Role, "read", "write", "admin") {
+		return errors.New("permission role must be read, write or admin")
+	}
+	return nil
+}
+
+// delegate returns the kind, user or team, and the name a permission is granted to
+func (p bootstrapPermission) delegate(org string) (string, string) {
+	switch {
+	case p.Team != "":
+		return "team", p.Team
+	case p.Robot != "":
+		return "user", org + "+" + p.Robot
+	}
+	return "user", p.User
+}
+
+// oneOf reports whether s is one of values
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func apply(cobraCmd *cobra.Command) {
+
+	bootstrap, err := loadBootstrap(bootstrapFile)
+	check(err)
+
+	err = loadSSHKeys()
+	check(err)
+
+	previous, err := loadInstallState()
+	check(err)
+	if !cobraCmd.Flags().Changed("quayRoot") && previous.QuayRoot != "" {
+		quayRoot = previous.QuayRoot
+	}
+	if quayHostname == "" {
+		quayHostname = previous.QuayHostname
+	}
+	if quayHostname == "" {
+		quayHostname = targetHostname + ":8443"
+	}
+	apiToken = resolveAPIToken()
+	if apiToken == "" {
+		check(errors.New("An API token is required. Supply it with --token or $MIRROR_REGISTRY_TOKEN, or install with this installer to store the token of the init user"))
+	}
+
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("apply")
+	check(err)
+
+	state, err := beginOperation("apply", false)
+	check(err)
+
+	state.startStep("bootstrap")
+	err = applyBootstrap(newQuayClient(quayHostname, apiToken), bootstrap)
+	if err == nil {
+		state.completeStep("bootstrap")
+	}
+	finishOperation(ctx, state, err)
+}
+
+// applyBootstrap creates what the bootstrap file describes and is missing from
+// Quay. Nothing is removed, so running it again only applies the differences.
+func applyBootstrap(client *quayClient, bootstrap *bootstrapConfig) error {
+	tokens := map[string]string{}
+	for _, org := range bootstrap.Organizations {
+		if err := applyOrganization(client, org, tokens); err != nil {
+			return fmt.Errorf("organization %s: %w", org.Name, err)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	file := robotTokensFile
+	if file == "" {
+		file = path.Join(targetStateDir(), "robot-tokens.json")
+	}
+	if err := writeRobotTokens(file, tokens); err != nil {
+		return err
+	}
+	log.Infof("Robot account tokens written to %s", file)
+	return nil
+}
+
+func applyOrganization(client *quayClient, org bootstrapOrganization, tokens map[string]string) error {
+	var current struct {
+		TagExpiration *int `json:"tag_expiration_s"`
+	}
+	err := client.do("GET", apiPath("organization", org.Name), nil, &current)
+	if isNotFound(err) {
+		body := map[string]string{"name": org.Name}
+		if org.Email != "" {
+			body["email"] = org.Email
+		}
+		if err := client.do("POST", apiPath("organization")+"/", body, nil); err != nil {
+			return err
+		}
+		log.Infof("Created organization %s", org.Name)
+		err = client.do("GET", apiPath("organization", org.Name), nil, &current)
+	}
+	if err != nil {
+		return err
+	}
+
+	if org.TagExpiration != "" {
+		seconds, _ := parseTagExpiration(org.TagExpiration)
+		if current.TagExpiration == nil || *current.TagExpiration != seconds {
+			if err := client.do("PUT", apiPath("organization", org.Name), map[string]int{"tag_expiration_s": seconds}, nil); err != nil {
+				return err
+			}
+			log.Infof("Set the tag expiration of %s to %s", org.Name, org.TagExpiration)
+		}
+	}
+
+	for _, robot := range org.Robots {
+		token, err := ensureRobot(client, org.Name, robot.Name, robot.Description)
+		if err != nil {
+			return err
+		}
+		tokens[org.Name+"+"+robot.Name] = token
+	}
+
+	for _, team := range org.Teams {
+		if err := applyTeam(client, org.Name, team); err != nil {
+			return err
+		}
+	}
+
+	for _, repo := range org.Repositories {
+		if err := applyRepository(client, org.Name, repo); err != nil {
+			return err
+		}
+	}
+
+	return applyDefaultPermissions(client, org.Name, org.DefaultPermissions)
+}
+
+// ensureRobot creates a robot account of an organization unless it exists, and returns its token
+func ensureRobot(client *quayClient, org, name, description string) (string, error) {
+	var account struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	robotPath := apiPath("organization", org, "robots", name)
+	err := client.do("GET", robotPath, nil, &account)
+	if isNotFound(err) {
+		err = client.do("PUT", robotPath, map[string]string{"description": description}, &account)
+		if err == nil {
+			log.Infof("Created robot account %s+%s", org, name)
+		}
+	}
+	return account.Token, err
+}
+
+func applyTeam(client *quayClient, org string, team bootstrapTeam) error {
+	role := team.Role
+	if role == "" {
+		role = "member"
+	}
+	teamPath := apiPath("organization", org, "team", team.Name)
+	if err := client.do("PUT", teamPath, map[string]string{"role": role, "description": team.Description}, nil); err != nil {
+		return err
+	}
+	log.Debugf("Team %s of %s has role %s", team.Name, org, role)
+
+	var members struct {
+		Members []struct {
+			Name string `json:"name"`
+		} `json:"members"`
+	}
+	if err := client.do("GET", teamPath+"/members?includePending=true", nil, &members); err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, member := range members.Members {
+		existing[member.Name] = true
+	}
+	for _, member := range team.Members {
+		if existing[member] {
+			continue
+		}
+		if err := client.do("PUT", apiPath("organization", org, "team", team.Name, "members", member), map[string]string{}, nil); err != nil {
+			return err
+		}
+		log.Infof("Added %s to team %s of %s", member, team.Name, org)
+	}
+	return nil
+}
+
+// repositoryPath builds the API path of a repository, which may have a nested name
+func repositoryPath(org, name string, elements ...string) string {
+	parts := append([]string{"repository", org}, strings.Split(name, "/")...)
+	return apiPath(append(parts, elements...)...)
+}
+
+func applyRepository(client *quayClient, org string, repo bootstrapRepository) error {
+	visibility := repo.Visibility
+	if visibility == "" {
+		visibility = "private"
+	}
+	var current struct {
+		IsPublic bool `json:"is_public"`
+	}
+	err := client.do("GET", repositoryPath(org, repo.Name), nil, &current)
+	if isNotFound(err) {
+		body := map[string]string{
+			"namespace":   org,
+			"repository":  repo.Name,
+			"visibility":  visibility,
+			"description": repo.Description,
+			"repo_kind":   "image",
+		}
+		if err := client.do("POST", apiPath("repository"), body, nil); err != nil {
+			return err
+		}
+		log.Infof("Created repository %s/%s", org, repo.Name)
+		current.IsPublic = visibility == "public"
+	} else if err != nil {
+		return err
+	}
+	if current.IsPublic != (visibility == "public") {
+		if err := client.do("POST", repositoryPath(org, repo.Name, "changevisibility"), map[string]string{"visibility": visibility}, nil); err != nil {
+			return err
+		}
+		log.Infof("Made repository %s/%s %s", org, repo.Name, visibility)
+	}
+
+	granted := map[string]map[string]string{}
+	for _, kind := range []string{"user", "team"} {
+		var permissions struct {
+			Permissions map[string]struct {
+				Role string `json:"role"`
+			} `json:"permissions"`
+		}
+		if err := client.do("GET", repositoryPath(org, repo.Name, "permissions", kind)+"/", nil, &permissions); err != nil {
+			return err
+		}
+		granted[kind] = map[string]string{}
+		for name, permission := range permissions.Permissions {
+			granted[kind][name] = permission.Role
+		}
+	}
+	for _, permission := range repo.Permissions {
+		kind, name := permission.delegate(org)
+		if granted[kind][name] == permission.Role {
+			continue
+		}
+		if err := client.do("PUT", repositoryPath(org, repo.Name, "permissions", kind, name), map[string]string{"role": permission.Role}, nil); err != nil {
+			return err
+		}
+		log.Infof("Granted %s on %s/%s to %s %s", permission.Role, org, repo.Name, kind, name)
+	}
+	return nil
+}
+
+// applyDefaultPermissions creates the default permissions of an organization,
+// which Quay grants on every repository created in it afterwards.
+func applyDefaultPermissions(client *quayClient, org string, permissions []bootstrapPermission) error {
+	if len(permissions) == 0 {
+		return nil
+	}
+	var prototypes struct {
+		Prototypes []struct {
+			ID             string      `json:"id"`
+			Role           string      `json:"role"`
+			ActivatingUser interface{} `json:"activating_user"`
+			Delegate       struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"delegate"`
+		} `json:"prototypes"`
+	}
+	if err := client.do("GET", apiPath("organization", org, "prototypes"), nil, &prototypes); err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		kind, name := permission.delegate(org)
+		found := false
+		for _, prototype := range prototypes.Prototypes {
+			if prototype.ActivatingUser != nil || prototype.Delegate.Kind != kind || prototype.Delegate.Name != name {
+				continue
+			}
+			found = true
+			if prototype.Role != permission.Role {
+				if err := client.do("PUT", apiPath("organization", org, "prototypes", prototype.ID), map[string]string{"role": permission.Role}, nil); err != nil {
+					return err
+				}
+				log.Infof("Changed the default permission of %s %s on %s to %s", kind, name, org, permission.Role)
+			}
+		}
+		if found {
+			continue
+		}
+		body := map[string]interface{}{
+			"role":     permission.Role,
+			"delegate": map[string]string{"kind": kind, "name": name},
+		}
+		if err := client.do("POST", apiPath("organization", org, "prototypes"), body, nil); err != nil {
+			return err
+		}
+		log.Infof("Granted %s on new repositories of %s to %s %s", permission.Role, org, kind, name)
+	}
+	return nil
+}
+
+// writeRobotTokens adds robot account tokens to a JSON file only readable by the current user
+func writeRobotTokens(file string, tokens map[string]string) error {
+	merged := map[string]string{}
+	if data, err := ioutil.ReadFile(file); err == nil {
+		if err := json.Unmarshal(data, &merged); err != nil {
+			return fmt.Errorf("Could not read %s: %w", file, err)
+		}
+	}
+	for name, token := range tokens {
+		merged[name] = token
+	}
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile does not change the mode of an existing file
+	return os.Chmod(file, 0600)
+}
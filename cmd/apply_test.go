@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseTagExpiration(t *testing.T) {
+	tests := map[string]int{"0s": 0, "90m": 5400, "1d": 86400, "2w": 1209600}
+	for s, want := range tests {
+		if got, err := parseTagExpiration(s); err != nil || got != want {
+			t.Errorf("parseTagExpiration(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "2", "w", "1y", "-1d"} {
+		if _, err := parseTagExpiration(s); err == nil {
+			t.Errorf("parseTagExpiration(%q) succeeded", s)
+		}
+	}
+}
+
+func TestLoadBootstrap(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			content: `organizations:
+  - name: ocp4
+    tagExpiration: 1w
+    robots:
+      - name: pusher
+    teams:
+      - name: mirror
+        role: creator
+        members: [ocp4+pusher]
+    repositories:
+      - name: openshift/release
+        permissions:
+          - robot: pusher
+            role: write
+    defaultPermissions:
+      - team: mirror
+        role: read
+`,
+		},
+		{
+			name:    "unknown field",
+			content: "organizations:\n  - name: ocp4\n    robot: [pusher]\n",
+			wantErr: "field robot not found",
+		},
+		{
+			name:    "permission without delegate",
+			content: "organizations:\n  - name: ocp4\n    repositories:\n      - name: release\n        permissions:\n          - role: write\n",
+			wantErr: "exactly one of user, robot or team",
+		},
+		{
+			name:    "bad team role",
+			content: "organizations:\n  - name: ocp4\n    teams:\n      - name: mirror\n        role: owner\n",
+			wantErr: "member, creator or admin",
+		},
+		{
+			name:    "full robot name",
+			content: "organizations:\n  - name: ocp4\n    robots:\n      - name: ocp4+pusher\n",
+			wantErr: "must not include the organization",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "bootstrap.yaml")
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadBootstrap(file)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("loadBootstrap() returned error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("loadBootstrap() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeQuay is a minimal in-memory Quay API recording the calls that change it
+type fakeQuay struct {
+	objects map[string]map[string]interface{}
+	writes  []string
+}
+
+func (f *fakeQuay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimSuffix(r.URL.Path, "/")
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	if r.Method == "GET" {
+		switch {
+		case strings.HasSuffix(key, "/members"):
+			var members []map[string]string
+			for name := range f.objects {
+				if strings.HasPrefix(name, key+"/") {
+					members = append(members, map[string]string{"name": path.Base(name)})
+				}
+			}
+			reply(map[string]interface{}{"members": members})
+		case strings.HasSuffix(key, "/permissions/user"), strings.HasSuffix(key, "/permissions/team"):
+			permissions := map[string]interface{}{}
+			for name, object := range f.objects {
+				if strings.HasPrefix(name, key+"/") {
+					permissions[path.Base(name)] = object
+				}
+			}
+			reply(map[string]interface{}{"permissions": permissions})
+		case strings.HasSuffix(key, "/prototypes"):
+			var prototypes []interface{}
+			for name, object := range f.objects {
+				if strings.HasPrefix(name, key+"/") {
+					prototypes = append(prototypes, object)
+				}
+			}
+			reply(map[string]interface{}{"prototypes": prototypes})
+		default:
+			object, ok := f.objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				reply(map[string]string{"detail": "Not Found"})
+				return
+			}
+			reply(object)
+		}
+		return
+	}
+
+	f.writes = append(f.writes, r.Method+" "+key)
+	body := map[string]interface{}{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case key == "/api/v1/organization":
+		key += "/" + body["name"].(string)
+	case key == "/api/v1/repository":
+		key += "/" + body["namespace"].(string) + "/" + body["repository"].(string)
+		body["is_public"] = body["visibility"] == "public"
+	case strings.HasSuffix(key, "/prototypes"):
+		body["id"] = "p1"
+		body["activating_user"] = nil
+		key += "/p1"
+	case strings.Contains(key, "/robots/"):
+		body["token"] = "secret-" + path.Base(key)
+	case strings.HasSuffix(key, "/changestate"):
+		f.objects[strings.TrimSuffix(key, "/changestate")]["state"] = body["state"]
+	}
+	if f.objects[key] == nil {
+		f.objects[key] = map[string]interface{}{}
+	}
+	for k, v := range body {
+		f.objects[key][k] = v
+	}
+	reply(f.objects[key])
+}
+
+func TestApplyBootstrap(t *testing.T) {
+	fake := &fakeQuay{objects: map[string]map[string]interface{}{}}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	client := &quayClient{baseURL: server.URL, token: "token", client: server.Client()}
+
+	origTokens := robotTokensFile
+	defer func() { robotTokensFile = origTokens }()
+	robotTokensFile = path.Join(t.TempDir(), "robot-tokens.json")
+
+	bootstrap := &bootstrapConfig{Organizations: []bootstrapOrganization{{
+		Name:          "ocp4",
+		TagExpiration: "1d",
+		Robots:        []bootstrapRobot{{Name: "pusher"}},
+		Teams:         []bootstrapTeam{{Name: "mirror", Members: []string{"ocp4+pusher"}}},
+		Repositories: []bootstrapRepository{{
+			Name:        "openshift/release",
+			Permissions: []bootstrapPermission{{Robot: "pusher", Role: "write"}, {Team: "mirror", Role: "read"}},
+		}},
+		DefaultPermissions: []bootstrapPermission{{Robot: "pusher", Role: "write"}},
+	}}}
+
+	if err := applyBootstrap(client, bootstrap); err != nil {
+		t.Fatalf("applyBootstrap() returned error: %v", err)
+	}
+	want := []string{
+		"POST /api/v1/organization",
+		"PUT /api/v1/organization/ocp4",
+		"PUT /api/v1/organization/ocp4/robots/pusher",
+		"PUT /api/v1/organization/ocp4/team/mirror",
+		"PUT /api/v1/organization/ocp4/team/mirror/members/ocp4+pusher",
+		"POST /api/v1/repository",
+		"PUT /api/v1/repository/ocp4/openshift/release/permissions/user/ocp4+pusher",
+		"PUT /api/v1/repository/ocp4/openshift/release/permissions/team/mirror",
+		"POST /api/v1/organization/ocp4/prototypes",
+	}
+	if strings.Join(fake.writes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("first run made calls\n%s\nwant\n%s", strings.Join(fake.writes, "\n"), strings.Join(want, "\n"))
+	}
+
+	data, err := ioutil.ReadFile(robotTokensFile)
+	if err != nil || !strings.Contains(string(data), `"ocp4+pusher": "secret-pusher"`) {
+		t.Errorf("robot tokens file = %s, %v", data, err)
+	}
+
+	// Only the team is updated again, as its PUT creates or updates it
+	fake.writes = nil
+	if err := applyBootstrap(client, bootstrap); err != nil {
+		t.Fatalf("second applyBootstrap() returned error: %v", err)
+	}
+	if strings.Join(fake.writes, "\n") != "PUT /api/v1/organization/ocp4/team/mirror" {
+		t.Errorf("second run made calls %q", fake.writes)
+	}
+}
@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditFileName is the name of the audit log kept under quayRoot on the target
+const auditFileName = "mirror-registry-audit.jsonl"
+
+// auditRecord describes one installer run. Records are appended as single JSON
+// lines to the audit log on the target and in the local state directory.
+type auditRecord struct {
+	Timestamp       time.Time                `json:"timestamp"`
+	Operation       string                   `json:"operation"`
+	Outcome         string                   `json:"outcome"`
+	Step            string                   `json:"step,omitempty"`
+	DurationSeconds float64                  `json:"durationSeconds"`
+	User            string                   `json:"user"`
+	Host            string                   `json:"host"`
+	TargetHostname  string                   `json:"targetHostname"`
+	TargetUsername  string                   `json:"targetUsername"`
+	QuayRoot        string                   `json:"quayRoot"`
+	Version         string                   `json:"version"`
+	Images          map[string]string        `json:"images,omitempty"`
+	Args            []string                 `json:"args"`
+	Stats           map[string]playbookStats `json:"stats,omitempty"`
+}
+
+// playbookStats are the counters printed for each host in the PLAY RECAP of ansible-playbook
+type playbookStats map[string]int
+
+// lastPlaybookStats holds the PLAY RECAP of the last playbook run by the installer
+var lastPlaybookStats map[string]playbookStats
+
+// sensitiveFlagPattern matches the names of flags whose values must not be logged
+var sensitiveFlagPattern = regexp.MustCompile(`(?i)password|secret|token`)
+
+// auditRedactedArgs are arguments that must not be logged, such as the value
+// config set writes to a secret key
+var auditRedactedArgs []string
+
+// ansiEscapePattern matches the color sequences ansible prints when attached to a TTY
+var ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// localAuditFile returns the path of the local audit log, shared by all targets
+func localAuditFile() string {
+	return path.Join(stateRoot(), "audit.jsonl")
+}
+
+// redactConfigValue keeps the value passed to config set out of the audit
+// log when it is or contains a secret
+func redactConfigValue(key string, value interface{}, rawValue string) {
+	if configValueHasSecret(key, value) {
+		auditRedactedArgs = append(auditRedactedArgs, rawValue)
+	}
+}
+
+// redactArgs returns a copy of the command line with the values of sensitive
+// flags and the arguments in auditRedactedArgs replaced
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted); i++ {
+		arg := redacted[i]
+		if contains(auditRedactedArgs, arg) {
+			redacted[i] = "REDACTED"
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if eq := strings.Index(name, "="); eq >= 0 {
+			if sensitiveFlagPattern.MatchString(name[:eq]) {
+				redacted[i] = arg[:strings.Index(arg, "=")+1] + "REDACTED"
+			}
+			continue
+		}
+		if sensitiveFlagPattern.MatchString(name) && i+1 < len(redacted) && !strings.HasPrefix(redacted[i+1], "-") {
+			redacted[i+1] = "REDACTED"
+			i++
+		}
+	}
+	// Connection URIs such as --db-uri may embed a password
+	for i, arg := range redacted {
+		if strings.Contains(arg, "://") {
+			if name, value, found := strings.Cut(arg, "="); found && strings.HasPrefix(name, "-") {
+				redacted[i] = name + "=" + redactURI(value)
+			} else {
+				redacted[i] = redactURI(arg)
+			}
+		}
+	}
+	return redacted
+}
+
+// imageOperations are the operations that deploy or run the images of the
+// installer on the target, whose audit records list them
+var imageOperations = map[string]bool{
+	"install":    true,
+	"upgrade":    true,
+	"migrate-db": true,
+}
+
+// newAuditRecord builds the audit record of an operation from its final state
+func newAuditRecord(state *installState) *auditRecord {
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+	record := &auditRecord{
+		Timestamp:       now,
+		Operation:       state.Operation,
+		Outcome:         state.Status,
+		Step:            state.Step,
+		DurationSeconds: now.Sub(state.StartedAt).Round(time.Second).Seconds(),
+		User:            username,
+		Host:            hostname,
+		TargetHostname:  state.TargetHostname,
+		TargetUsername:  state.TargetUsername,
+		QuayRoot:        state.QuayRoot,
+		Version:         releaseVersion,
+		Args:            redactArgs(os.Args[1:]),
+		Stats:           lastPlaybookStats,
+	}
+	if imageOperations[state.Operation] {
+		record.Images = map[string]string{
+			"ansible": eeImage,
+			"pause":   pauseImage,
+			"quay":    quayImage,
+			"redis":   redisImage,
+			"sqlite":  sqliteImage,
+		}
+	}
+	return record
+}
+
+// recordAudit appends the audit record of an operation to the local audit log
+// and, when quayRoot still exists, to the audit log on the target. Failing to
+// write the audit trail is reported but does not fail the operation.
+func recordAudit(state *installState) {
+	record := newAuditRecord(state)
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Warnf("Could not encode audit record: %s", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	if err := appendAuditLine(localAuditFile(), line); err != nil {
+		log.Warnf("Could not write local audit log: %s", err.Error())
+	}
+
+	auditFile := targetPath(path.Join(quayRoot, auditFileName))
+	script := fmt.Sprintf(`if [ -d %s ]; then (umask 077; cat >> %s); fi`, targetPath(quayRoot), auditFile)
+	if _, err := runOnTarget(script, bytes.NewReader(line)); err != nil {
+		log.Warnf("Could not write audit log on %s: %s", targetHostname, err.Error())
+	}
+}
+
+// auditCommand starts the audit record of a command that writes to the
+// registry without changing the installation. Such commands do not take the
+// lock nor record their progress in state.json, so that several can run at
+// once. The record is written when the installer exits, as failed unless the
+// command sets the returned state to succeeded.
+func auditCommand(operation string) *installState {
+	state := &installState{Operation: operation, Status: statusFailed, StartedAt: time.Now().UTC()}
+	onExit(func() {
+		state.TargetHostname, state.TargetUsername, state.QuayRoot = targetHostname, targetUsername, quayRoot
+		recordAudit(state)
+	})
+	return state
+}
+
+// appendAuditLine appends a record to a local audit log only readable by the current user
+func appendAuditLine(file string, line []byte) error {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readAuditRecords parses an audit log. Lines that are not valid records are skipped.
+func readAuditRecords(r io.Reader) ([]auditRecord, error) {
+	var records []auditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// readLocalAuditRecords reads the local audit log. A missing log yields no records.
+func readLocalAuditRecords() ([]auditRecord, error) {
+	data, err := ioutil.ReadFile(localAuditFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readAuditRecords(bytes.NewReader(data))
+}
+
+// recapWriter passes the playbook output through while collecting the PLAY RECAP stats
+type recapWriter struct {
+	out     io.Writer
+	partial []byte
+	inRecap bool
+	stats   map[string]playbookStats
+}
+
+func (w *recapWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.parseLine(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	if w.out == nil {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+func (w *recapWriter) parseLine(line string) {
+	line = strings.TrimSpace(ansiEscapePattern.ReplaceAllString(line, ""))
+	if strings.HasPrefix(line, "PLAY RECAP") {
+		w.inRecap = true
+		w.stats = map[string]playbookStats{}
+		return
+	}
+	if !w.inRecap {
+		return
+	}
+	host, counters, found := strings.Cut(line, " : ")
+	if !found {
+		if line != "" {
+			w.inRecap = false
+		}
+		return
+	}
+	stats := playbookStats{}
+	for _, field := range strings.Fields(counters) {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil {
+			stats[key] = n
+		}
+	}
+	w.stats[strings.TrimSpace(host)] = stats
+}
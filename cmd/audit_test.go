@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "no sensitive flags",
+			args: []string{"install", "--quayRoot", "/opt/quay", "-v"},
+			want: []string{"install", "--quayRoot", "/opt/quay", "-v"},
+		},
+		{
+			name: "separate value",
+			args: []string{"install", "--initPassword", "hunter2", "--initUser", "admin"},
+			want: []string{"install", "--initPassword", "REDACTED", "--initUser", "admin"},
+		},
+		{
+			name: "inline value",
+			args: []string{"install", "--initPassword=hunter2"},
+			want: []string{"install", "--initPassword=REDACTED"},
+		},
+		{
+			name: "secret and token flags",
+			args: []string{"--s3SecretKey", "abc", "--token=xyz"},
+			want: []string{"--s3SecretKey", "REDACTED", "--token=REDACTED"},
+		},
+		{
+			name: "password in connection uri",
+			args: []string{"--db-uri", "postgresql://quay:hunter2@db/quay", "--db-uri=postgres://quay:hunter2@db/quay"},
+			want: []string{"--db-uri", "postgresql://quay:REDACTED@db/quay", "--db-uri=postgres://quay:REDACTED@db/quay"},
+		},
+		{
+			name: "sensitive flag without value",
+			args: []string{"--initPassword", "--verbose"},
+			want: []string{"--initPassword", "--verbose"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactArgs(tt.args)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redactArgs(%v) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactConfigSetValue(t *testing.T) {
+	defer func() { auditRedactedArgs = nil }()
+
+	tests := []struct {
+		key, value string
+		redacted   bool
+	}{
+		{"DATABASE_SECRET_KEY", "4d1e5f0c", true},
+		{"LDAP_ADMIN_PASSWD", "hunter2", true},
+		{"DB_URI", "postgresql://quay:hunter2@db/quay", true},
+		{"DISTRIBUTED_STORAGE_CONFIG", "{default: [S3Storage, {s3_bucket: quay, s3_access_key: AKIA, s3_secret_key: abc}]}", true},
+		{"FEATURE_PROXY_CACHE", "true", false},
+		{"DISTRIBUTED_STORAGE_CONFIG", "{default: [LocalStorage, {storage_path: /datastorage}]}", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			auditRedactedArgs = nil
+			var value interface{}
+			if err := yaml.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			redactConfigValue(tt.key, value, tt.value)
+
+			args := []string{"config", "set", tt.key, tt.value, "--targetHostname", "quay.example.com"}
+			want := []string{"config", "set", tt.key, tt.value, "--targetHostname", "quay.example.com"}
+			if tt.redacted {
+				want[3] = "REDACTED"
+			}
+			if got := redactArgs(args); !reflect.DeepEqual(got, want) {
+				t.Errorf("redactArgs(%q) = %q, want %q", args, got, want)
+			}
+		})
+	}
+}
+
+func TestRecapWriter(t *testing.T) {
+	output := "TASK [mirror_appliance : Start Quay] ***\r\nok: [quay.example.com]\n\n" +
+		"PLAY RECAP *********************************************************************\n" +
+		"\x1b[0;33mquay.example.com\x1b[0m           : \x1b[0;32mok=20  \x1b[0m \x1b[0;33mchanged=5   \x1b[0m unreachable=0    failed=0    skipped=3    rescued=0    ignored=0   \r\n" +
+		"\n"
+
+	var out strings.Builder
+	w := &recapWriter{out: &out}
+	// Split the output to check that lines spanning writes are handled
+	for _, chunk := range []string{output[:40], output[40:130], output[130:]} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out.String() != output {
+		t.Errorf("output was not passed through unchanged")
+	}
+	want := map[string]playbookStats{
+		"quay.example.com": {"ok": 20, "changed": 5, "unreachable": 0, "failed": 0, "skipped": 3, "rescued": 0, "ignored": 0},
+	}
+	if !reflect.DeepEqual(w.stats, want) {
+		t.Errorf("stats = %v, want %v", w.stats, want)
+	}
+}
+
+func TestNewAuditRecordImages(t *testing.T) {
+	tests := []struct {
+		operation  string
+		wantImages bool
+	}{
+		{"install", true},
+		{"upgrade", true},
+		{"migrate-db", true},
+		{"uninstall", false},
+		{"config-set", false},
+		{"user-reset-password", false},
+	}
+	for _, tt := range tests {
+		record := newAuditRecord(&installState{Operation: tt.operation, Status: statusSucceeded})
+		if got := record.Images != nil; got != tt.wantImages {
+			t.Errorf("record of %s has images = %v, want %v", tt.operation, got, tt.wantImages)
+		}
+	}
+}
+
+func TestAuditCommand(t *testing.T) {
+	origHostname, origUsername, origQuayRoot := targetHostname, targetUsername, quayRoot
+	defer func() { targetHostname, targetUsername, quayRoot = origHostname, origUsername, origQuayRoot }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "localhost"
+	quayRoot = t.TempDir()
+
+	auditCommand("push")
+	runExitHooks()
+	audit := auditCommand("replicate")
+	audit.Status = statusSucceeded
+	runExitHooks()
+
+	records, err := readLocalAuditRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Operation != "push" || records[0].Outcome != statusFailed ||
+		records[1].Operation != "replicate" || records[1].Outcome != statusSucceeded {
+		t.Fatalf("records = %+v, want a failed push and a succeeded replicate", records)
+	}
+	if records[1].QuayRoot != quayRoot || records[1].Images != nil {
+		t.Errorf("replicate record = %+v, want quayRoot %s and no images", records[1], quayRoot)
+	}
+	if pathExists(path.Join(targetStateDir(), "state.json")) {
+		t.Error("auditCommand wrote state.json")
+	}
+}
+
+func TestAuditLogRoundTrip(t *testing.T) {
+	origHostname, origUsername, origQuayRoot := targetHostname, targetUsername, quayRoot
+	defer func() { targetHostname, targetUsername, quayRoot = origHostname, origUsername, origQuayRoot }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "localhost"
+	quayRoot = t.TempDir()
+
+	for _, status := range []string{statusFailed, statusSucceeded} {
+		recordAudit(&installState{
+			Operation:      "install",
+			Status:         status,
+			TargetHostname: "localhost",
+			QuayRoot:       quayRoot,
+			StartedAt:      time.Now().Add(-time.Minute).UTC(),
+		})
+	}
+
+	records, err := readLocalAuditRecords()
+	if err != nil {
+		t.Fatalf("readLocalAuditRecords returned error: %v", err)
+	}
+	if len(records) != 2 || records[0].Outcome != statusFailed || records[1].Outcome != statusSucceeded {
+		t.Fatalf("local records = %+v, want failed then succeeded install", records)
+	}
+	if records[1].DurationSeconds != 60 {
+		t.Errorf("duration = %v, want 60", records[1].DurationSeconds)
+	}
+
+	out, err := runOnTarget("cat "+targetPath(quayRoot+"/"+auditFileName), nil)
+	if err != nil {
+		t.Fatalf("reading target audit log: %v", err)
+	}
+	remote, err := readAuditRecords(strings.NewReader(string(out) + "not json\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remote) != 2 {
+		t.Errorf("target audit log has %d records, want 2", len(remote))
+	}
+
+	if got := filterAuditRecords(records, "other.example.com"); len(got) != 0 {
+		t.Errorf("filterAuditRecords kept %d records for another target", len(got))
+	}
+}
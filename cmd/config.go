@@ -0,0 +1,449 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// configBackupSuffix is appended to config.yaml for the copy kept by config set and config edit
+const configBackupSuffix = ".bak"
+
+// configShowSecrets prints passwords and secrets with config get
+var configShowSecrets bool
+
+// configAllowUnknown lets config set write keys missing from the schema
+var configAllowUnknown bool
+
+// configValidateFile is a local config.yaml checked by config validate instead of the one on the target
+var configValidateFile string
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "View and edit the Quay configuration of the target.",
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get [KEY]",
+	Short: "Print config.yaml, or the value of one of its keys.",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		configGet(cobraCmd, args)
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set KEY VALUE",
+	Short: "Set a key of config.yaml and restart Quay. VALUE is parsed as YAML, such as true, 30 or [1d, 2w].",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		configSet(cobraCmd, args[0], args[1])
+	},
+}
+
+var configEditCmd = &cobra.Command{
+	Use:   "edit",
+	Short: "Edit config.yaml with $EDITOR and restart Quay.",
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		configEdit(cobraCmd)
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check config.yaml against the settings known to mirror-registry.",
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		configValidate(cobraCmd)
+	},
+}
+
+var configDiffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the settings of config.yaml that differ from the configuration generated by install, and where they come from.",
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		configDiff(cobraCmd)
+	},
+}
+
+func init() {
+
+	// Add config command
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configEditCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configDiffCmd)
+
+	configCmd.PersistentFlags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	configCmd.PersistentFlags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	configCmd.PersistentFlags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	configCmd.PersistentFlags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+
+	configGetCmd.Flags().BoolVarP(&configShowSecrets, "show-secrets", "", false, "Print passwords and secrets instead of hiding them.")
+	configSetCmd.Flags().BoolVarP(&configAllowUnknown, "allow-unknown", "", false, "Set a key that is not a setting known to mirror-registry.")
+	configSetCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+	configEditCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+	configValidateCmd.Flags().StringVarP(&configValidateFile, "file", "f", "", "Check a local config.yaml instead of the one on the target.")
+	configDiffCmd.Flags().StringVarP(&configOverrideFile, "config-override", "", "", "Preview a local overrides file instead of the config-overrides.yaml of the target.")
+
+}
+
+// configTarget reuses the quayRoot of the last install unless --quayRoot was passed
+func configTarget(cobraCmd *cobra.Command) {
+	err := loadSSHKeys()
+	check(err)
+
+	previous, err := loadInstallState()
+	check(err)
+	if !cobraCmd.Flags().Changed("quayRoot") && previous.QuayRoot != "" {
+		quayRoot = previous.QuayRoot
+	}
+}
+
+func configGet(cobraCmd *cobra.Command, args []string) {
+
+	configTarget(cobraCmd)
+	data, err := readQuayConfig()
+	check(err)
+	config, err := parseConfig(data)
+	check(err)
+
+	var out interface{} = config
+	if len(args) == 1 {
+		value, ok := config[args[0]]
+		if !ok {
+			check(fmt.Errorf("%s is not set in config.yaml on %s", args[0], targetHostname))
+		}
+		out = value
+		if !configShowSecrets {
+			out = hideConfigSecrets(args[0], value)
+		}
+	} else if !configShowSecrets {
+		for key, value := range config {
+			config[key] = hideConfigSecrets(key, value)
+		}
+	}
+	encoded, err := yaml.Marshal(out)
+	check(err)
+	fmt.Print(string(encoded))
+}
+
+func configSet(cobraCmd *cobra.Command, key, rawValue string) {
+
+	var value interface{}
+	err := yaml.Unmarshal([]byte(rawValue), &value)
+	check(err)
+	redactConfigValue(key, value, rawValue)
+	if _, known := configKeySchemaFor(key); !known && !configAllowUnknown {
+		check(fmt.Errorf("%s is not a setting known to mirror-registry. Check its spelling, or pass --allow-unknown to set it anyway", key))
+	}
+	err = checkConfigValue(key, value)
+	check(err)
+
+	configTarget(cobraCmd)
+	applyConfigChange("config-set", func(current []byte) ([]byte, error) {
+		return setConfigValue(current, key, value)
+	})
+}
+
+func configEdit(cobraCmd *cobra.Command) {
+
+	err := requireInteractive("config edit", "Use config set KEY VALUE instead.")
+	check(err)
+	if !isTerminal(os.Stdin) {
+		check(errors.New("config edit needs a terminal to run the editor. Use config set KEY VALUE instead."))
+	}
+
+	configTarget(cobraCmd)
+	data, err := readQuayConfig()
+	check(err)
+
+	file, err := ioutil.TempFile("", "mirror-registry-config-*.yaml")
+	check(err)
+	_, err = file.Write(data)
+	check(err)
+	check(file.Close())
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", file.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	check(err)
+
+	edited, err := ioutil.ReadFile(file.Name())
+	check(err)
+	if bytes.Equal(edited, data) {
+		os.Remove(file.Name())
+		log.Printf("config.yaml was not changed")
+		return
+	}
+	if _, _, err := checkConfigChange(data, edited); err != nil {
+		check(fmt.Errorf("%w. config.yaml was not changed, your edits are kept in %s", err, file.Name()))
+	}
+	applyConfigChange("config-edit", func(current []byte) ([]byte, error) {
+		// Another run may have written config.yaml while the editor was open
+		if !bytes.Equal(current, data) {
+			return nil, fmt.Errorf("config.yaml on %s was changed by another run while it was being edited. config.yaml was not changed, your edits are kept in %s", targetHostname, file.Name())
+		}
+		os.Remove(file.Name())
+		return edited, nil
+	})
+}
+
+func configValidate(cobraCmd *cobra.Command) {
+
+	var data []byte
+	var err error
+	source := configValidateFile
+	if configValidateFile != "" {
+		data, err = ioutil.ReadFile(configValidateFile)
+	} else {
+		configTarget(cobraCmd)
+		source = quayConfigPath() + " on " + targetHostname
+		data, err = readQuayConfig()
+	}
+	check(err)
+	config, err := parseConfig(data)
+	if err != nil {
+		check(fmt.Errorf("%s is not valid YAML: %w", source, err))
+	}
+	problems, warnings := validateQuayConfig(config)
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+	for _, problem := range problems {
+		log.Error(problem)
+	}
+	if len(problems) > 0 {
+		check(fmt.Errorf("%s has %d errors", source, len(problems)))
+	}
+	log.Printf("%s is valid", source)
+}
+
+// checkConfigChange validates a new config.yaml and returns both configs
+func checkConfigChange(previous, updated []byte) (map[string]interface{}, map[string]interface{}, error) {
+	oldConfig, err := parseConfig(previous)
+	if err != nil {
+		return nil, nil, err
+	}
+	newConfig, err := parseConfig(updated)
+	if err != nil {
+		return nil, nil, fmt.Errorf("The new config.yaml is not valid YAML: %w", err)
+	}
+	problems, warnings := validateQuayConfig(newConfig)
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+	for _, problem := range problems {
+		log.Error(problem)
+	}
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("The new config.yaml has %d errors", len(problems))
+	}
+	return oldConfig, newConfig, nil
+}
+
+// applyConfigChange takes the lock of the target, then reads config.yaml and
+// writes the version returned by change, keeping a backup. It restarts
+// quay-app and puts the previous config.yaml back if Quay does not become
+// healthy.
+func applyConfigChange(operation string, change func(current []byte) ([]byte, error)) {
+
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target, and read config.yaml
+	// under the lock so that changes made by other runs are not overwritten
+	err := acquireLock(operation)
+	check(err)
+
+	previous, err := readQuayConfig()
+	check(err)
+	updated, err := change(previous)
+	check(err)
+	oldConfig, newConfig, err := checkConfigChange(previous, updated)
+	check(err)
+	changes := diffConfig(oldConfig, newConfig)
+	if len(changes) == 0 {
+		log.Printf("config.yaml already has these settings")
+		return
+	}
+	for _, change := range changes {
+		log.Infof("%s: %s -> %s", change.Path, displayConfigValue(change.Path, change.Old), displayConfigValue(change.Path, change.New))
+	}
+
+	state, err := beginOperation(operation, false)
+	check(err)
+
+	state.startStep("write-config")
+	err = writeQuayConfig(updated, configBackupSuffix)
+	if err == nil {
+		state.completeStep("write-config")
+		state.startStep("restart-quay")
+		err = restartQuayWithConfig(newConfig, oldConfig)
+		if err == nil {
+			state.completeStep("restart-quay")
+		}
+	}
+	finishOperation(ctx, state, err)
+
+	log.Printf("config.yaml was updated and Quay restarted. The previous version is %s", quayConfigPath()+configBackupSuffix)
+	data, err := readQuayConfigFile(configOverridesFile)
+	if err != nil {
+		log.Warnf("Could not check %s: %s", configOverridesFile, err.Error())
+		return
+	}
+	overrides, err := parseConfig(data)
+	if err != nil {
+		log.Warnf("Could not check %s: %s", configOverridesFile, err.Error())
+		return
+	}
+	if lost := configPathsNotIn(changes, overrides); len(lost) > 0 {
+		log.Warnf("Changes to %s are lost on the next install, as they are not in %s. Add them to it to keep them", strings.Join(lost, ", "), configOverridesFile)
+	}
+}
+
+// restartQuayWithConfig restarts quay-app and waits for it to become healthy.
+// Otherwise the new config.yaml is kept as config.yaml.rejected, the backup is
+// restored and quay-app restarted again.
+func restartQuayWithConfig(newConfig, oldConfig map[string]interface{}) error {
+	log.Info("Restarting Quay")
+	hostname, _ := newConfig["SERVER_HOSTNAME"].(string)
+	err := systemctlOnTarget("restart", "quay-app.service")
+	if err == nil {
+		err = waitForQuayOnTarget(hostname)
+	}
+	if err == nil {
+		return nil
+	}
+
+	log.Warnf("Quay did not become healthy with the new config.yaml, restoring the previous one")
+	rejected := targetPath(quayConfigPath() + ".rejected")
+	if _, copyErr := runOnTarget(fmt.Sprintf(`cp -p %s %s`, targetPath(quayConfigPath()), rejected), nil); copyErr != nil {
+		log.Warnf("Could not keep the rejected config.yaml: %s", copyErr.Error())
+	}
+	if restoreErr := restoreQuayConfig(configBackupSuffix); restoreErr != nil {
+		return fmt.Errorf("%w, and the previous config.yaml could not be restored: %s", err, restoreErr.Error())
+	}
+	oldHostname, _ := oldConfig["SERVER_HOSTNAME"].(string)
+	restartErr := systemctlOnTarget("restart", "quay-app.service")
+	if restartErr == nil {
+		restartErr = waitForQuayOnTarget(oldHostname)
+	}
+	if restartErr != nil {
+		return fmt.Errorf("%w, and Quay did not recover with the previous config.yaml: %s", err, restartErr.Error())
+	}
+	return fmt.Errorf("%w. The previous config.yaml was restored, and the rejected one saved as %s", err, quayConfigPath()+".rejected")
+}
+
+// hideConfigSecrets replaces the passwords and secrets of a config value.
+// Items of a list, such as the storage settings of DISTRIBUTED_STORAGE_CONFIG,
+// are checked at the path of the list.
+func hideConfigSecrets(configPath string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		hidden := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			hidden[key] = hideConfigSecrets(configPath+"."+key, item)
+		}
+		return hidden
+	case []interface{}:
+		if isSecretConfigPath(configPath) {
+			return "<hidden>"
+		}
+		hidden := make([]interface{}, len(v))
+		for i, item := range v {
+			hidden[i] = hideConfigSecrets(configPath, item)
+		}
+		return hidden
+	}
+	if value != nil && displayConfigValue(configPath, value) == "<hidden>" {
+		return "<hidden>"
+	}
+	return value
+}
+
+func configDiff(cobraCmd *cobra.Command) {
+
+	configTarget(cobraCmd)
+	data, err := readQuayConfig()
+	check(err)
+	current, err := parseConfig(data)
+	check(err)
+
+	var overrides map[string]interface{}
+	overridesSource := configOverridesFile
+	if configOverrideFile != "" {
+		overrides, err = loadConfigOverrides(configOverrideFile)
+		check(err)
+		overridesSource = configOverrideFile
+	} else {
+		data, err = readQuayConfigFile(configOverridesFile)
+		check(err)
+		overrides, err = parseConfig(data)
+		check(err)
+	}
+
+	// Installs made before config.generated.yaml was kept can only show the pending overrides
+	base := current
+	data, err = readQuayConfigFile(generatedConfigFile)
+	check(err)
+	if len(data) > 0 {
+		base, err = parseConfig(data)
+		check(err)
+	} else {
+		log.Warnf("%s was not found on %s, showing only the overrides that are not applied yet", generatedConfigFile, targetHostname)
+	}
+
+	effective := mergeConfig(current, overrides)
+	pending := map[string]bool{}
+	for _, change := range diffConfig(current, effective) {
+		pending[change.Path] = true
+	}
+
+	changes := diffConfig(base, effective)
+	if len(changes) == 0 {
+		log.Printf("config.yaml on %s has no changes from the generated configuration", targetHostname)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SETTING\tGENERATED\tEFFECTIVE\tSOURCE\n")
+	for _, change := range changes {
+		source := "config.yaml, lost on the next install"
+		if hasConfigPath(overrides, change.Path) {
+			source = overridesSource
+		}
+		if pending[change.Path] {
+			source += ", applied on the next install or upgrade"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", change.Path, displayConfigValue(change.Path, change.Old), displayConfigValue(change.Path, change.New), source)
+	}
+	check(w.Flush())
+}
+
+// displayConfigValue prints a config value, hiding passwords and secrets
+func displayConfigValue(configPath string, value interface{}) string {
+	if value == nil {
+		return "-"
+	}
+	if isSecretConfigPath(configPath) {
+		return "<hidden>"
+	}
+	return formatConfigValue(value)
+}
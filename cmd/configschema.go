@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of values of Quay config keys
+const (
+	configBool   = "boolean"
+	configInt    = "integer"
+	configString = "string"
+	configList   = "list"
+	configMap    = "mapping"
+)
+
+// configKeySchema describes the value of a Quay config key
+type configKeySchema struct {
+	kind     string
+	required bool
+	values   []string
+}
+
+// quayConfigSchema lists the Quay config keys known to the installer. Keys
+// starting with FEATURE_ and ending with _LOGIN_CONFIG are checked by
+// configKeySchemaFor.
+var quayConfigSchema = map[string]configKeySchema{
+	"AUTHENTICATION_TYPE":                   {kind: configString, required: true, values: []string{"Database", "LDAP", "OIDC", "JWT", "Keystone", "AppToken"}},
+	"BROWSER_API_CALLS_XHR_ONLY":            {kind: configBool},
+	"BUILDLOGS_REDIS":                       {kind: configMap, required: true},
+	"CREATE_NAMESPACE_ON_PUSH":              {kind: configBool},
+	"CREATE_PRIVATE_REPO_ON_PUSH":           {kind: configBool},
+	"DATABASE_SECRET_KEY":                   {kind: configString, required: true},
+	"DB_CONNECTION_ARGS":                    {kind: configMap},
+	"DB_URI":                                {kind: configString, required: true},
+	"DEFAULT_TAG_EXPIRATION":                {kind: configString},
+	"DISTRIBUTED_STORAGE_CONFIG":            {kind: configMap, required: true},
+	"DISTRIBUTED_STORAGE_DEFAULT_LOCATIONS": {kind: configList},
+	"DISTRIBUTED_STORAGE_PREFERENCE":        {kind: configList, required: true},
+	"ENTERPRISE_LOGO_URL":                   {kind: configString},
+	"GITHUB_TRIGGER_CONFIG":                 {kind: configMap},
+	"GITLAB_TRIGGER_KIND":                   {kind: configMap},
+	"GLOBAL_READONLY_SUPER_USERS":           {kind: configList},
+	"LDAP_ADMIN_DN":                         {kind: configString},
+	"LDAP_ADMIN_PASSWD":                     {kind: configString},
+	"LDAP_ALLOW_INSECURE_FALLBACK":          {kind: configBool},
+	"LDAP_BASE_DN":                          {kind: configList},
+	"LDAP_EMAIL_ATTR":                       {kind: configString},
+	"LDAP_SUPERUSER_FILTER":                 {kind: configString},
+	"LDAP_UID_ATTR":                         {kind: configString},
+	"LDAP_URI":                              {kind: configString},
+	"LDAP_USER_FILTER":                      {kind: configString},
+	"LDAP_USER_RDN":                         {kind: configList},
+	"LOGS_MODEL":                            {kind: configString, values: []string{"database", "transition_reads_both_writes_es", "elasticsearch", "splunk"}},
+	"LOGS_MODEL_CONFIG":                     {kind: configMap},
+	"LOG_ARCHIVE_LOCATION":                  {kind: configString},
+	"MAIL_DEFAULT_SENDER":                   {kind: configString},
+	"MAIL_PASSWORD":                         {kind: configString},
+	"MAIL_PORT":                             {kind: configInt},
+	"MAIL_SERVER":                           {kind: configString},
+	"MAIL_USERNAME":                         {kind: configString},
+	"MAIL_USE_TLS":                          {kind: configBool},
+	"MAXIMUM_LAYER_SIZE":                    {kind: configString},
+	"PERMANENTLY_DELETE_TAGS":               {kind: configBool},
+	"PREFERRED_URL_SCHEME":                  {kind: configString, values: []string{"http", "https"}},
+	"PUBLIC_NAMESPACES":                     {kind: configList},
+	"REGISTRY_STATE":                        {kind: configString, values: []string{"normal", "readonly"}},
+	"REGISTRY_TITLE":                        {kind: configString},
+	"REGISTRY_TITLE_SHORT":                  {kind: configString},
+	"REPO_MIRROR_INTERVAL":                  {kind: configInt},
+	"REPO_MIRROR_SERVER_HOSTNAME":           {kind: configString},
+	"REPO_MIRROR_TLS_VERIFY":                {kind: configBool},
+	"RESET_CHILD_MANIFEST_EXPIRATION":       {kind: configBool},
+	"SECRET_KEY":                            {kind: configString, required: true},
+	"SECURITY_SCANNER_INDEXING_INTERVAL":    {kind: configInt},
+	"SECURITY_SCANNER_ISSUER_NAME":          {kind: configString},
+	"SECURITY_SCANNER_V4_ENDPOINT":          {kind: configString},
+	"SECURITY_SCANNER_V4_PSK":               {kind: configString},
+	"SERVER_HOSTNAME":                       {kind: configString, required: true},
+	"SESSION_COOKIE_SECURE":                 {kind: configBool},
+	"SETUP_COMPLETE":                        {kind: configBool},
+	"SUPER_USERS":                           {kind: configList},
+	"TAG_EXPIRATION_OPTIONS":                {kind: configList},
+	"TEAM_RESYNC_STALE_TIME":                {kind: configString},
+	"TESTING":                               {kind: configBool},
+	"USERFILES_LOCATION":                    {kind: configString},
+	"USERFILES_PATH":                        {kind: configString},
+	"USER_EVENTS_REDIS":                     {kind: configMap, required: true},
+	"USE_CDN":                               {kind: configBool},
+}
+
+// secretConfigWords are parts of the names of the config keys holding
+// passwords, secrets and credentials
+var secretConfigWords = []string{"SECRET", "PASSW", "TOKEN", "ACCESS_KEY", "PSK", "DB_URI"}
+
+// isSecretConfigPath reports whether a dotted config path holds a password, secret or credential
+func isSecretConfigPath(configPath string) bool {
+	upper := strings.ToUpper(configPath)
+	for _, word := range secretConfigWords {
+		if strings.Contains(upper, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// configValueHasSecret reports whether a value set at a config path is a
+// secret, or contains one in its mappings and lists
+func configValueHasSecret(configPath string, value interface{}) bool {
+	if isSecretConfigPath(configPath) {
+		return true
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if configValueHasSecret(configPath+"."+key, item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if configValueHasSecret(configPath, item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configKeySchemaFor returns the schema of a key, and false when the key is unknown
+func configKeySchemaFor(key string) (configKeySchema, bool) {
+	if schema, ok := quayConfigSchema[key]; ok {
+		return schema, true
+	}
+	switch {
+	case strings.HasPrefix(key, "FEATURE_"):
+		return configKeySchema{kind: configBool}, true
+	case strings.HasSuffix(key, "_LOGIN_CONFIG"):
+		return configKeySchema{kind: configMap}, true
+	}
+	return configKeySchema{}, false
+}
+
+// configValueKind returns the kind of a value decoded from YAML
+func configValueKind(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return configBool
+	case int, int64, uint64:
+		return configInt
+	case string:
+		return configString
+	case []interface{}:
+		return configList
+	case map[string]interface{}:
+		return configMap
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// checkConfigValue checks the value of one key against the schema. Unknown
+// keys are not errors, as Quay has more settings than the installer knows.
+func checkConfigValue(key string, value interface{}) error {
+	schema, ok := configKeySchemaFor(key)
+	if !ok {
+		return nil
+	}
+	if value == nil {
+		if schema.required {
+			return fmt.Errorf("%s is required", key)
+		}
+		return nil
+	}
+	if kind := configValueKind(value); kind != schema.kind {
+		return fmt.Errorf("%s must be a %s, not a %s", key, schema.kind, kind)
+	}
+	if len(schema.values) > 0 && !contains(schema.values, value.(string)) {
+		return fmt.Errorf("%s must be one of %s, not %q", key, strings.Join(schema.values, ", "), value)
+	}
+	return nil
+}
+
+// validateQuayConfig checks a whole Quay config. It returns the errors that
+// would prevent Quay from starting, and warnings for the keys it does not know.
+func validateQuayConfig(config map[string]interface{}) (problems []string, warnings []string) {
+	var keys []string
+	for key := range config {
+		keys = append(keys, key)
+	}
+	for key, schema := range quayConfigSchema {
+		if _, ok := config[key]; !ok && schema.required {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, known := configKeySchemaFor(key); !known {
+			warnings = append(warnings, fmt.Sprintf("%s is not a setting known to mirror-registry, check its spelling", key))
+			continue
+		}
+		if err := checkConfigValue(key, config[key]); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	// Settings that depend on each other
+	if hostname, ok := config["SERVER_HOSTNAME"].(string); ok && strings.Contains(hostname, "://") {
+		problems = append(problems, "SERVER_HOSTNAME must be a host name and an optional port, without a scheme")
+	}
+	options, _ := config["TAG_EXPIRATION_OPTIONS"].([]interface{})
+	for _, option := range options {
+		if s, ok := option.(string); !ok || !tagExpirationPattern.MatchString(s) {
+			problems = append(problems, fmt.Sprintf("TAG_EXPIRATION_OPTIONS contains %v, use a number followed by s, m, h, d or w", option))
+		}
+	}
+	if expiration, ok := config["DEFAULT_TAG_EXPIRATION"].(string); ok {
+		if !tagExpirationPattern.MatchString(expiration) {
+			problems = append(problems, fmt.Sprintf("DEFAULT_TAG_EXPIRATION %q must be a number followed by s, m, h, d or w", expiration))
+		} else if len(options) > 0 && !containsValue(options, expiration) {
+			problems = append(problems, fmt.Sprintf("DEFAULT_TAG_EXPIRATION %s must be one of TAG_EXPIRATION_OPTIONS", expiration))
+		}
+	}
+	if config["AUTHENTICATION_TYPE"] == "LDAP" {
+		for _, key := range []string{"LDAP_URI", "LDAP_BASE_DN"} {
+			if config[key] == nil {
+				problems = append(problems, fmt.Sprintf("%s is required when AUTHENTICATION_TYPE is LDAP", key))
+			}
+		}
+	}
+	return problems, warnings
+}
+
+// containsValue reports whether values contains value
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
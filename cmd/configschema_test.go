@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigValue(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   interface{}
+		wantErr bool
+	}{
+		{"FEATURE_PROXY_CACHE", true, false},
+		{"FEATURE_PROXY_CACHE", "true", true},
+		{"REGISTRY_TITLE", "Acme", false},
+		{"REGISTRY_TITLE", 42, true},
+		{"REPO_MIRROR_INTERVAL", 30, false},
+		{"TAG_EXPIRATION_OPTIONS", []interface{}{"1d"}, false},
+		{"TAG_EXPIRATION_OPTIONS", "1d", true},
+		{"PREFERRED_URL_SCHEME", "ftp", true},
+		{"REGISTRY_STATE", "readonly", false},
+		{"KEYCLOAK_LOGIN_CONFIG", map[string]interface{}{"CLIENT_ID": "quay"}, false},
+		{"REPO_MIRROR_SERVER_HOSTNAME", nil, false},
+		{"SERVER_HOSTNAME", nil, true},
+		{"SOMETHING_UNKNOWN", 1, false},
+	}
+	for _, tt := range tests {
+		if err := checkConfigValue(tt.key, tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("checkConfigValue(%s, %v) error = %v, wantErr %v", tt.key, tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateQuayConfig(t *testing.T) {
+	// The config.yaml generated with the default settings must be valid and only use known settings
+	template, err := ioutil.ReadFile("../ansible-runner/context/app/project/roles/mirror_appliance/templates/config.yaml.j2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	skip := false
+	for _, line := range strings.Split(string(template), "\n") {
+		switch {
+		case strings.HasPrefix(line, "{% if"):
+			skip = true
+		case strings.HasPrefix(line, "{% else"):
+			skip = false
+		case strings.HasPrefix(line, "{% endif"):
+			skip = false
+		case strings.HasPrefix(line, "{%"):
+		case !skip:
+			lines = append(lines, line)
+		}
+	}
+	rendered := regexp.MustCompile(`\{\{ *([a-z_]+)[^}]*\}\}`).ReplaceAllString(strings.Join(lines, "\n"), "rendered-$1")
+	config, err := parseConfig([]byte(rendered))
+	if err != nil {
+		t.Fatalf("could not parse the rendered template: %v", err)
+	}
+	problems, warnings := validateQuayConfig(config)
+	if len(problems) > 0 || len(warnings) > 0 {
+		t.Errorf("template: problems %q, warnings %q", problems, warnings)
+	}
+
+	config["DEFAULT_TAG_EXPIRATION"] = "3w"
+	config["SERVER_HOSTNAME"] = "https://quay.example.com"
+	config["FEATURE_MAILING"] = "no"
+	config["REGISTRY_TITEL"] = "Acme"
+	delete(config, "SECRET_KEY")
+	problems, warnings = validateQuayConfig(config)
+	if len(problems) != 4 {
+		t.Errorf("problems = %q, want 4", problems)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "REGISTRY_TITEL") {
+		t.Errorf("warnings = %q", warnings)
+	}
+}
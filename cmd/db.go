@@ -0,0 +1,440 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// dbSnapshotDir is the folder on the target where database snapshots are written
+var dbSnapshotDir string
+
+// sqliteDatabaseFile is the path of the Quay database inside the sqlite-storage volume
+const sqliteDatabaseFile = "/sqlite/quay_sqlite.db"
+
+// dbCmd represents the db command
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Check and maintain the SQLite database of Quay.",
+}
+
+var dbCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Run the SQLite integrity and foreign key checks. Quay is put in read-only mode while they run.",
+	Run: func(cmd *cobra.Command, args []string) {
+		dbMaintenance(cmd, "check")
+	},
+}
+
+var dbVacuumCmd = &cobra.Command{
+	Use:   "vacuum",
+	Short: "Rebuild the database to reclaim free space and defragment it. Quay is stopped while it runs.",
+	Run: func(cmd *cobra.Command, args []string) {
+		dbMaintenance(cmd, "vacuum")
+	},
+}
+
+var dbAnalyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Refresh the statistics used by the SQLite query planner. Quay is put in read-only mode while it runs.",
+	Run: func(cmd *cobra.Command, args []string) {
+		dbMaintenance(cmd, "analyze")
+	},
+}
+
+var dbSizeCmd = &cobra.Command{
+	Use:   "size",
+	Short: "Print the size of the database, its free space and its largest tables.",
+	Run: func(cmd *cobra.Command, args []string) {
+		dbMaintenance(cmd, "size")
+	},
+}
+
+var dbSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Write a consistent copy of the database on the target. Quay is put in read-only mode while it is written.",
+	Run: func(cmd *cobra.Command, args []string) {
+		dbMaintenance(cmd, "snapshot")
+	},
+}
+
+func init() {
+
+	// Add db command
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbCheckCmd)
+	dbCmd.AddCommand(dbVacuumCmd)
+	dbCmd.AddCommand(dbAnalyzeCmd)
+	dbCmd.AddCommand(dbSizeCmd)
+	dbCmd.AddCommand(dbSnapshotCmd)
+
+	dbCmd.PersistentFlags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	dbCmd.PersistentFlags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	dbCmd.PersistentFlags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	dbCmd.PersistentFlags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	dbCmd.PersistentFlags().StringVarP(&sqliteStorage, "sqliteStorage", "", "sqlite-storage", "The folder where quay sqlite data is saved, used when it cannot be read from the running Quay container. This defaults to a Podman named volume 'sqlite-storage'.")
+	dbCmd.PersistentFlags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+
+	dbVacuumCmd.Flags().BoolVarP(&autoApprove, "autoApprove", "", false, "Skips interactive approval")
+	dbSnapshotCmd.Flags().StringVarP(&dbSnapshotDir, "dir", "", "", "The folder on the target to write the snapshot to. This defaults to <quayRoot>/sqlite-snapshots")
+
+}
+
+func dbMaintenance(cobraCmd *cobra.Command, action string) {
+
+	configTarget(cobraCmd)
+
+	hostname, source, err := sqliteDatabaseOnTarget()
+	check(err)
+	err = ensureSqliteCli()
+	check(err)
+
+	if action == "size" {
+		err = printDatabaseSize(source)
+		check(err)
+		return
+	}
+
+	if action == "vacuum" && !autoApprove {
+		err = requireInteractive("approval", "Re-run with --autoApprove to vacuum without prompting.")
+		check(err)
+		question := fmt.Sprintf("Quay on %s will be stopped while the database is vacuumed. Continue? [y/n]", targetHostname)
+		fmt.Println(question)
+		if !getApproval(question) {
+			log.Info("Vacuum cancelled.")
+			return
+		}
+	}
+
+	// Put Quay back in service and record the interruption on SIGINT/SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("db-" + action)
+	check(err)
+
+	state, err := beginOperation("db-"+action, false)
+	check(err)
+
+	switch action {
+	case "check":
+		err = withQuayReadOnly(state, hostname, func() error { return checkDatabase(source) })
+	case "analyze":
+		err = withQuayReadOnly(state, hostname, func() error {
+			log.Info("Analyzing the database")
+			_, err := runSqlite(source, "", "ANALYZE;")
+			return err
+		})
+	case "vacuum":
+		err = withQuayStopped(state, hostname, func() error { return vacuumDatabase(source) })
+	case "snapshot":
+		err = withQuayReadOnly(state, hostname, func() error { return snapshotDatabase(source) })
+	}
+	finishOperation(ctx, state, err)
+}
+
+// sqliteDatabaseOnTarget returns the SERVER_HOSTNAME of Quay and the volume or
+// folder holding its SQLite database, or an error if Quay does not use SQLite.
+func sqliteDatabaseOnTarget() (string, string, error) {
+	config, err := readQuayConfig()
+	if err != nil {
+		return "", "", err
+	}
+	uri, err := configValue(config, "DB_URI")
+	if err != nil {
+		return "", "", err
+	}
+	if s, ok := uri.(string); !ok || !strings.HasPrefix(s, "sqlite:") {
+		return "", "", fmt.Errorf("Quay on %s does not use SQLite. The db commands only maintain the SQLite database.", targetHostname)
+	}
+	hostname, _ := configValue(config, "SERVER_HOSTNAME")
+	_, source := runningQuayContainer()
+	return fmt.Sprint(hostname), source, nil
+}
+
+// ensureSqliteCli makes sure the sqlite3 CLI image is loaded on the target,
+// importing it from the sqlite3.tar archive next to the installer if needed.
+func ensureSqliteCli() error {
+	if _, err := runOnTarget("podman image exists "+shellQuote(sqliteImage), nil); err == nil {
+		return nil
+	}
+	if _, err := loadSqliteCli(); err != nil {
+		return err
+	}
+	if targetIsLocal() {
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	archive, err := os.Open(path.Join(path.Dir(executable), "sqlite3.tar"))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	log.Infof("Loading sqlite3 cli image on %s", targetHostname)
+	if _, err = runOnTarget(getImageMetadata("sqlite", sqliteImage, "/dev/stdin"), archive); err != nil {
+		return err
+	}
+	recordLoadedImage(imageHostTarget, sqliteImage)
+	return nil
+}
+
+// runSqlite runs the sqlite3 CLI against the Quay database. mount is an
+// optional folder of the target mounted at /snapshots.
+func runSqlite(source, mount string, sql string) ([]byte, error) {
+	// The volume is not relabeled so that Quay keeps access to it while the CLI runs
+	script := fmt.Sprintf(`podman run --rm -i --security-opt label=disable -v %s:/sqlite`, targetPath(source))
+	if mount != "" {
+		script += fmt.Sprintf(` -v %s:/snapshots`, targetPath(mount))
+	}
+	script += fmt.Sprintf(` %s -batch -bail %s`, shellQuote(sqliteImage), sqliteDatabaseFile)
+	return runOnTarget(script, strings.NewReader(sql))
+}
+
+// withQuayReadOnly runs fn with Quay in read-only mode, restoring config.yaml and restarting Quay afterwards
+func withQuayReadOnly(state *installState, hostname string, fn func() error) error {
+	state.startStep("readonly-quay")
+	config, err := readQuayConfig()
+	if err != nil {
+		return err
+	}
+	readOnly, err := setConfigValue(config, "REGISTRY_STATE", "readonly")
+	if err != nil {
+		return err
+	}
+	log.Info("Putting Quay in read-only mode")
+	if err := writeQuayConfig(readOnly, ".db-maintenance"); err != nil {
+		return err
+	}
+	restore := func() error {
+		log.Info("Taking Quay out of read-only mode")
+		if err := restoreQuayConfig(".db-maintenance"); err != nil {
+			return err
+		}
+		if err := systemctlOnTarget("restart", "quay-app.service"); err != nil {
+			return err
+		}
+		return waitForQuayOnTarget(hostname)
+	}
+	if err := systemctlOnTarget("restart", "quay-app.service"); err == nil {
+		err = waitForQuayOnTarget(hostname)
+	}
+	if err != nil {
+		if restoreErr := restore(); restoreErr != nil {
+			log.Warnf("Could not take Quay out of read-only mode: %s", restoreErr.Error())
+		}
+		return err
+	}
+	state.completeStep("readonly-quay")
+
+	return runMaintenance(state, fn, restore)
+}
+
+// withQuayStopped runs fn with Quay stopped, starting it again afterwards
+func withQuayStopped(state *installState, hostname string, fn func() error) error {
+	state.startStep("stop-quay")
+	log.Info("Stopping Quay")
+	if err := systemctlOnTarget("stop", "quay-app.service"); err != nil {
+		return err
+	}
+	state.completeStep("stop-quay")
+
+	return runMaintenance(state, fn, func() error {
+		log.Info("Starting Quay")
+		if err := systemctlOnTarget("start", "quay-app.service"); err != nil {
+			return err
+		}
+		return waitForQuayOnTarget(hostname)
+	})
+}
+
+// runMaintenance runs fn and then resume, which puts Quay back in service even when fn failed
+func runMaintenance(state *installState, fn, resume func() error) error {
+	state.startStep("maintenance")
+	err := fn()
+	if err == nil {
+		state.completeStep("maintenance")
+		state.startStep("resume-quay")
+	}
+	if resumeErr := resume(); resumeErr != nil {
+		if err != nil {
+			log.Warnf("Could not put Quay back in service: %s", resumeErr.Error())
+			return err
+		}
+		return resumeErr
+	}
+	if err == nil {
+		state.completeStep("resume-quay")
+	}
+	return err
+}
+
+// checkDatabase runs the integrity and foreign key checks of SQLite
+func checkDatabase(source string) error {
+	log.Info("Checking the integrity of the database. This may take some time.")
+	out, err := runSqlite(source, "", "PRAGMA integrity_check;")
+	if err != nil {
+		return err
+	}
+	if problems := outputLines(out); len(problems) != 1 || problems[0] != "ok" {
+		return fmt.Errorf("The integrity check found %d problems:\n%s", len(problems), strings.Join(firstLines(problems, 20), "\n"))
+	}
+	log.Info("Integrity check passed")
+
+	out, err = runSqlite(source, "", "PRAGMA foreign_key_check;")
+	if err != nil {
+		return err
+	}
+	if problems := outputLines(out); len(problems) > 0 {
+		return fmt.Errorf("The foreign key check found %d rows referencing missing rows (table|rowid|parent|key):\n%s", len(problems), strings.Join(firstLines(problems, 20), "\n"))
+	}
+	log.Info("Foreign key check passed")
+	return nil
+}
+
+// vacuumDatabase rebuilds the database and prints the space reclaimed
+func vacuumDatabase(source string) error {
+	before, err := databaseSize(source)
+	if err != nil {
+		return err
+	}
+	log.Infof("Vacuuming the database. The target needs up to %s of free space for the copy SQLite writes.", formatBytes(before.total()))
+	if _, err := runSqlite(source, "", "VACUUM;"); err != nil {
+		return err
+	}
+	after, err := databaseSize(source)
+	if err != nil {
+		return err
+	}
+	log.Infof("Database size went from %s to %s", formatBytes(before.total()), formatBytes(after.total()))
+	return nil
+}
+
+// snapshotDatabase writes a copy of the database with the SQLite backup API and checks it
+func snapshotDatabase(source string) error {
+	dir := dbSnapshotDir
+	if dir == "" {
+		dir = path.Join(quayRoot, "sqlite-snapshots")
+	}
+	if _, err := runOnTarget(fmt.Sprintf(`umask 077 && mkdir -p %s`, targetPath(dir)), nil); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("quay_sqlite-%s.db", time.Now().UTC().Format("20060102T150405Z"))
+	log.Infof("Writing snapshot %s", path.Join(dir, name))
+	if _, err := runSqlite(source, dir, fmt.Sprintf(".backup /snapshots/%s\n", name)); err != nil {
+		return err
+	}
+	out, err := runOnTarget(fmt.Sprintf(`podman run --rm -i --security-opt label=disable -v %s:/snapshots %s -batch -readonly /snapshots/%s`, targetPath(dir), shellQuote(sqliteImage), name), strings.NewReader("PRAGMA quick_check;"))
+	if err != nil {
+		return err
+	}
+	if lines := outputLines(out); len(lines) != 1 || lines[0] != "ok" {
+		return fmt.Errorf("The snapshot %s failed its integrity check:\n%s", path.Join(dir, name), strings.Join(firstLines(lines, 20), "\n"))
+	}
+	log.Infof("Snapshot written to %s on %s", path.Join(dir, name), targetHostname)
+	return nil
+}
+
+// sqliteSize describes the pages of a SQLite database
+type sqliteSize struct {
+	pageSize  int64
+	pageCount int64
+	freePages int64
+}
+
+func (s sqliteSize) total() int64 { return s.pageSize * s.pageCount }
+
+func (s sqliteSize) free() int64 { return s.pageSize * s.freePages }
+
+// databaseSize reads the page counts of the database
+func databaseSize(source string) (sqliteSize, error) {
+	var size sqliteSize
+	out, err := runSqlite(source, "", "PRAGMA page_size;\nPRAGMA page_count;\nPRAGMA freelist_count;\n")
+	if err != nil {
+		return size, err
+	}
+	lines := outputLines(out)
+	if len(lines) != 3 {
+		return size, fmt.Errorf("Unexpected output from sqlite3: %q", out)
+	}
+	for i, field := range []*int64{&size.pageSize, &size.pageCount, &size.freePages} {
+		if *field, err = strconv.ParseInt(lines[i], 10, 64); err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+// printDatabaseSize prints the size and free space of the database and its ten largest tables
+func printDatabaseSize(source string) error {
+	size, err := databaseSize(source)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database size: %s (%d pages of %d bytes)\n", formatBytes(size.total()), size.pageCount, size.pageSize)
+	fmt.Printf("Free space:    %s, reclaimable with 'mirror-registry db vacuum'\n", formatBytes(size.free()))
+
+	// The dbstat table is only available when SQLite was built with it
+	out, err := runSqlite(source, "", "SELECT name, SUM(pgsize) AS size FROM dbstat GROUP BY name ORDER BY size DESC LIMIT 10;")
+	if err != nil {
+		log.Debugf("Could not read table sizes: %s", err.Error())
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nTABLE OR INDEX\tSIZE")
+	for _, line := range outputLines(out) {
+		name, bytes, found := strings.Cut(line, "|")
+		if !found {
+			continue
+		}
+		n, _ := strconv.ParseInt(bytes, 10, 64)
+		fmt.Fprintf(w, "%s\t%s\n", name, formatBytes(n))
+	}
+	return w.Flush()
+}
+
+// outputLines returns the non-empty lines of a command output
+func outputLines(out []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// firstLines returns at most n lines, noting how many were left out
+func firstLines(lines []string, n int) []string {
+	if len(lines) <= n {
+		return lines
+	}
+	return append(lines[:n:n], fmt.Sprintf("... and %d more", len(lines)-n))
+}
+
+// formatBytes formats a size in bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
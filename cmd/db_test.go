@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.0 KiB",
+		1536:                   "1.5 KiB",
+		50 * 1024 * 1024:       "50.0 MiB",
+		3 * 1024 * 1024 * 1024: "3.0 GiB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestOutputLines(t *testing.T) {
+	got := outputLines([]byte("ok\n\n  row 12 missing from index  \r\n"))
+	want := []string{"ok", "row 12 missing from index"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("outputLines() = %q, want %q", got, want)
+	}
+
+	lines := []string{"a", "b", "c", "d"}
+	if got := firstLines(lines, 2); !reflect.DeepEqual(got, []string{"a", "b", "... and 2 more"}) {
+		t.Errorf("firstLines() = %q", got)
+	}
+	if got := firstLines(lines, 4); !reflect.DeepEqual(got, lines) {
+		t.Errorf("firstLines() = %q, want all lines", got)
+	}
+}
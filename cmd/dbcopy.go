@@ -0,0 +1,728 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite" // sqlite driver
+)
+
+// dbColumn is a column of a table along with the kind of values it holds
+type dbColumn struct {
+	Name string
+	Kind columnKind
+}
+
+// columnKind is the type of a column, independent of the database
+type columnKind int
+
+const (
+	kindText columnKind = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindTime
+	kindBytes
+)
+
+// tableCount is the number of rows and checksum of a table in the source and destination databases
+type tableCount struct {
+	Table          string `json:"table"`
+	Source         int64  `json:"source"`
+	Dest           int64  `json:"dest"`
+	SourceChecksum string `json:"sourceChecksum"`
+	DestChecksum   string `json:"destChecksum"`
+}
+
+// dbDialect hides the differences between the databases Quay can run on
+type dbDialect interface {
+	// name is the name of the database, used in messages
+	name() string
+	// tables lists the tables of the database
+	tables(ctx context.Context, db *sql.DB) ([]string, error)
+	// columns lists the columns of a table in order
+	columns(ctx context.Context, db *sql.DB, table string) ([]dbColumn, error)
+	// dependencies maps each table to the tables its foreign keys reference
+	dependencies(ctx context.Context, db *sql.DB) (map[string][]string, error)
+	// beginCopy empties the tables of the destination, which the Quay
+	// migrations fill with default rows, and prepares it for the copy
+	beginCopy(ctx context.Context, db *sql.DB, tables []string) error
+	// insertStatement prepares the statement inserting rows into a table
+	insertStatement(tx *sql.Tx, table string, columns []string) (*sql.Stmt, error)
+	// value converts a value to the representation expected by the database
+	value(v interface{}, kind columnKind) interface{}
+	// endCopy updates sequences and checks the destination after the copy
+	endCopy(ctx context.Context, db *sql.DB) error
+}
+
+// alembicTable is the table recording the schema revision. It is filled by the Quay migrations and not copied.
+const alembicTable = "alembic_version"
+
+// openDatabase opens a database from a Quay DB_URI
+func openDatabase(uri string) (*sql.DB, dbDialect, error) {
+	switch {
+	case strings.HasPrefix(uri, "sqlite:///"):
+		db, err := sql.Open("sqlite", "file:"+strings.TrimPrefix(uri, "sqlite:///"))
+		if err != nil {
+			return nil, nil, err
+		}
+		// SQLite only supports one writer, and foreign_keys is a per-connection setting
+		db.SetMaxOpenConns(1)
+		return db, sqliteDialect{}, nil
+	case strings.HasPrefix(uri, "postgresql://"), strings.HasPrefix(uri, "postgres://"):
+		db, err := sql.Open("postgres", uri)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, postgresDialect{}, nil
+	}
+	return nil, nil, fmt.Errorf("Unsupported database URI %s", redactURI(uri))
+}
+
+// schemaRevision returns the alembic revision of a Quay database
+func schemaRevision(ctx context.Context, db *sql.DB) (string, error) {
+	var revision string
+	err := db.QueryRowContext(ctx, "SELECT version_num FROM "+quoteIdent(alembicTable)).Scan(&revision)
+	return revision, err
+}
+
+// copyDatabase copies every table of src into dst, whose schema must already
+// exist. The row counts and checksums of every table are compared after the copy.
+func copyDatabase(ctx context.Context, src *sql.DB, srcDialect dbDialect, dst *sql.DB, dstDialect dbDialect) ([]tableCount, error) {
+	srcTables, err := srcDialect.tables(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	dstTables, err := dstDialect.tables(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := tablesToCopy(srcTables, dstTables)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := dstDialect.dependencies(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	tables = orderTables(tables, deps)
+
+	if err := dstDialect.beginCopy(ctx, dst, tables); err != nil {
+		return nil, err
+	}
+
+	var counts []tableCount
+	for _, table := range tables {
+		count, err := copyTable(ctx, table, src, srcDialect, dst, dstDialect)
+		if err != nil {
+			return counts, fmt.Errorf("Could not copy table %s: %w", table, err)
+		}
+		counts = append(counts, count)
+		log.Debugf("Copied %d rows of table %s", count.Dest, table)
+		if count.Source != count.Dest {
+			return counts, fmt.Errorf("Row count mismatch in table %s: %d rows in %s, %d rows in %s", table, count.Source, srcDialect.name(), count.Dest, dstDialect.name())
+		}
+		if count.SourceChecksum != count.DestChecksum {
+			return counts, fmt.Errorf("Checksum mismatch in table %s: %s in %s, %s in %s", table, count.SourceChecksum, srcDialect.name(), count.DestChecksum, dstDialect.name())
+		}
+	}
+
+	if err := dstDialect.endCopy(ctx, dst); err != nil {
+		return counts, err
+	}
+	return counts, nil
+}
+
+// tablesToCopy returns the tables present in both databases, or an error if
+// a table holding data would be left behind.
+func tablesToCopy(srcTables, dstTables []string) ([]string, error) {
+	inDst := map[string]bool{}
+	for _, table := range dstTables {
+		inDst[table] = true
+	}
+	var tables, missing []string
+	for _, table := range srcTables {
+		if table == alembicTable {
+			continue
+		}
+		if !inDst[table] {
+			missing = append(missing, table)
+			continue
+		}
+		tables = append(tables, table)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Tables missing from the destination schema: %s", strings.Join(missing, ", "))
+	}
+	return tables, nil
+}
+
+// orderTables sorts tables so that referenced tables are copied before the tables referencing them
+func orderTables(tables []string, deps map[string][]string) []string {
+	sort.Strings(tables)
+	wanted := map[string]bool{}
+	for _, table := range tables {
+		wanted[table] = true
+	}
+
+	var ordered []string
+	visited := map[string]bool{}
+	visiting := map[string]bool{}
+	var visit func(string)
+	visit = func(table string) {
+		if visited[table] || visiting[table] {
+			return
+		}
+		visiting[table] = true
+		refs := append([]string(nil), deps[table]...)
+		sort.Strings(refs)
+		for _, ref := range refs {
+			if wanted[ref] && ref != table {
+				visit(ref)
+			}
+		}
+		visiting[table] = false
+		visited[table] = true
+		ordered = append(ordered, table)
+	}
+	for _, table := range tables {
+		visit(table)
+	}
+	return ordered
+}
+
+// copyTable copies the rows of one table and counts them on both sides
+func copyTable(ctx context.Context, table string, src *sql.DB, srcDialect dbDialect, dst *sql.DB, dstDialect dbDialect) (tableCount, error) {
+	count := tableCount{Table: table}
+
+	srcColumns, err := srcDialect.columns(ctx, src, table)
+	if err != nil {
+		return count, err
+	}
+	dstColumns, err := dstDialect.columns(ctx, dst, table)
+	if err != nil {
+		return count, err
+	}
+	inSrc := map[string]bool{}
+	for _, column := range srcColumns {
+		inSrc[column.Name] = true
+	}
+	var columns []dbColumn
+	var names []string
+	orderByID := false
+	for _, column := range dstColumns {
+		if !inSrc[column.Name] {
+			continue
+		}
+		columns = append(columns, column)
+		names = append(names, column.Name)
+		if column.Name == "id" {
+			orderByID = true
+		}
+	}
+	if len(columns) < len(srcColumns) {
+		return count, fmt.Errorf("The destination table has fewer columns than the source")
+	}
+
+	if err := src.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoteIdent(table)).Scan(&count.Source); err != nil {
+		return count, err
+	}
+
+	query := "SELECT " + quoteIdents(names) + " FROM " + quoteIdent(table)
+	// Rows referencing earlier rows of the same table must be inserted after them
+	if orderByID {
+		query += " ORDER BY " + quoteIdent("id")
+	}
+	rows, err := src.QueryContext(ctx, query)
+	if err != nil {
+		return count, err
+	}
+	defer rows.Close()
+
+	tx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return count, err
+	}
+	defer tx.Rollback()
+	stmt, err := dstDialect.insertStatement(tx, table, names)
+	if err != nil {
+		return count, err
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	converted := make([]interface{}, len(columns))
+	var checksum tableChecksum
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		for i, column := range columns {
+			v, err := convertValue(values[i], column.Kind)
+			if err != nil {
+				return count, fmt.Errorf("column %s: %w", column.Name, err)
+			}
+			values[i] = v
+			converted[i] = dstDialect.value(v, column.Kind)
+		}
+		checksum.add(values)
+		if _, err := stmt.ExecContext(ctx, converted...); err != nil {
+			return count, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if err := closeInsertStatement(ctx, stmt, dstDialect); err != nil {
+		return count, err
+	}
+	if err := tx.Commit(); err != nil {
+		return count, err
+	}
+	count.SourceChecksum = checksum.String()
+
+	// Read the copied rows back to check what was actually written
+	count.Dest, count.DestChecksum, err = checksumTable(ctx, dst, table, columns)
+	return count, err
+}
+
+// checksumTable returns the number of rows of a table and the checksum of the given columns
+func checksumTable(ctx context.Context, db *sql.DB, table string, columns []dbColumn) (int64, string, error) {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	rows, err := db.QueryContext(ctx, "SELECT "+quoteIdents(names)+" FROM "+quoteIdent(table))
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	var checksum tableChecksum
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return n, "", err
+		}
+		for i, column := range columns {
+			v, err := convertValue(values[i], column.Kind)
+			if err != nil {
+				return n, "", fmt.Errorf("column %s: %w", column.Name, err)
+			}
+			values[i] = v
+		}
+		checksum.add(values)
+		n++
+	}
+	return n, checksum.String(), rows.Err()
+}
+
+// tableChecksum is a checksum of the rows of a table that does not depend on
+// the order the rows are read in or on the database they are stored in. It is
+// the sum of the SHA-256 hashes of the rows, modulo 2^256.
+type tableChecksum struct {
+	sum [4]uint64
+}
+
+// add adds a row of values returned by convertValue to the checksum
+func (c *tableChecksum) add(values []interface{}) {
+	h := sha256.New()
+	for _, v := range values {
+		value := canonicalValue(v)
+		fmt.Fprintf(h, "%d:%s", len(value), value)
+	}
+	digest := h.Sum(nil)
+	var carry uint64
+	for i := range c.sum {
+		word := binary.BigEndian.Uint64(digest[24-8*i:])
+		c.sum[i], carry = bits.Add64(c.sum[i], word, carry)
+	}
+}
+
+// String returns the first 16 hex digits of the checksum
+func (c *tableChecksum) String() string {
+	return fmt.Sprintf("%016x", c.sum[3])
+}
+
+// canonicalValue encodes a value returned by convertValue the same way whichever database it was read from
+func canonicalValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "N"
+	case bool:
+		return "B" + strconv.FormatBool(t)
+	case int64:
+		return "I" + strconv.FormatInt(t, 10)
+	case float64:
+		return "F" + strconv.FormatFloat(t, 'g', -1, 64)
+	case time.Time:
+		// Both databases store datetimes with microsecond precision
+		return "T" + t.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+	case []byte:
+		return "X" + hex.EncodeToString(t)
+	case string:
+		return "S" + t
+	}
+	return fmt.Sprintf("?%v", v)
+}
+
+// closeInsertStatement flushes the rows buffered by a COPY statement and closes the statement
+func closeInsertStatement(ctx context.Context, stmt *sql.Stmt, dialect dbDialect) error {
+	if _, ok := dialect.(postgresDialect); ok {
+		if _, err := stmt.ExecContext(ctx); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	return stmt.Close()
+}
+
+// timeLayouts are the formats datetimes are stored as text in SQLite
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// convertValue converts a value read from the source database to the Go type of the destination column
+func convertValue(v interface{}, kind columnKind) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch kind {
+	case kindBool:
+		switch t := v.(type) {
+		case bool:
+			return t, nil
+		case int64:
+			return t != 0, nil
+		case float64:
+			return t != 0, nil
+		case []byte:
+			return parseBool(string(t))
+		case string:
+			return parseBool(t)
+		}
+	case kindInt:
+		switch t := v.(type) {
+		case int64:
+			return t, nil
+		case bool:
+			if t {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case float64:
+			if t != float64(int64(t)) {
+				return nil, fmt.Errorf("%v is not an integer", t)
+			}
+			return int64(t), nil
+		case []byte:
+			return strconv.ParseInt(string(t), 10, 64)
+		case string:
+			return strconv.ParseInt(t, 10, 64)
+		}
+	case kindFloat:
+		switch t := v.(type) {
+		case float64:
+			return t, nil
+		case int64:
+			return float64(t), nil
+		case []byte:
+			return strconv.ParseFloat(string(t), 64)
+		case string:
+			return strconv.ParseFloat(t, 64)
+		}
+	case kindTime:
+		switch t := v.(type) {
+		case time.Time:
+			return t.UTC(), nil
+		case []byte:
+			return parseTime(string(t))
+		case string:
+			return parseTime(t)
+		case int64:
+			return time.Unix(t, 0).UTC(), nil
+		}
+	case kindBytes:
+		switch t := v.(type) {
+		case []byte:
+			return append([]byte(nil), t...), nil
+		case string:
+			return []byte(t), nil
+		}
+	case kindText:
+		switch t := v.(type) {
+		case string:
+			return t, nil
+		case []byte:
+			return string(t), nil
+		case int64:
+			return strconv.FormatInt(t, 10), nil
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(t), nil
+		case time.Time:
+			return t.UTC().Format("2006-01-02 15:04:05.999999"), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T value %v", v, v)
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "t", "true", "y", "yes":
+		return true, nil
+	case "0", "f", "false", "n", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", s)
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a datetime", s)
+}
+
+// kindOf maps a declared column type to the kind of values it holds
+func kindOf(declared string) columnKind {
+	t := strings.ToLower(declared)
+	switch {
+	case strings.Contains(t, "bool"):
+		return kindBool
+	case strings.Contains(t, "timestamp"), strings.Contains(t, "datetime"), t == "date":
+		return kindTime
+	case strings.Contains(t, "int"), strings.Contains(t, "serial"):
+		return kindInt
+	case strings.Contains(t, "bytea"), strings.Contains(t, "blob"):
+		return kindBytes
+	case strings.Contains(t, "double"), strings.Contains(t, "real"), strings.Contains(t, "float"),
+		strings.Contains(t, "numeric"), strings.Contains(t, "decimal"):
+		return kindFloat
+	}
+	return kindText
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteIdents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdent(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// sqliteDialect is the SQLite database Quay uses by default
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string { return "SQLite" }
+
+func (sqliteDialect) tables(ctx context.Context, db *sql.DB) ([]string, error) {
+	return queryStrings(ctx, db, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+}
+
+func (sqliteDialect) columns(ctx context.Context, db *sql.DB, table string) ([]dbColumn, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, type FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []dbColumn
+	for rows.Next() {
+		var name, declared string
+		if err := rows.Scan(&name, &declared); err != nil {
+			return nil, err
+		}
+		columns = append(columns, dbColumn{Name: name, Kind: kindOf(declared)})
+	}
+	return columns, rows.Err()
+}
+
+func (sqliteDialect) dependencies(ctx context.Context, db *sql.DB) (map[string][]string, error) {
+	// Foreign keys are not enforced during the copy
+	return nil, nil
+}
+
+func (sqliteDialect) beginCopy(ctx context.Context, db *sql.DB, tables []string) error {
+	if _, err := db.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if _, err := db.ExecContext(ctx, "DELETE FROM "+quoteIdent(table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sqliteDialect) insertStatement(tx *sql.Tx, table string, columns []string) (*sql.Stmt, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return tx.Prepare("INSERT INTO " + quoteIdent(table) + " (" + quoteIdents(columns) + ") VALUES (" + placeholders + ")")
+}
+
+// value stores booleans as integers and datetimes in the text format used by Quay
+func (sqliteDialect) value(v interface{}, kind columnKind) interface{} {
+	switch t := v.(type) {
+	case bool:
+		if t {
+			return int64(1)
+		}
+		return int64(0)
+	case time.Time:
+		if t.Nanosecond()/1000 != 0 {
+			return t.Format("2006-01-02 15:04:05.000000")
+		}
+		return t.Format("2006-01-02 15:04:05")
+	}
+	return v
+}
+
+func (sqliteDialect) endCopy(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return fmt.Errorf("The copied database has rows with broken foreign keys")
+	}
+	return rows.Err()
+}
+
+// postgresDialect is an external PostgreSQL database, or the legacy quay-postgres container
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return "PostgreSQL" }
+
+func (postgresDialect) tables(ctx context.Context, db *sql.DB) ([]string, error) {
+	return queryStrings(ctx, db, "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name")
+}
+
+func (postgresDialect) columns(ctx context.Context, db *sql.DB, table string) ([]dbColumn, error) {
+	rows, err := db.QueryContext(ctx, "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 ORDER BY ordinal_position", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []dbColumn
+	for rows.Next() {
+		var name, declared string
+		if err := rows.Scan(&name, &declared); err != nil {
+			return nil, err
+		}
+		columns = append(columns, dbColumn{Name: name, Kind: kindOf(declared)})
+	}
+	return columns, rows.Err()
+}
+
+func (postgresDialect) dependencies(ctx context.Context, db *sql.DB) (map[string][]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT c.conrelid::regclass::text, c.confrelid::regclass::text
+		FROM pg_constraint c JOIN pg_namespace n ON n.oid = c.connamespace
+		WHERE c.contype = 'f' AND n.nspname = current_schema()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deps := map[string][]string{}
+	for rows.Next() {
+		var table, ref string
+		if err := rows.Scan(&table, &ref); err != nil {
+			return nil, err
+		}
+		table, ref = strings.Trim(table, `"`), strings.Trim(ref, `"`)
+		deps[table] = append(deps[table], ref)
+	}
+	return deps, rows.Err()
+}
+
+func (postgresDialect) beginCopy(ctx context.Context, db *sql.DB, tables []string) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "TRUNCATE "+quoteIdents(tables)+" RESTART IDENTITY CASCADE")
+	return err
+}
+
+func (postgresDialect) insertStatement(tx *sql.Tx, table string, columns []string) (*sql.Stmt, error) {
+	return tx.Prepare(pq.CopyIn(table, columns...))
+}
+
+func (postgresDialect) value(v interface{}, kind columnKind) interface{} {
+	return v
+}
+
+// endCopy moves the sequences of serial columns past the copied ids
+func (postgresDialect) endCopy(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND column_default LIKE 'nextval(%'`)
+	if err != nil {
+		return err
+	}
+	type serial struct{ table, column string }
+	var serials []serial
+	for rows.Next() {
+		var s serial
+		if err := rows.Scan(&s.table, &s.column); err != nil {
+			rows.Close()
+			return err
+		}
+		serials = append(serials, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range serials {
+		query := fmt.Sprintf("SELECT setval(pg_get_serial_sequence($1, $2), COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false)", quoteIdent(s.column), quoteIdent(s.table))
+		if _, err := db.ExecContext(ctx, query, quoteIdent(s.table), s.column); err != nil {
+			return fmt.Errorf("Could not reset sequence of %s.%s: %w", s.table, s.column, err)
+		}
+	}
+	return nil
+}
+
+// queryStrings runs a query returning a single text column
+func queryStrings(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
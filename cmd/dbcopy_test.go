@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := map[string]columnKind{
+		"INTEGER":                     kindInt,
+		"bigint":                      kindInt,
+		"BOOLEAN":                     kindBool,
+		"DATETIME":                    kindTime,
+		"timestamp without time zone": kindTime,
+		"bytea":                       kindBytes,
+		"BLOB":                        kindBytes,
+		"double precision":            kindFloat,
+		"NUMERIC(10, 2)":              kindFloat,
+		"VARCHAR(255)":                kindText,
+		"text":                        kindText,
+		"":                            kindText,
+	}
+	for declared, want := range tests {
+		if got := kindOf(declared); got != want {
+			t.Errorf("kindOf(%q) = %v, want %v", declared, got, want)
+		}
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		kind    columnKind
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "null", value: nil, kind: kindBool, want: nil},
+		{name: "sqlite bool", value: int64(1), kind: kindBool, want: true},
+		{name: "text bool", value: []byte("false"), kind: kindBool, want: false},
+		{name: "invalid bool", value: "maybe", kind: kindBool, wantErr: true},
+		{name: "int from text", value: "42", kind: kindInt, want: int64(42)},
+		{name: "int from fraction", value: 1.5, kind: kindInt, wantErr: true},
+		{name: "float from int", value: int64(3), kind: kindFloat, want: float64(3)},
+		{name: "sqlite datetime", value: "2021-05-04 10:11:12.123456", kind: kindTime, want: time.Date(2021, 5, 4, 10, 11, 12, 123456000, time.UTC)},
+		{name: "datetime without fraction", value: []byte("2021-05-04 10:11:12"), kind: kindTime, want: time.Date(2021, 5, 4, 10, 11, 12, 0, time.UTC)},
+		{name: "bytes from text", value: "abc", kind: kindBytes, want: []byte("abc")},
+		{name: "text from bytes", value: []byte("abc"), kind: kindText, want: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertValue(tt.value, tt.kind)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("convertValue(%v) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("convertValue(%v) = %#v, want %#v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderTables(t *testing.T) {
+	deps := map[string][]string{
+		"repository":    {"user"},
+		"manifest":      {"repository", "mediatype"},
+		"user":          {"user"}, // self reference
+		"teammember":    {"team", "user"},
+		"team":          {"user"},
+		"notcopiedhere": {"user"},
+	}
+	got := orderTables([]string{"teammember", "manifest", "team", "repository", "user", "mediatype"}, deps)
+	position := map[string]int{}
+	for i, table := range got {
+		position[table] = i
+	}
+	if len(got) != 6 {
+		t.Fatalf("orderTables returned %v, want 6 tables", got)
+	}
+	for table, refs := range deps {
+		for _, ref := range refs {
+			if _, ok := position[table]; !ok || ref == table {
+				continue
+			}
+			if position[ref] > position[table] {
+				t.Errorf("%s is copied before %s which it references: %v", table, ref, got)
+			}
+		}
+	}
+}
+
+func TestCopyDatabaseSqlite(t *testing.T) {
+	ctx := context.Background()
+	schema := []string{
+		`CREATE TABLE alembic_version (version_num VARCHAR(32) NOT NULL)`,
+		`CREATE TABLE user (id INTEGER PRIMARY KEY, username VARCHAR(255), enabled BOOLEAN, created DATETIME)`,
+		`CREATE TABLE repository (id INTEGER PRIMARY KEY, namespace_user_id INTEGER REFERENCES user (id), name VARCHAR(255), blob BLOB)`,
+	}
+
+	open := func(name string) (*sql.DB, dbDialect) {
+		db, dialect, err := openDatabase("sqlite:///" + path.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		for _, statement := range schema {
+			if _, err := db.Exec(statement); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db, dialect
+	}
+	src, srcDialect := open("src.db")
+	dst, dstDialect := open("dst.db")
+
+	for _, statement := range []string{
+		`INSERT INTO alembic_version VALUES ('abc123')`,
+		`INSERT INTO user VALUES (1, 'admin', 1, '2021-05-04 10:11:12.5'), (2, 'robot', 0, NULL)`,
+		`INSERT INTO repository VALUES (1, 1, 'busybox', x'00ff'), (2, 2, 'alpine', NULL)`,
+	} {
+		if _, err := src.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rows inserted by the migrations are replaced by the copy
+	if _, err := dst.Exec(`INSERT INTO user VALUES (7, 'default', 1, NULL)`); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := copyDatabase(ctx, src, srcDialect, dst, dstDialect)
+	if err != nil {
+		t.Fatalf("copyDatabase returned error: %v", err)
+	}
+	if len(counts) != 2 || counts[0].Table != "repository" || counts[1].Table != "user" {
+		t.Fatalf("counts = %+v, want repository then user", counts)
+	}
+	for _, count := range counts {
+		if count.Source != 2 || count.Dest != 2 || count.SourceChecksum == "" || count.SourceChecksum != count.DestChecksum {
+			t.Errorf("count = %+v, want 2 rows with matching checksums", count)
+		}
+	}
+
+	var username string
+	var enabled bool
+	var created time.Time
+	if err := dst.QueryRow(`SELECT username, enabled, created FROM user WHERE id = 1`).Scan(&username, &enabled, &created); err != nil {
+		t.Fatal(err)
+	}
+	if username != "admin" || !enabled || !created.Equal(time.Date(2021, 5, 4, 10, 11, 12, 500000000, time.UTC)) {
+		t.Errorf("copied user = %s, %v, %s", username, enabled, created)
+	}
+	var blob []byte
+	if err := dst.QueryRow(`SELECT blob FROM repository WHERE id = 1`).Scan(&blob); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(blob, []byte{0x00, 0xff}) {
+		t.Errorf("copied blob = %v", blob)
+	}
+}
+
+func TestTableChecksum(t *testing.T) {
+	rows := [][]interface{}{
+		{int64(1), "admin", true, time.Date(2021, 5, 4, 10, 11, 12, 500000000, time.UTC)},
+		{int64(2), "robot", false, nil},
+	}
+	checksumOf := func(rows [][]interface{}) string {
+		var c tableChecksum
+		for _, row := range rows {
+			c.add(row)
+		}
+		return c.String()
+	}
+	want := checksumOf(rows)
+
+	if got := checksumOf([][]interface{}{rows[1], rows[0]}); got != want {
+		t.Errorf("checksum depends on row order: %s != %s", got, want)
+	}
+	// The same values read back from SQLite, converted for the column kinds
+	var converted [][]interface{}
+	for _, row := range [][]interface{}{{int64(1), []byte("admin"), int64(1), "2021-05-04 10:11:12.500000"}, {int64(2), "robot", int64(0), nil}} {
+		kinds := []columnKind{kindInt, kindText, kindBool, kindTime}
+		var values []interface{}
+		for i, v := range row {
+			c, err := convertValue(v, kinds[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, c)
+		}
+		converted = append(converted, values)
+	}
+	if got := checksumOf(converted); got != want {
+		t.Errorf("checksum depends on the database representation: %s != %s", got, want)
+	}
+	// Values must not run into each other
+	if checksumOf([][]interface{}{{"ab", "c"}}) == checksumOf([][]interface{}{{"a", "bc"}}) {
+		t.Error("checksum does not separate values")
+	}
+	if got := checksumOf([][]interface{}{rows[0], {int64(2), "robot", true, nil}}); got == want {
+		t.Error("checksum did not change with a value")
+	}
+}
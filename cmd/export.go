@@ -0,0 +1,435 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// exportRepos are the repositories to export, each with an optional tag
+var exportRepos []string
+
+// exportTo is the path of the archive written by export
+var exportTo string
+
+// exportTagRegex selects the tags of the repositories exported without a tag
+var exportTagRegex string
+
+// exportArchs are the architectures kept from multi-architecture images
+var exportArchs []string
+
+// importFrom is the archive or layout directory imported
+var importFrom string
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export repositories of Quay to an OCI image layout archive.",
+	Args:  cobra.NoArgs,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		export(cobraCmd)
+	},
+}
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Push every image of an archive written by export to Quay.",
+	Args:  cobra.NoArgs,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		importImages(cobraCmd)
+	},
+}
+
+func init() {
+
+	// Add export and import commands
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+
+	for _, c := range []*cobra.Command{exportCmd, importCmd} {
+		c.Flags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+		c.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+		c.Flags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+		c.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+		c.Flags().StringVarP(&quayHostname, "quayHostname", "", "", "The SERVER_HOSTNAME of Quay. This defaults to the value used by the last install, or <targetHostname>:8443")
+		c.Flags().StringVarP(&registryUsername, "username", "", "", "The Quay user to authenticate as. This defaults to the init user stored by install.")
+		c.Flags().StringVarP(&registryPasswordFile, "password-file", "", "", "The path of a file containing the password of --username. Can also be set with $MIRROR_REGISTRY_PASSWORD.")
+	}
+
+	exportCmd.Flags().StringArrayVarP(&exportRepos, "repo", "", nil, "A repository to export, such as ocp4/openshift/release, or a single tag of it, such as ocp4/openshift/release:4.14.1. Can be repeated.")
+	exportCmd.Flags().StringVarP(&exportTo, "to", "", "", "The path of the archive to write, such as bundle.tar.")
+	exportCmd.Flags().StringVarP(&exportTagRegex, "tag-regex", "", "", "Only export the tags matching this regular expression, such as '4\\.14\\..*'. Applies to the repositories given without a tag.")
+	exportCmd.Flags().StringSliceVarP(&exportArchs, "arch", "", nil, "Only keep these architectures of multi-architecture images, such as amd64,arm64 or arm/v7. All are kept by default.")
+	exportCmd.MarkFlagRequired("repo")
+	exportCmd.MarkFlagRequired("to")
+
+	importCmd.Flags().StringVarP(&importFrom, "from", "", "", "The archive written by export, or an OCI layout directory with images named <org>/<repo>:<tag>.")
+	importCmd.Flags().IntVarP(&registryParallel, "parallel", "", 4, "The number of blobs uploaded at the same time.")
+	importCmd.MarkFlagRequired("from")
+
+}
+
+// imageExporter collects the manifests and blobs of the exported images
+type imageExporter struct {
+	client *registryClient
+	archs  []string
+
+	// index lists the exported images, named <repo>:<tag>
+	index []ociDescriptor
+	// inline holds the manifests, and the configs read to check their architecture
+	inline map[string][]byte
+	// blobs are downloaded from the repository of the image that uses them first
+	blobs     []ociDescriptor
+	blobRepos map[string]string
+}
+
+func newImageExporter(client *registryClient, archs []string) *imageExporter {
+	return &imageExporter{client: client, archs: archs, inline: map[string][]byte{}, blobRepos: map[string]string{}}
+}
+
+// parseExportRepo splits org/repo[:tag] into the repository and an optional tag
+func parseExportRepo(ref string) (string, string, error) {
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return parseImageReference(ref, "")
+	}
+	repo := strings.TrimPrefix(ref, quayHostname+"/")
+	if !repositoryPattern.MatchString(repo) {
+		return "", "", fmt.Errorf("Invalid repository %q. Use lowercase ORG/REPO", repo)
+	}
+	return repo, "", nil
+}
+
+// matchTags returns the tags matching a regular expression, which must match the whole tag
+func matchTags(tags []string, expr string) ([]string, error) {
+	if expr == "" {
+		return tags, nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --tag-regex: %w", err)
+	}
+	var matched []string
+	for _, tag := range tags {
+		if re.MatchString(tag) {
+			matched = append(matched, tag)
+		}
+	}
+	return matched, nil
+}
+
+// matchPlatform reports whether a platform has one of the exported architectures
+func (e *imageExporter) matchPlatform(platform *ociPlatform) bool {
+	if len(e.archs) == 0 {
+		return true
+	}
+	if platform == nil {
+		return false
+	}
+	for _, arch := range e.archs {
+		parts := strings.SplitN(arch, "/", 2)
+		if platform.Architecture == parts[0] && (len(parts) == 1 || platform.Variant == parts[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTag adds the image of a tag. It returns false when the image has none
+// of the exported architectures.
+func (e *imageExporter) addTag(repo, tag string) (bool, error) {
+	data, mediaType, digest, err := e.client.getManifest(repo, tag)
+	if err != nil {
+		return false, err
+	}
+	desc, ok, err := e.addManifest(repo, data, mediaType, digest, true)
+	if err != nil || !ok {
+		return false, err
+	}
+	desc.Annotations = map[string]string{ociRefNameAnnotation: repo + ":" + tag}
+	e.index = append(e.index, desc)
+	return true, nil
+}
+
+// addManifest adds a manifest with its blobs, or an index with the manifests
+// of the exported architectures. An index losing some of its manifests is
+// rewritten, and so gets another digest.
+func (e *imageExporter) addManifest(repo string, data []byte, mediaType, digest string, checkArch bool) (ociDescriptor, bool, error) {
+	manifest, err := parseManifest(data, mediaType)
+	if err != nil {
+		return ociDescriptor{}, false, err
+	}
+	if manifest.isIndex() {
+		var kept []ociDescriptor
+		for _, child := range manifest.Manifests {
+			if !e.matchPlatform(child.Platform) {
+				continue
+			}
+			childData, childType, childDigest, err := e.client.getManifest(repo, child.Digest)
+			if err != nil {
+				return ociDescriptor{}, false, err
+			}
+			if childType == "" {
+				childType = child.MediaType
+			}
+			if _, _, err := e.addManifest(repo, childData, childType, childDigest, false); err != nil {
+				return ociDescriptor{}, false, fmt.Errorf("%s: %w", child.Platform, err)
+			}
+			kept = append(kept, child)
+		}
+		if len(kept) == 0 {
+			return ociDescriptor{}, false, nil
+		}
+		if len(kept) < len(manifest.Manifests) {
+			manifest.Manifests = kept
+			if data, err = json.Marshal(manifest); err != nil {
+				return ociDescriptor{}, false, err
+			}
+			digest = sha256Digest(data)
+		}
+	} else {
+		if checkArch && len(e.archs) > 0 && manifest.Config != nil {
+			ok, err := e.configMatches(repo, *manifest.Config)
+			if err != nil || !ok {
+				return ociDescriptor{}, false, err
+			}
+		}
+		for _, blob := range manifest.blobs() {
+			if _, ok := e.blobRepos[blob.Digest]; !ok {
+				e.blobRepos[blob.Digest] = repo
+				e.blobs = append(e.blobs, blob)
+			}
+		}
+	}
+	e.inline[digest] = data
+	return ociDescriptor{MediaType: manifest.MediaType, Digest: digest, Size: int64(len(data))}, true, nil
+}
+
+// configMatches reads the platform of a single-architecture image from its config
+func (e *imageExporter) configMatches(repo string, desc ociDescriptor) (bool, error) {
+	data, ok := e.inline[desc.Digest]
+	if !ok {
+		r, err := e.client.getBlob(repo, desc.Digest)
+		if err != nil {
+			return false, err
+		}
+		defer r.Close()
+		if data, err = ioutil.ReadAll(io.LimitReader(r, desc.Size)); err != nil {
+			return false, err
+		}
+		if sha256Digest(data) != desc.Digest {
+			return false, fmt.Errorf("config %s does not match its digest", desc.Digest)
+		}
+	}
+	platform := &ociPlatform{}
+	if err := json.Unmarshal(data, platform); err != nil {
+		return false, fmt.Errorf("Invalid config %s: %w", desc.Digest, err)
+	}
+	if !e.matchPlatform(platform) {
+		return false, nil
+	}
+	e.inline[desc.Digest] = data
+	return true, nil
+}
+
+// size returns the size of the blobs to download
+func (e *imageExporter) size() int64 {
+	var size int64
+	for _, blob := range e.blobs {
+		if e.inline[blob.Digest] == nil {
+			size += blob.Size
+		}
+	}
+	return size
+}
+
+// write writes the OCI image layout to a tar file. The archive is written
+// next to the file and renamed once complete.
+func (e *imageExporter) write(file string) error {
+	partial := file + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+	defer f.Close()
+
+	w := tar.NewWriter(f)
+	if err := writeTarFile(w, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	var digests []string
+	for digest := range e.inline {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	for _, digest := range digests {
+		if err := writeTarFile(w, blobPath(digest), e.inline[digest]); err != nil {
+			return err
+		}
+	}
+	for _, blob := range e.blobs {
+		if e.inline[blob.Digest] != nil {
+			continue
+		}
+		if err := e.writeBlob(w, blob); err != nil {
+			return err
+		}
+	}
+	index, err := json.MarshalIndent(ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: e.index}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(w, "index.json", index); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, file)
+}
+
+// writeBlob downloads a blob into the archive and checks its digest
+func (e *imageExporter) writeBlob(w *tar.Writer, blob ociDescriptor) error {
+	log.Debugf("Downloading blob %s (%s)", blob.Digest, formatBytes(blob.Size))
+	r, err := e.client.getBlob(e.blobRepos[blob.Digest], blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := w.WriteHeader(&tar.Header{Name: blobPath(blob.Digest), Mode: 0644, Size: blob.Size}); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), io.LimitReader(r, blob.Size)); err != nil {
+		return fmt.Errorf("Could not download blob %s: %w", blob.Digest, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != blob.Digest {
+		return fmt.Errorf("blob %s has the digest %s", blob.Digest, digest)
+	}
+	return nil
+}
+
+// writeTarFile adds a file to an archive
+func writeTarFile(w *tar.Writer, name string, data []byte) error {
+	if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func export(cobraCmd *cobra.Command) {
+
+	registryTarget(cobraCmd)
+	_, err := matchTags(nil, exportTagRegex)
+	check(err)
+	client, err := quayRegistryClient()
+	check(err)
+
+	exporter := newImageExporter(client, exportArchs)
+	for _, ref := range exportRepos {
+		repo, tag, err := parseExportRepo(ref)
+		check(err)
+		tags := []string{tag}
+		if tag == "" {
+			all, err := client.tags(repo)
+			check(err)
+			tags, err = matchTags(all, exportTagRegex)
+			check(err)
+			if len(tags) == 0 {
+				log.Warnf("No tag of %s matches --tag-regex %q", repo, exportTagRegex)
+			}
+		}
+		for _, tag := range tags {
+			ok, err := exporter.addTag(repo, tag)
+			if err != nil {
+				check(fmt.Errorf("Could not export %s:%s: %w", repo, tag, err))
+			}
+			if !ok {
+				log.Infof("Skipping %s:%s, it has none of the architectures %s", repo, tag, strings.Join(exportArchs, ", "))
+				continue
+			}
+			log.Infof("Exporting %s:%s", repo, tag)
+		}
+	}
+	if len(exporter.index) == 0 {
+		check(errors.New("Nothing to export"))
+	}
+
+	log.Infof("Downloading %d blobs (%s) to %s", len(exporter.blobs), formatBytes(exporter.size()), exportTo)
+	err = exporter.write(exportTo)
+	check(err)
+	log.Infof("Exported %d images to %s. Import it with: mirror-registry import --from %s", len(exporter.index), exportTo, exportTo)
+}
+
+func importImages(cobraCmd *cobra.Command) {
+
+	audit := auditCommand("import")
+	if registryParallel < 1 {
+		check(errors.New("--parallel must be at least 1"))
+	}
+	transport := "oci-archive"
+	if info, err := os.Stat(importFrom); err == nil && info.IsDir() {
+		transport = "oci"
+	}
+	source, err := openImageFiles(transport, importFrom)
+	check(err)
+	defer source.Close()
+	index, err := source.index()
+	check(err)
+
+	registryTarget(cobraCmd)
+	type image struct {
+		desc      ociDescriptor
+		repo, tag string
+	}
+	var images []image
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[ociRefNameAnnotation]
+		repo, tag, err := parseImageReference(name, "")
+		if err != nil {
+			check(fmt.Errorf("%s has an image named %q. Use push for images not named <org>/<repo>:<tag>", importFrom, name))
+		}
+		images = append(images, image{desc, repo, tag})
+	}
+	client, err := quayRegistryClient()
+	check(err)
+
+	locations := loadBlobLocations()
+	var uploaded, mounted, existing int
+	var size int64
+	for _, image := range images {
+		log.Infof("Pushing %s/%s:%s", quayHostname, image.repo, image.tag)
+		pusher := &imagePusher{client: client, source: source, repo: image.repo, parallel: registryParallel, locations: locations}
+		err = pusher.pushManifest(image.desc, image.tag)
+		uploaded, mounted, existing, size = uploaded+pusher.uploaded, mounted+pusher.mounted, existing+pusher.existing, size+pusher.bytes
+		if err != nil {
+			err = fmt.Errorf("%s:%s: %w", image.repo, image.tag, err)
+			break
+		}
+	}
+	if saveErr := locations.save(); saveErr != nil {
+		log.Warnf("Could not save the blob locations: %s", saveErr.Error())
+	}
+	if err != nil {
+		check(fmt.Errorf("%w. Run the same command again to continue, the blobs already pushed are not uploaded again", err))
+	}
+	log.Infof("Imported %d images: %d blobs uploaded (%s), %d mounted from other repositories, %d already present",
+		len(images), uploaded, formatBytes(size), mounted, existing)
+	audit.Status = statusSucceeded
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestMatchTags(t *testing.T) {
+	tags := []string{"4.14.1", "4.14.10", "4.15.0", "latest"}
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"", tags},
+		{`4\.14\..*`, []string{"4.14.1", "4.14.10"}},
+		{`4\.14\.1`, []string{"4.14.1"}},
+		{"stable", nil},
+	}
+	for _, tt := range tests {
+		got, err := matchTags(tags, tt.expr)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matchTags(%q) = %q, %v, want %q", tt.expr, got, err, tt.want)
+		}
+	}
+	if _, err := matchTags(tags, "4.(14"); err == nil {
+		t.Error("matchTags() accepted an invalid expression")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	files, root := testImageFiles(t)
+	dir := t.TempDir()
+	writeTestDir(t, path.Join(dir, "layout"), files)
+
+	// Fill the source registry with the multi-architecture test image
+	_, source := newFakeRegistry(t)
+	layout, err := openImageSource("oci:" + path.Join(dir, "layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layout.Close()
+	for _, tag := range []string{"v1", "v2"} {
+		pusher := &imagePusher{client: source, source: layout, repo: "ocp4/image", parallel: 2, locations: &blobLocations{repo: map[string]string{}}}
+		if err := pusher.pushManifest(layout.root, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		archs     []string
+		platforms int
+		sameRoot  bool
+		blobs     int
+	}{
+		{"all architectures", nil, 2, true, 5},
+		{"amd64 only", []string{"amd64"}, 1, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := newImageExporter(source, tt.archs)
+			for _, tag := range []string{"v1", "v2"} {
+				if ok, err := exporter.addTag("ocp4/image", tag); err != nil || !ok {
+					t.Fatalf("addTag(%s) = %v, %v", tag, ok, err)
+				}
+			}
+			if len(exporter.blobs) != tt.blobs {
+				t.Errorf("%d blobs, want %d", len(exporter.blobs), tt.blobs)
+			}
+			bundle := path.Join(t.TempDir(), "bundle.tar")
+			if err := exporter.write(bundle); err != nil {
+				t.Fatal(err)
+			}
+
+			image, err := openImageSource("oci-archive:" + bundle + ":ocp4/image:v2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer image.Close()
+			_, index, err := image.readManifest(image.root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(index.Manifests) != tt.platforms || (image.root.Digest == root.Digest) != tt.sameRoot {
+				t.Errorf("exported %d platforms as %s, want %d", len(index.Manifests), image.root.Digest, tt.platforms)
+			}
+
+			_, dest := newFakeRegistry(t)
+			pusher := &imagePusher{client: dest, source: image, repo: "ocp4/image", parallel: 2, locations: &blobLocations{repo: map[string]string{}}}
+			if err := pusher.pushManifest(image.root, "v2"); err != nil {
+				t.Fatal(err)
+			}
+			if digest, err := dest.headManifest("ocp4/image", "v2"); err != nil || digest != image.root.Digest {
+				t.Errorf("imported v2 = %q, %v, want %s", digest, err, image.root.Digest)
+			}
+		})
+	}
+}
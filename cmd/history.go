@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// historyRemote holds whether to read the audit log on the target instead of the local one
+var historyRemote bool
+
+// historyLimit is the maximum number of records to show
+var historyLimit int
+
+// historyJSON holds whether to print the raw JSON records
+var historyJSON bool
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the install, upgrade and uninstall runs recorded in the audit log.",
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		history(cobraCmd)
+	},
+}
+
+func init() {
+
+	// Add history command
+	rootCmd.AddCommand(historyCmd)
+
+	historyCmd.Flags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "Only list runs against this target. With --remote, the target to read the audit log from. This defaults to $HOST")
+	historyCmd.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	historyCmd.Flags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	historyCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	historyCmd.Flags().BoolVarP(&historyRemote, "remote", "", false, "Read the audit log kept under quayRoot on the target instead of the local one.")
+	historyCmd.Flags().IntVarP(&historyLimit, "limit", "n", 0, "Only show the most recent runs. This defaults to showing all runs.")
+	historyCmd.Flags().BoolVarP(&historyJSON, "json", "", false, "Print the records as JSON lines.")
+
+}
+
+func history(cobraCmd *cobra.Command) {
+
+	var records []auditRecord
+	var err error
+	if historyRemote {
+		var out []byte
+		out, err = runOnTarget("cat "+targetPath(path.Join(quayRoot, auditFileName))+" 2>/dev/null || true", nil)
+		check(err)
+		records, err = readAuditRecords(bytes.NewReader(out))
+		check(err)
+	} else {
+		records, err = readLocalAuditRecords()
+		check(err)
+		if cobraCmd.Flags().Changed("targetHostname") {
+			records = filterAuditRecords(records, targetHostname)
+		}
+	}
+
+	if historyLimit > 0 && len(records) > historyLimit {
+		records = records[len(records)-historyLimit:]
+	}
+
+	if historyJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, record := range records {
+			check(encoder.Encode(record))
+		}
+		return
+	}
+
+	if len(records) == 0 {
+		log.Info("No runs recorded")
+		return
+	}
+	printAuditRecords(records)
+}
+
+// filterAuditRecords keeps the records of runs against the given target
+func filterAuditRecords(records []auditRecord, target string) []auditRecord {
+	var filtered []auditRecord
+	for _, record := range records {
+		if record.TargetHostname == target {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+// printAuditRecords prints the records as a table, oldest first
+func printAuditRecords(records []auditRecord) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tOPERATION\tOUTCOME\tDURATION\tBY\tTARGET\tVERSION\tSTEP")
+	for _, record := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			record.Timestamp.Local().Format("2006-01-02 15:04:05"),
+			record.Operation,
+			record.Outcome,
+			time.Duration(record.DurationSeconds*float64(time.Second)).String(),
+			record.User+"@"+record.Host,
+			record.TargetUsername+"@"+record.TargetHostname,
+			orDash(record.Version),
+			orDash(record.Step),
+		)
+	}
+	w.Flush()
+}
+
+// orDash returns s, or a dash when s is empty
+func orDash(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return s
+}
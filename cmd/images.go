@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Hosts an image can be loaded on
+const (
+	imageHostInstaller = "installer"
+	imageHostTarget    = "target"
+)
+
+// loadedImage is an image the installer imported into podman storage
+type loadedImage struct {
+	Reference string `json:"reference"`
+	ID        string `json:"id"`
+	Host      string `json:"host"`
+}
+
+// errImageInUse is returned by removeImage when a container still uses the image
+type errImageInUse struct {
+	containers string
+}
+
+func (e errImageInUse) Error() string {
+	return "used by " + e.containers
+}
+
+// loadedImagesFile returns the file listing the images loaded for the current target
+func loadedImagesFile() string {
+	return path.Join(targetStateDir(), "images.json")
+}
+
+// targetImagesFile is where the playbooks list the images they loaded on the
+// target, one "<reference> <id>" line per image. It is mounted at /runner/state.
+func targetImagesFile() string {
+	return path.Join(targetStateDir(), "loaded-images")
+}
+
+// readLoadedImages reads the images loaded for the current target. A missing file yields no images.
+func readLoadedImages() ([]loadedImage, error) {
+	data, err := ioutil.ReadFile(loadedImagesFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []loadedImage
+	err = json.Unmarshal(data, &images)
+	return images, err
+}
+
+// writeLoadedImages replaces the list of images loaded for the current target
+func writeLoadedImages(images []loadedImage) error {
+	if err := os.MkdirAll(targetStateDir(), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(loadedImagesFile(), data, 0600)
+}
+
+// mergeLoadedImages adds images to a list, replacing the entries with the same host and ID
+func mergeLoadedImages(images []loadedImage, added ...loadedImage) []loadedImage {
+	for _, image := range added {
+		replaced := false
+		for i := range images {
+			if images[i].Host == image.Host && images[i].ID == image.ID {
+				images[i] = image
+				replaced = true
+			}
+		}
+		if !replaced {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// recordLoadedImage records that the installer loaded an image on a host.
+// Failing to record it is reported but does not fail the operation.
+func recordLoadedImage(host, reference string) {
+	out, err := runImageCommand(host, "podman image inspect --format '{{.Id}}' "+shellQuote(reference))
+	if err != nil {
+		log.Warnf("Could not record loaded image %s: %s", reference, err.Error())
+		return
+	}
+	images, err := readLoadedImages()
+	if err == nil {
+		images = mergeLoadedImages(images, loadedImage{Reference: reference, ID: strings.TrimSpace(string(out)), Host: host})
+		err = writeLoadedImages(images)
+	}
+	if err != nil {
+		log.Warnf("Could not record loaded image %s: %s", reference, err.Error())
+	}
+}
+
+// collectTargetImages moves the images listed by the playbooks into the list
+// of images loaded for the current target.
+func collectTargetImages() {
+	data, err := ioutil.ReadFile(targetImagesFile())
+	if err != nil {
+		return
+	}
+	var added []loadedImage
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			added = append(added, loadedImage{Reference: fields[0], ID: fields[1], Host: imageHostTarget})
+		}
+	}
+	images, err := readLoadedImages()
+	if err == nil {
+		err = writeLoadedImages(mergeLoadedImages(images, added...))
+	}
+	if err != nil {
+		log.Warnf("Could not record the images loaded on %s: %s", targetHostname, err.Error())
+		return
+	}
+	os.Remove(targetImagesFile())
+}
+
+// runImageCommand runs a script on the installer host or on the target
+func runImageCommand(host, script string) ([]byte, error) {
+	if host == imageHostTarget {
+		return runOnTarget(script, nil)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return out, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// removeImage removes an image unless a container still uses it, and reports
+// whether it was removed. The reference is only untagged when it still points
+// to the loaded image, and an image whose ID is unknown is removed by reference.
+func removeImage(image loadedImage) (bool, error) {
+	id := image.ID
+	if id == "" {
+		id = image.Reference
+	}
+	script := fmt.Sprintf(`id=%s; ref=%s
+podman image exists "$id" || exit 0
+users=$(podman ps -a --filter ancestor="$id" --format '{{.Names}}' | paste -sd, -)
+if [ -n "$users" ]; then echo "$users"; exit 3; fi
+if [ "$(podman image inspect --format '{{.Id}}' "$ref" 2>/dev/null)" = "$(podman image inspect --format '{{.Id}}' "$id")" ]; then
+  podman image rm "$ref" >/dev/null
+fi
+if podman image exists "$id" && [ -z "$(podman image inspect --format '{{join .RepoTags ","}}' "$id")" ]; then
+  podman image rm "$id" >/dev/null
+fi
+podman image exists "$id" || echo removed`, shellQuote(id), shellQuote(image.Reference))
+	out, err := runImageCommand(image.Host, script)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		return false, errImageInUse{containers: strings.TrimSpace(string(out))}
+	}
+	return strings.TrimSpace(string(out)) == "removed", err
+}
+
+// removeLoadedImages removes the images the installer loaded for the current
+// target, on the target and on the installer host. With purge, the Quay, Redis,
+// pause and SQLite images are removed from the target even when another tool
+// loaded them. Images still used by a container are skipped with a warning.
+func removeLoadedImages(purge bool) error {
+	images, err := readLoadedImages()
+	if err != nil {
+		return err
+	}
+	if purge {
+		tracked := map[string]bool{}
+		for _, image := range images {
+			if image.Host == imageHostTarget {
+				tracked[image.Reference] = true
+			}
+		}
+		for _, reference := range []string{quayImage, redisImage, pauseImage, sqliteImage} {
+			if !tracked[reference] {
+				images = append(images, loadedImage{Reference: reference, Host: imageHostTarget})
+			}
+		}
+	}
+
+	var kept []loadedImage
+	for _, image := range images {
+		where := targetHostname
+		if image.Host == imageHostInstaller {
+			where = "this host"
+		}
+		removed, err := removeImage(image)
+		switch err.(type) {
+		case nil:
+			if removed {
+				log.Infof("Removed image %s from %s", image.Reference, where)
+			} else {
+				log.Debugf("Image %s is no longer on %s or is tagged with another name", image.Reference, where)
+			}
+		case errImageInUse:
+			log.Warnf("Skipping image %s on %s, which is %s", image.Reference, where, err.Error())
+			kept = append(kept, image)
+		default:
+			log.Warnf("Could not remove image %s from %s: %s", image.Reference, where, err.Error())
+			kept = append(kept, image)
+		}
+	}
+	var tracked []loadedImage
+	for _, image := range kept {
+		if image.ID != "" {
+			tracked = append(tracked, image)
+		}
+	}
+	return writeLoadedImages(tracked)
+}
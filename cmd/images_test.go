@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestCollectTargetImages(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "quay.example.com"
+
+	if err := writeLoadedImages([]loadedImage{
+		{Reference: "registry.example.com/ee:v1", ID: "ee1", Host: imageHostInstaller},
+		{Reference: "registry.example.com/quay:v1", ID: "quay1", Host: imageHostTarget},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	lines := "registry.example.com/quay:v1 quay1\nregistry.example.com/redis:v1 redis1\nnot an image line\n"
+	if err := ioutil.WriteFile(targetImagesFile(), []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	collectTargetImages()
+
+	got, err := readLoadedImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []loadedImage{
+		{Reference: "registry.example.com/ee:v1", ID: "ee1", Host: imageHostInstaller},
+		{Reference: "registry.example.com/quay:v1", ID: "quay1", Host: imageHostTarget},
+		{Reference: "registry.example.com/redis:v1", ID: "redis1", Host: imageHostTarget},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded images = %+v, want %+v", got, want)
+	}
+	if pathExists(targetImagesFile()) {
+		t.Error("the list written by the playbooks was not removed")
+	}
+}
@@ -0,0 +1,361 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ociRefNameAnnotation names the manifests of the index of an OCI image layout
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// imageSource is a local image in an OCI image layout or a docker-archive.
+// Blobs and manifests are read with random access, so that archives are read
+// in place without extracting them.
+type imageSource struct {
+	// root is the manifest or index to push
+	root ociDescriptor
+	// refName is the tag the image was saved with, if any
+	refName string
+
+	dir     string
+	archive *os.File
+	entries map[string]*io.SectionReader
+	blobs   map[string][]byte
+}
+
+// sourceFile is a file of an OCI layout or an entry of an archive. Closing it
+// closes the file of a layout, and does nothing for an archive entry, which
+// is closed with the archive.
+type sourceFile struct {
+	*io.SectionReader
+	file *os.File
+}
+
+// Close closes the file of a layout
+func (f *sourceFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// parseImageSource splits a source such as oci:/path/layout:tag into its
+// transport, path and reference. The path is the longest prefix that exists,
+// as both paths and references may contain colons.
+func parseImageSource(source string) (string, string, string, error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || !oneOf(parts[0], "oci", "oci-archive", "docker-archive") {
+		return "", "", "", fmt.Errorf("Invalid source %q. Use oci:/path[:tag], oci-archive:/path.tar[:tag] or docker-archive:/path.tar[:name:tag]", source)
+	}
+	transport, rest := parts[0], parts[1]
+	if pathExists(rest) {
+		return transport, rest, "", nil
+	}
+	for i := len(rest) - 1; i > 0; i-- {
+		if rest[i] == ':' && pathExists(rest[:i]) {
+			return transport, rest[:i], rest[i+1:], nil
+		}
+	}
+	return "", "", "", fmt.Errorf("Could not find %s", rest)
+}
+
+// openImageSource opens the image of a source such as oci:/path/layout:tag
+func openImageSource(source string) (*imageSource, error) {
+	transport, file, reference, err := parseImageSource(source)
+	if err != nil {
+		return nil, err
+	}
+	src, err := openImageFiles(transport, file)
+	if err != nil {
+		return nil, err
+	}
+	if transport == "docker-archive" {
+		err = src.loadDockerArchive(reference)
+	} else {
+		err = src.loadOCIIndex(reference)
+	}
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("Could not read %s: %w", source, err)
+	}
+	return src, nil
+}
+
+// openImageFiles opens an OCI layout directory, or indexes the entries of an archive
+func openImageFiles(transport, file string) (*imageSource, error) {
+	src := &imageSource{blobs: map[string][]byte{}}
+	if transport != "oci" {
+		if err := src.openTar(file); err != nil {
+			src.Close()
+			return nil, err
+		}
+		return src, nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory. Use oci-archive: for an OCI layout in a tar file", file)
+	}
+	src.dir = file
+	return src, nil
+}
+
+// openTar indexes the entries of an uncompressed tar file
+func (s *imageSource) openTar(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	s.archive = f
+	s.entries = map[string]*io.SectionReader{}
+	magic := make([]byte, 2)
+	if _, err := f.ReadAt(magic, 0); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return fmt.Errorf("%s is compressed. Decompress it with gunzip first", file)
+	}
+	counter := &countingReader{r: bufio.NewReader(f)}
+	reader := tar.NewReader(counter)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not a tar file: %w", file, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The content of a regular entry starts where its header ends
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		s.entries[name] = io.NewSectionReader(f, counter.n, header.Size)
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openFile returns a file of the layout or the archive, which the caller closes.
+// Files of a layout are opened one at a time, so that pushing a layout with
+// many blobs does not hold a file descriptor for each of them.
+func (s *imageSource) openFile(name string) (*sourceFile, error) {
+	if s.dir == "" {
+		entry, ok := s.entries[path.Clean(name)]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", name)
+		}
+		return &sourceFile{SectionReader: io.NewSectionReader(entry, 0, entry.Size())}, nil
+	}
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sourceFile{SectionReader: io.NewSectionReader(f, 0, info.Size()), file: f}, nil
+}
+
+// readFile returns the whole content of a file of the layout or the archive
+func (s *imageSource) readFile(name string) ([]byte, error) {
+	r, err := s.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// open returns a blob or a manifest by digest, which the caller closes
+func (s *imageSource) open(digest string) (*sourceFile, error) {
+	if data, ok := s.blobs[digest]; ok {
+		return &sourceFile{SectionReader: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))}, nil
+	}
+	if !digestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("Unsupported digest %q", digest)
+	}
+	r, err := s.openFile(blobPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("blob %s is missing from the image", digest)
+	}
+	return r, nil
+}
+
+// readManifest returns a manifest by descriptor
+func (s *imageSource) readManifest(desc ociDescriptor) ([]byte, *ociManifest, error) {
+	r, err := s.open(desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sha256Digest(data) != desc.Digest {
+		return nil, nil, fmt.Errorf("manifest %s does not match its digest", desc.Digest)
+	}
+	manifest, err := parseManifest(data, desc.MediaType)
+	return data, manifest, err
+}
+
+// index returns the index.json of an OCI layout
+func (s *imageSource) index() (*ociManifest, error) {
+	data, err := s.readFile("index.json")
+	if err != nil {
+		return nil, errors.New("index.json not found, this is not an OCI image layout")
+	}
+	return parseManifest(data, mediaTypeOCIIndex)
+}
+
+// loadOCIIndex picks the manifest of the index.json of an OCI layout with
+// the reference, or the only manifest when no reference is given
+func (s *imageSource) loadOCIIndex(reference string) error {
+	index, err := s.index()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[ociRefNameAnnotation]
+		if name != "" {
+			names = append(names, name)
+		}
+		if (reference != "" && name == reference) || (reference == "" && len(index.Manifests) == 1) {
+			s.root, s.refName = desc, name
+			return nil
+		}
+	}
+	sort.Strings(names)
+	if reference == "" {
+		return fmt.Errorf("the layout contains %d images, add one of %s to the source", len(index.Manifests), strings.Join(names, ", "))
+	}
+	return fmt.Errorf("no image named %s, the layout contains %s", reference, strings.Join(names, ", "))
+}
+
+// dockerArchiveImage is an image of the manifest.json of a docker-archive
+type dockerArchiveImage struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// loadDockerArchive builds an OCI manifest for the image of a docker-archive
+// with the reference, or its only image when no reference is given. Layers
+// keep their compression, and their media type is chosen accordingly.
+func (s *imageSource) loadDockerArchive(reference string) error {
+	data, err := s.readFile("manifest.json")
+	if err != nil {
+		return errors.New("manifest.json not found, this is not a docker-archive")
+	}
+	var images []dockerArchiveImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		return fmt.Errorf("invalid manifest.json: %w", err)
+	}
+	var image *dockerArchiveImage
+	var names []string
+	for i := range images {
+		for _, tag := range images[i].RepoTags {
+			names = append(names, tag)
+			if reference != "" && (tag == reference || strings.HasSuffix(tag, "/"+reference)) {
+				image, s.refName = &images[i], tag
+			}
+		}
+	}
+	if reference == "" && len(images) == 1 {
+		image = &images[0]
+		if len(image.RepoTags) > 0 {
+			s.refName = image.RepoTags[0]
+		}
+	}
+	if image == nil {
+		sort.Strings(names)
+		if reference == "" {
+			return fmt.Errorf("the archive contains %d images, add one of %s to the source", len(images), strings.Join(names, ", "))
+		}
+		return fmt.Errorf("no image named %s, the archive contains %s", reference, strings.Join(names, ", "))
+	}
+	if i := strings.LastIndex(s.refName, ":"); i > strings.LastIndex(s.refName, "/") {
+		s.refName = s.refName[i+1:]
+	}
+
+	config, err := s.readFile(image.Config)
+	if err != nil {
+		return err
+	}
+	configDigest := sha256Digest(config)
+	s.blobs[configDigest] = config
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        &ociDescriptor{MediaType: mediaTypeOCIConfig, Digest: configDigest, Size: int64(len(config))},
+	}
+	for _, layer := range image.Layers {
+		desc, err := s.addArchiveBlob(layer)
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	digest := sha256Digest(data)
+	s.blobs[digest] = data
+	s.root = ociDescriptor{MediaType: mediaTypeOCIManifest, Digest: digest, Size: int64(len(data))}
+	return nil
+}
+
+// addArchiveBlob makes a layer file of a docker-archive available by its
+// digest. The entry is read from the archive, so it needs no closing.
+func (s *imageSource) addArchiveBlob(name string) (ociDescriptor, error) {
+	r, err := s.openFile(name)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	mediaType := mediaTypeOCILayer
+	magic := make([]byte, 2)
+	if _, err := r.ReadAt(magic, 0); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		mediaType = mediaTypeOCILayerGzip
+	}
+	digest, size, err := digestReader(r)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	s.entries[blobPath(digest)] = r.SectionReader
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
+
+// Close closes the archive
+func (s *imageSource) Close() error {
+	if s.archive == nil {
+		return nil
+	}
+	err := s.archive.Close()
+	s.archive = nil
+	return err
+}
@@ -1,18 +1,21 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/lib/pq" // pg driver
-	"github.com/sethvargo/go-password/password"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // These variables are set at build time via ldflags
@@ -57,6 +60,9 @@ var quayHostname string
 // askBecomePass holds whether or not to ask for password during SSH connection
 var askBecomePass bool
 
+// becomePassFile is the path of a file containing the sudo password for the target host
+var becomePassFile string
+
 // quayRoot is the directory where all the quay config data is stored
 var quayRoot string
 
@@ -72,12 +78,15 @@ var additionalArgs string
 // command to run when starting quay container
 var quayCmd string
 
+// resume holds whether or not to continue an unfinished install from its last completed step
+var resume bool
+
 // installCmd represents the install command
 var installCmd = &cobra.Command{
 	Use:   "install",
 	Short: "Install Quay and its required dependencies.",
-	Run: func(cmd *cobra.Command, args []string) {
-		install()
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		install(cobraCmd)
 	},
 }
 
@@ -100,14 +109,61 @@ func init() {
 
 	installCmd.Flags().StringVarP(&imageArchivePath, "image-archive", "i", "", "An archive containing images")
 	installCmd.Flags().BoolVarP(&askBecomePass, "askBecomePass", "", false, "Whether or not to ask for sudo password during SSH connection.")
+	installCmd.Flags().StringVarP(&becomePassFile, "becomePassFile", "", "", "The path of a file containing the sudo password for the target host. Can also be set with $MIRROR_REGISTRY_BECOME_PASSWORD.")
 	installCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
 	installCmd.Flags().StringVarP(&quayStorage, "quayStorage", "", "quay-storage", "The folder where quay persistent storage data is saved. This defaults to a Podman named volume 'quay-storage'. Root is required to uninstall.")
 	installCmd.Flags().StringVarP(&sqliteStorage, "sqliteStorage", "", "sqlite-storage", "The folder where quay sqlite data is saved. This defaults to a Podman named volume 'sqlite-storage'. Root is required to uninstall.")
 	installCmd.Flags().StringVarP(&additionalArgs, "additionalArgs", "", "", "Additional arguments you would like to append to the ansible-playbook call. Used mostly for development.")
+	installCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+	installCmd.Flags().StringVarP(&storageBackend, "storage-backend", "", storageBackendLocal, "Where Quay stores image blobs: local (--quayStorage) or s3.")
+	installCmd.Flags().StringVarP(&s3Endpoint, "s3-endpoint", "", "", "The URL of the S3-compatible endpoint, for example https://minio.example.com:9000. This defaults to AWS S3.")
+	installCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "The S3 bucket Quay stores image blobs in. The bucket must already exist.")
+	installCmd.Flags().StringVarP(&s3Region, "s3-region", "", "us-east-1", "The region of the S3 bucket. This defaults to us-east-1.")
+	installCmd.Flags().StringVarP(&s3AccessKey, "s3-access-key", "", "", "The access key of the S3 bucket. Can also be set with $MIRROR_REGISTRY_S3_ACCESS_KEY.")
+	installCmd.Flags().StringVarP(&s3SecretKey, "s3-secret-key", "", "", "The secret key of the S3 bucket. Can also be set with $MIRROR_REGISTRY_S3_SECRET_KEY.")
+	installCmd.Flags().StringVarP(&s3CACert, "s3-ca-cert", "", "", "The path to the CA certificate that signed the certificate of the S3 endpoint.")
+	installCmd.Flags().StringVarP(&s3StoragePath, "s3-storage-path", "", "/datastorage/registry", "The prefix under which Quay stores blobs in the bucket. This defaults to /datastorage/registry.")
+	installCmd.Flags().StringVarP(&dbURI, "db-uri", "", "", "The URI of an external PostgreSQL database, for example postgresql://quay@db.example.com:5432/quay. This defaults to a SQLite database on the target.")
+	installCmd.Flags().StringVarP(&dbHost, "db-host", "", "", "The host of an external PostgreSQL database. Use instead of --db-uri.")
+	installCmd.Flags().IntVarP(&dbPort, "db-port", "", 5432, "The port of the external PostgreSQL database. This defaults to 5432.")
+	installCmd.Flags().StringVarP(&dbName, "db-name", "", "quay", "The name of the external PostgreSQL database. This defaults to quay.")
+	installCmd.Flags().StringVarP(&dbUser, "db-user", "", "", "The user Quay connects to the external PostgreSQL database with.")
+	installCmd.Flags().StringVarP(&dbPasswordFile, "db-password-file", "", "", "The path of a file containing the password of --db-user. Can also be set with $MIRROR_REGISTRY_DB_PASSWORD.")
+	installCmd.Flags().StringVarP(&dbSSLMode, "db-sslmode", "", "require", "The sslmode used to connect to the external PostgreSQL database when the URI does not set one. This defaults to require.")
+	installCmd.Flags().StringVarP(&authType, "auth", "", authDatabase, "How users log in to Quay: database (users created in Quay) or ldap.")
+	installCmd.Flags().StringVarP(&ldapURI, "ldap-uri", "", "", "The URI of the LDAP server, for example ldaps://ldap.example.com.")
+	installCmd.Flags().StringVarP(&ldapBaseDN, "ldap-base-dn", "", "", "The base DN of the directory, for example dc=example,dc=com.")
+	installCmd.Flags().StringVarP(&ldapUserRDN, "ldap-user-rdn", "", "", "The RDN of the users relative to --ldap-base-dn, for example ou=People.")
+	installCmd.Flags().StringVarP(&ldapBindDN, "ldap-bind-dn", "", "", "The DN Quay binds with to search the directory. This defaults to an anonymous bind.")
+	installCmd.Flags().StringVarP(&ldapBindPasswordFile, "ldap-bind-password-file", "", "", "The path of a file containing the password of --ldap-bind-dn. Can also be set with $MIRROR_REGISTRY_LDAP_BIND_PASSWORD.")
+	installCmd.Flags().StringVarP(&ldapCACert, "ldap-ca-cert", "", "", "The path to the CA certificate that signed the certificate of the LDAP server.")
+	installCmd.Flags().StringVarP(&ldapSuperuserFilter, "ldap-superuser-filter", "", "", "An LDAP filter selecting the users that are Quay superusers, for example (memberOf=cn=quay-admins,ou=Groups,dc=example,dc=com).")
+	installCmd.Flags().StringVarP(&ldapUIDAttr, "ldap-uid-attr", "", "uid", "The LDAP attribute holding the user name. This defaults to uid.")
+	installCmd.Flags().StringVarP(&ldapEmailAttr, "ldap-email-attr", "", "mail", "The LDAP attribute holding the email address. This defaults to mail.")
+	installCmd.Flags().BoolVarP(&ldapAllowInsecure, "ldap-allow-insecure", "", false, "Allow an ldap:// connection without TLS when StartTLS fails.")
+	installCmd.Flags().StringVarP(&oidcIssuer, "oidc-issuer", "", "", "The issuer URL of an OIDC provider users can log in with, for example https://keycloak.example.com/realms/quay.")
+	installCmd.Flags().StringVarP(&oidcClientID, "oidc-client-id", "", "", "The ID of the client registered for Quay in the OIDC provider.")
+	installCmd.Flags().StringVarP(&oidcClientSecretFile, "oidc-client-secret-file", "", "", "The path of a file containing the secret of --oidc-client-id. Can also be set with $MIRROR_REGISTRY_OIDC_CLIENT_SECRET.")
+	installCmd.Flags().StringVarP(&oidcLoginScopes, "oidc-login-scopes", "", "openid", "The comma-separated scopes requested when logging in with OIDC. This defaults to openid.")
+	installCmd.Flags().StringVarP(&oidcCACert, "oidc-ca-cert", "", "", "The path to the CA certificate that signed the certificate of the OIDC provider.")
+	installCmd.Flags().StringVarP(&oidcServiceName, "oidc-service-name", "", "Single Sign-On", "The name of the OIDC login button in Quay.")
+	installCmd.Flags().StringVarP(&configOverrideFile, "config-override", "", "", "The path of a YAML file of config.yaml settings that is copied to quayRoot/quay-config/config-overrides.yaml and merged over the generated config.yaml on every install and upgrade.")
+	installCmd.Flags().StringVarP(&httpProxy, "http-proxy", "", "", "The proxy used for HTTP requests by Quay and the installer, for example http://proxy.example.com:3128.")
+	installCmd.Flags().StringVarP(&httpsProxy, "https-proxy", "", "", "The proxy used for HTTPS requests by Quay and the installer, for example http://proxy.example.com:3128.")
+	installCmd.Flags().StringVarP(&noProxy, "no-proxy", "", "", "The comma-separated hosts reached without the proxy. The Quay hostname and the pod-local addresses are always added.")
+	installCmd.Flags().StringVarP(&replicateSource, "replicate-from", "", "", "The URL of another registry, such as https://mirror1.example.com:8443, to replicate to this Quay with a systemd timer on the target.")
+	installCmd.Flags().DurationVarP(&replicateInterval, "replicate-interval", "", time.Hour, "How long the replication timer waits after a run before the next one. This defaults to 1h.")
+	installCmd.Flags().StringVarP(&replicateSourceUsername, "replicate-username", "", "", "The user reading from --replicate-from.")
+	installCmd.Flags().StringVarP(&replicateSourcePasswordFile, "replicate-password-file", "", "", "The path of a file containing the password of --replicate-username. Can also be set with $MIRROR_REGISTRY_SOURCE_PASSWORD.")
+	installCmd.Flags().StringVarP(&replicateSourceCACert, "replicate-ca-cert", "", "", "The path to the CA certificate that signed the certificate of --replicate-from.")
+	installCmd.Flags().StringArrayVarP(&replicateRepos, "replicate-repo", "", nil, "Only replicate the repositories matching this pattern, such as ocp4/*. Can be repeated.")
+	installCmd.Flags().StringVarP(&bootstrapFile, "bootstrap", "", "", "The path of a bootstrap file describing organizations, teams, robot accounts and permissions to create with the API token of the init user once Quay is installed.")
+	installCmd.Flags().StringVarP(&robotTokensFile, "robot-tokens-file", "", "", "The file the robot account tokens of --bootstrap are written to. This defaults to robot-tokens.json in the state directory of the target.")
+	installCmd.Flags().BoolVarP(&resume, "resume", "", false, "Continue an unfinished install from its first incomplete step, reusing the settings and credentials of the previous run.")
 
 }
 
-func install() {
+func install(cobraCmd *cobra.Command) {
 
 	var err error
 	log.Printf("Install has begun")
@@ -117,15 +173,139 @@ func install() {
 	log.Debug("Quay Image: " + quayImage)
 	log.Debug("Redis Image: " + redisImage)
 
+	// Pick up the settings of an unfinished install
+	previous := &installState{}
+	if resume {
+		previous, err = loadInstallState()
+		check(err)
+		check(previous.resumable())
+		err = resumeInstallSettings(cobraCmd, previous)
+		check(err)
+		log.Printf("Resuming install on %s, skipping completed steps: %s", targetHostname, strings.Join(previous.Install.CompletedSteps, ", "))
+	}
+
+	// Check the bootstrap file before anything is installed
+	var bootstrap *bootstrapConfig
+	if bootstrapFile != "" && authType != authDatabase {
+		check(errors.New("--bootstrap uses the init user, which is only created with --auth database. Log in with a directory account and run 'mirror-registry apply --token <token>' instead."))
+	}
+	if bootstrapFile != "" {
+		bootstrap, err = loadBootstrap(bootstrapFile)
+		check(err)
+	}
+
+	// Check access to the object storage before anything is installed
+	var storageMountFlags, storageVarsArg string
+	switch storageBackend {
+	case storageBackendLocal:
+	case storageBackendS3:
+		s3, err := s3SettingsFromFlags()
+		check(err)
+		log.Infof("Validating access to S3 bucket %s", s3.Bucket)
+		err = s3.validate(context.Background())
+		check(err)
+		storageConfig, err := s3.quayStorageConfig()
+		check(err)
+		storageMountFlags, storageVarsArg, err = runnerVarsFlags("storage.json", map[string]interface{}{
+			"storage_backend":            storageBackendS3,
+			"distributed_storage_config": map[string]interface{}{"default": storageConfig},
+		})
+		check(err)
+		if s3.CACert != "" {
+			s3CACertAbs, err := filepath.Abs(s3.CACert)
+			check(err)
+			storageMountFlags += fmt.Sprintf(" -v %s:/runner/certs/s3-ca.crt:Z ", s3CACertAbs)
+		}
+	default:
+		check(fmt.Errorf("Unsupported storage backend %q. Use local or s3.", storageBackend))
+	}
+
+	// Check the external database before anything is installed
+	databaseBackend := databaseBackendSqlite
+	var databaseMountFlags, databaseVarsArg string
+	if externalDatabaseRequested() {
+		uri, err := postgresURIFromFlags()
+		check(err)
+		log.Infof("Checking PostgreSQL database %s", redactURI(uri))
+		err = preflightPostgres(context.Background(), uri)
+		check(err)
+		databaseBackend = databaseBackendPostgres
+		databaseMountFlags, databaseVarsArg, err = runnerVarsFlags("database.json", map[string]string{
+			"db_backend": databaseBackendPostgres,
+			"db_uri":     uri,
+		})
+		check(err)
+	}
+
+	// Check the directory before anything is installed
+	var authMountFlags, authVarsArg string
+	switch authType {
+	case authDatabase:
+	case authLDAP:
+		ldapConfig, err := ldapSettingsFromFlags()
+		check(err)
+		log.Infof("Checking LDAP directory %s", ldapConfig.URI)
+		err = ldapConfig.validate()
+		check(err)
+		authMountFlags, authVarsArg, err = runnerVarsFlags("auth.json", map[string]interface{}{
+			"auth_config": ldapConfig.quayConfig(),
+		})
+		check(err)
+		if ldapConfig.CACert != "" {
+			ldapCACertAbs, err := filepath.Abs(ldapConfig.CACert)
+			check(err)
+			authMountFlags += fmt.Sprintf(" -v %s:/runner/certs/ldap-ca.crt:Z ", ldapCACertAbs)
+		}
+	default:
+		check(fmt.Errorf("Unsupported authentication %q. Use database or ldap.", authType))
+	}
+
+	// Check the config overrides before anything is installed
+	var configOverrideMountFlag string
+	if configOverrideFile != "" {
+		_, err = loadConfigOverrides(configOverrideFile)
+		check(err)
+		configOverrideAbs, err := filepath.Abs(configOverrideFile)
+		check(err)
+		configOverrideMountFlag = fmt.Sprintf(" -v %s:/runner/env/config-overrides.yaml:Z ", configOverrideAbs)
+	}
+
+	// Check the OIDC provider before anything is installed
+	var oidcMountFlags, oidcVarsArg string
+	if oidcRequested() {
+		oidcMountFlags, oidcVarsArg, err = oidcRunnerFlags()
+		check(err)
+	}
+
+	// Check the replication source before anything is installed
+	var replicateMountFlags, replicateVarsArg string
+	if replicateSource != "" {
+		replicateMountFlags, replicateVarsArg, err = replicateRunnerFlags()
+		check(err)
+		log.Infof("Checking registry %s", replicateSource)
+		checkReplicateSource()
+	}
+
 	// Load execution environment
-	err = loadExecutionEnvironment()
-	check(err)
+	if resume && imageExists(eeImage) {
+		log.Info("Execution environment is already loaded")
+	} else {
+		err = loadExecutionEnvironment()
+		check(err)
+	}
 
 	// Set quayHostname if not already set
 	if quayHostname == "" {
 		quayHostname = targetHostname + ":8443"
 	}
 
+	// Pass the proxy to the runner, the playbook and the Quay services
+	var proxyFlags, proxyVarsArg string
+	if proxyRequested() {
+		proxyFlags, proxyVarsArg, err = proxyRunnerFlags(quayHostname)
+		check(err)
+	}
+
 	// Load the SSL certificate and the key
 	err = loadCerts(sslCert, sslKey, strings.Split(quayHostname, ":")[0], sslCheckSkip)
 	check(err)
@@ -149,10 +329,13 @@ func install() {
 		}
 	}
 
+	imagesLoaded := previous.stepCompleted("load-images")
 	if imageArchivePath != "" {
 		imageArchiveMountFlag = fmt.Sprintf("-v %s:/runner/image-archive.tar", imageArchivePath)
 		log.Info("Found image archive at " + imageArchivePath)
-		if isLocalInstall() {
+		if imagesLoaded {
+			log.Info("Images were loaded by the previous install, skipping")
+		} else if isLocalInstall() {
 			log.Printf("Unpacking image archive from %s", imageArchivePath)
 			cmd := exec.Command("tar", "-xvf", imageArchivePath)
 			if verbose {
@@ -174,6 +357,7 @@ func install() {
 			log.Debug("Importing Pause with command: ", pauseImport)
 			err = pauseImport.Run()
 			check(err)
+			recordLoadedImage(imageHostTarget, pauseImage)
 
 			// Load Redis image
 			redisArchivePath := path.Join(path.Dir(executableDir), "redis.tar")
@@ -187,6 +371,7 @@ func install() {
 			log.Debug("Importing Redis with command: ", redisImport)
 			err = redisImport.Run()
 			check(err)
+			recordLoadedImage(imageHostTarget, redisImage)
 
 			// Load Quay image
 			quayArchivePath := path.Join(path.Dir(executableDir), "quay.tar")
@@ -200,6 +385,8 @@ func install() {
 			log.Debug("Importing Quay with command: ", quayImport)
 			err = quayImport.Run()
 			check(err)
+			recordLoadedImage(imageHostTarget, quayImage)
+			imagesLoaded = true
 		}
 		log.Infof("Attempting to set SELinux rules on image archive")
 		cmd := exec.Command("chcon", "-Rt", "svirt_sandbox_file_t", imageArchivePath)
@@ -214,7 +401,7 @@ func install() {
 
 	// Generate password if none provided
 	if initPassword == "" {
-		initPassword, err = password.Generate(32, 10, 0, false, false)
+		initPassword, err = generatePassword()
 		check(err)
 	}
 
@@ -228,11 +415,9 @@ func install() {
 		quayHostname = quayHostname + ":8443"
 	}
 
-	// Set askBecomePass flag if true
-	var askBecomePassFlag string
-	if askBecomePass {
-		askBecomePassFlag = "-K"
-	}
+	// Set the sudo password from a file or the environment, or ask for it if requested
+	becomePassMountFlag, askBecomePassFlag, err := becomePassFlags()
+	check(err)
 
 	// Set the SSL flag if cert and key are defined
 	var sslCertKeyFlag string
@@ -250,15 +435,61 @@ func install() {
 
 	quayCmd = "registry"
 
+	// Stop the runner container and record the interruption on SIGINT/SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("install")
+	check(err)
+
+	state, err := beginOperation("install", resume)
+	check(err)
+	state.QuayHostname = quayHostname
+	state.QuayStorage = quayStorage
+	state.SqliteStorage = sqliteStorage
+	state.StorageBackend = storageBackend
+	state.DatabaseBackend = databaseBackend
+	state.AuthType = authType
+	if imagesLoaded {
+		state.addCompletedStep("load-images")
+	}
+	err = state.save()
+	check(err)
+
+	// Keep the init credentials so that a resumed install reuses them. The API
+	// token is kept as long as it belongs to the same init user.
+	creds, err := loadCredentials()
+	check(err)
+	if creds.InitUser != initUser {
+		creds.InitToken = ""
+		state.InitTokenUser = ""
+	}
+	creds.InitUser, creds.InitPassword = initUser, initPassword
+	recordInstallSettings(cobraCmd, state, creds)
+	err = creds.save()
+	check(err)
+	err = state.save()
+	check(err)
+
 	// Run playbook
 	log.Printf("Running install playbook. This may take some time. To see playbook output run the installer with -v (verbose) flag.")
 	quayVersion := strings.Split(quayImage, ":")[1]
 	podmanCmd := fmt.Sprintf(`podman run `+
-		`--rm --interactive --tty `+
+		runnerTTYFlags()+
 		`--workdir /runner/project `+
 		`--net host `+
 		imageArchiveMountFlag+ // optional image archive flag
 		sslCertKeyFlag+ // optional ssl cert/key flag
+		runnerStateFlags()+
+		becomePassMountFlag+ // optional sudo password file
+		storageMountFlags+ // optional object storage settings
+		databaseMountFlags+ // optional external database settings
+		authMountFlags+ // optional LDAP settings
+		oidcMountFlags+ // optional OIDC settings
+		configOverrideMountFlag+ // optional config overrides
+		proxyFlags+ // optional proxy settings
+		replicateMountFlags+ // optional replication settings
 		` -v %s:/runner/env/ssh_key `+
 		`-e RUNNER_OMIT_EVENTS=False `+
 		`-e RUNNER_ONLY_FAILED_EVENTS=False `+
@@ -266,19 +497,154 @@ func install() {
 		`-e ANSIBLE_CONFIG=/runner/project/ansible.cfg `+
 		fmt.Sprintf("-e ANSIBLE_NOCOLOR=%t ", noColor)+
 		`--quiet `+
-		`--name ansible_runner_instance `+
+		fmt.Sprintf("--name %s ", runnerContainerName)+
 		fmt.Sprintf("%s ", eeImage)+
-		`ansible-playbook -i %s@%s, --private-key /runner/env/ssh_key -e "init_user=%s init_password=%s quay_image=%s quay_version=%s redis_image=%s pause_image=%s quay_hostname=%s local_install=%s quay_root=%s quay_storage=%s sqlite_storage=%s quay_cmd=%s" install_mirror_appliance.yml %s %s`,
-		sshKey, targetUsername, targetHostname, initUser, initPassword, quayImage, quayVersion, redisImage, pauseImage, quayHostname, strconv.FormatBool(isLocalInstall()), quayRoot, quayStorage, sqliteStorage, quayCmd, askBecomePassFlag, additionalArgs)
-
-	log.Debug("Running command: " + podmanCmd)
-	cmd := exec.Command("bash", "-c", podmanCmd)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	err = cmd.Run()
-	check(err)
+		`ansible-playbook -i %s@%s, --private-key /runner/env/ssh_key -e "init_user=%s init_password=%s quay_image=%s quay_version=%s redis_image=%s pause_image=%s quay_hostname=%s local_install=%s quay_root=%s quay_storage=%s sqlite_storage=%s quay_cmd=%s progress_file=/runner/state/progress loaded_images_file=/runner/state/loaded-images init_token_file=/runner/state/init-token completed_steps=%s" install_mirror_appliance.yml %s %s %s %s %s %s %s %s`,
+		sshKey, targetUsername, targetHostname, initUser, initPassword, quayImage, quayVersion, redisImage, pauseImage, quayHostname, strconv.FormatBool(isLocalInstall()), quayRoot, quayStorage, sqliteStorage, quayCmd, strings.Join(state.Install.CompletedSteps, ","), storageVarsArg, databaseVarsArg, authVarsArg, oidcVarsArg, proxyVarsArg, replicateVarsArg, askBecomePassFlag, additionalArgs)
+
+	err = runPlaybook(ctx, podmanCmd, os.Stdout, os.Stderr)
+	collectInitToken(state, creds)
+	apiToken = creds.InitToken
+	if err == nil && bootstrap != nil {
+		err = bootstrapInstall(state, bootstrap)
+	}
+	finishOperation(ctx, state, err)
 
 	log.Printf("Quay installed successfully, config data is stored in %s", quayRoot)
+	if authType != authDatabase {
+		log.Printf("Quay is available at %s. Log in with a directory account.", "https://"+quayHostname)
+		return
+	}
 	log.Printf("Quay is available at %s with credentials (%s, %s)", "https://"+quayHostname, initUser, initPassword)
+	if creds.InitToken != "" {
+		log.Printf("The API token of %s is stored in %s", initUser, path.Join(targetStateDir(), "credentials.json"))
+	}
+}
+
+// bootstrapInstall applies the bootstrap file with the API token returned when
+// the init user was created
+func bootstrapInstall(state *installState, bootstrap *bootstrapConfig) error {
+	state.startStep("bootstrap")
+	if apiToken == "" {
+		return fmt.Errorf("No API token was returned for %s, which probably existed already. Run 'mirror-registry apply --bootstrap %s --token <token>' with the token of a superuser.", initUser, bootstrapFile)
+	}
+	log.Infof("Applying bootstrap file %s", bootstrapFile)
+	if err := applyBootstrap(newQuayClient(quayHostname, apiToken), bootstrap); err != nil {
+		return err
+	}
+	state.completeStep("bootstrap")
+	return nil
+}
+
+// resumeInstallSettings reuses the settings and credentials of the previous
+// install for every flag that was not passed explicitly.
+func resumeInstallSettings(cobraCmd *cobra.Command, previous *installState) error {
+	settings := []struct {
+		flag     string
+		value    *string
+		previous string
+	}{
+		{"quayRoot", &quayRoot, previous.QuayRoot},
+		{"quayHostname", &quayHostname, previous.QuayHostname},
+		{"quayStorage", &quayStorage, previous.QuayStorage},
+		{"sqliteStorage", &sqliteStorage, previous.SqliteStorage},
+		{"storage-backend", &storageBackend, previous.StorageBackend},
+		{"auth", &authType, previous.AuthType},
+	}
+	for _, setting := range settings {
+		if !cobraCmd.Flags().Changed(setting.flag) && setting.previous != "" {
+			*setting.value = setting.previous
+		}
+	}
+
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	if !cobraCmd.Flags().Changed("initUser") && creds.InitUser != "" {
+		initUser = creds.InitUser
+	}
+	if !cobraCmd.Flags().Changed("initPassword") && creds.InitPassword != "" {
+		initPassword = creds.InitPassword
+	}
+	if err := restoreInstallFlags(cobraCmd, previous.Install.Flags); err != nil {
+		return err
+	}
+	if err := restoreInstallFlags(cobraCmd, creds.InstallFlags); err != nil {
+		return err
+	}
+	for name, value := range creds.InstallEnv {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+	return nil
+}
+
+// installSecretFlagPattern matches the install flags whose values are kept in
+// credentials.json instead of state.json
+var installSecretFlagPattern = regexp.MustCompile(`(?i)password|secret|token|access-key|db-uri`)
+
+// installSecretEnv are the environment variables supplying secrets to install
+// that are kept in credentials.json for a resumed install
+var installSecretEnv = []string{
+	"MIRROR_REGISTRY_S3_ACCESS_KEY",
+	"MIRROR_REGISTRY_S3_SECRET_KEY",
+	"MIRROR_REGISTRY_DB_PASSWORD",
+	"MIRROR_REGISTRY_LDAP_BIND_PASSWORD",
+	"MIRROR_REGISTRY_OIDC_CLIENT_SECRET",
+	"MIRROR_REGISTRY_SOURCE_PASSWORD",
+}
+
+// unrecordedInstallFlags are the install flags that only apply to the run they
+// are passed to. The init credentials are kept in credentials.json of their own.
+var unrecordedInstallFlags = []string{"resume", "break-lock", "initUser", "initPassword", "askBecomePass", "becomePassFile"}
+
+// recordInstallSettings keeps the flags passed to install, and the secrets
+// supplied through the environment, so that --resume can restore them. Secrets
+// are kept in credentials.json, which is only readable by the current user.
+func recordInstallSettings(cobraCmd *cobra.Command, state *installState, creds *installCredentials) {
+	state.Install.Flags = map[string][]string{}
+	creds.InstallFlags = map[string][]string{}
+	cobraCmd.LocalFlags().VisitAll(func(flag *pflag.Flag) {
+		if !flag.Changed || contains(unrecordedInstallFlags, flag.Name) {
+			return
+		}
+		values := []string{flag.Value.String()}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			values = slice.GetSlice()
+		}
+		if installSecretFlagPattern.MatchString(flag.Name) {
+			creds.InstallFlags[flag.Name] = values
+		} else {
+			state.Install.Flags[flag.Name] = values
+		}
+	})
+	creds.InstallEnv = map[string]string{}
+	for _, name := range installSecretEnv {
+		if value := os.Getenv(name); value != "" {
+			creds.InstallEnv[name] = value
+		}
+	}
+}
+
+// restoreInstallFlags sets the recorded flags that were not passed explicitly
+func restoreInstallFlags(cobraCmd *cobra.Command, flags map[string][]string) error {
+	for name, values := range flags {
+		flag := cobraCmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed || len(values) == 0 {
+			continue
+		}
+		var err error
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			err = slice.Replace(values)
+		} else {
+			err = flag.Value.Set(values[0])
+		}
+		if err != nil {
+			return fmt.Errorf("Could not restore --%s of the previous install: %w", name, err)
+		}
+		flag.Changed = true
+	}
+	return nil
 }
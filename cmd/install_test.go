@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"os"
+	"reflect"
 	"testing"
+
+	"github.com/spf13/cobra"
 )
 
 func TestInstallFlagDefaults(t *testing.T) {
@@ -23,6 +26,13 @@ func TestInstallFlagDefaults(t *testing.T) {
 		{"quayStorage default", "quayStorage", "quay-storage"},
 		{"sqliteStorage default", "sqliteStorage", "sqlite-storage"},
 		{"additionalArgs default", "additionalArgs", ""},
+		{"storage-backend default", "storage-backend", "local"},
+		{"s3-region default", "s3-region", "us-east-1"},
+		{"s3-storage-path default", "s3-storage-path", "/datastorage/registry"},
+		{"db-uri default", "db-uri", ""},
+		{"db-port default", "db-port", "5432"},
+		{"db-name default", "db-name", "quay"},
+		{"db-sslmode default", "db-sslmode", "require"},
 	}
 
 	for _, tt := range tests {
@@ -48,6 +58,8 @@ func TestInstallBoolFlagDefaults(t *testing.T) {
 	}{
 		{"sslCheckSkip default", "sslCheckSkip", "false"},
 		{"askBecomePass default", "askBecomePass", "false"},
+		{"break-lock default", "break-lock", "false"},
+		{"resume default", "resume", "false"},
 	}
 
 	for _, tt := range tests {
@@ -130,6 +142,10 @@ func TestUninstallFlagDefaults(t *testing.T) {
 		{"quayStorage default", "quayStorage", "quay-storage"},
 		{"sqliteStorage default", "sqliteStorage", "sqlite-storage"},
 		{"autoApprove default", "autoApprove", "false"},
+		{"keep-data default", "keep-data", "false"},
+		{"keep-config default", "keep-config", "false"},
+		{"keep-images default", "keep-images", "false"},
+		{"purge-images default", "purge-images", "false"},
 	}
 
 	for _, tt := range tests {
@@ -181,6 +197,11 @@ func TestGlobalFlags(t *testing.T) {
 		t.Errorf("verbose shorthand = %q, want %q", f.Shorthand, "v")
 	}
 
+	f = rootCmd.PersistentFlags().Lookup("non-interactive")
+	if f == nil {
+		t.Fatal("non-interactive flag not registered")
+	}
+
 	f = rootCmd.PersistentFlags().Lookup("no-color")
 	if f == nil {
 		t.Fatal("no-color flag not registered")
@@ -189,3 +210,58 @@ func TestGlobalFlags(t *testing.T) {
 		t.Errorf("no-color shorthand = %q, want %q", f.Shorthand, "c")
 	}
 }
+
+func TestResumeInstallFlags(t *testing.T) {
+	newInstallCmd := func() (*cobra.Command, map[string]*string, *[]string) {
+		c := &cobra.Command{Use: "install"}
+		values := map[string]*string{}
+		for _, name := range []string{"auth", "ldap-uri", "ldap-base-dn", "s3-secret-key", "db-uri", "initPassword"} {
+			values[name] = c.Flags().String(name, "", "")
+		}
+		repos := c.Flags().StringArray("replicate-repo", nil, "")
+		c.Flags().Bool("resume", false, "")
+		return c, values, repos
+	}
+	t.Setenv("MIRROR_REGISTRY_DB_PASSWORD", "hunter2")
+
+	first, _, _ := newInstallCmd()
+	err := first.Flags().Parse([]string{"--auth", "ldap", "--ldap-uri", "ldaps://ldap.example.com", "--ldap-base-dn", "dc=example,dc=com",
+		"--s3-secret-key", "abc", "--db-uri", "postgresql://quay:pw@db/quay", "--initPassword", "secret", "--replicate-repo", "ocp4/*", "--replicate-repo", "rhel/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, creds := &installState{}, &installCredentials{}
+	recordInstallSettings(first, state, creds)
+
+	wantState := map[string][]string{"auth": {"ldap"}, "ldap-uri": {"ldaps://ldap.example.com"}, "ldap-base-dn": {"dc=example,dc=com"}, "replicate-repo": {"ocp4/*", "rhel/*"}}
+	if !reflect.DeepEqual(state.Install.Flags, wantState) {
+		t.Errorf("state flags = %v, want %v", state.Install.Flags, wantState)
+	}
+	wantCreds := map[string][]string{"s3-secret-key": {"abc"}, "db-uri": {"postgresql://quay:pw@db/quay"}}
+	if !reflect.DeepEqual(creds.InstallFlags, wantCreds) {
+		t.Errorf("credentials flags = %v, want %v", creds.InstallFlags, wantCreds)
+	}
+	if creds.InstallEnv["MIRROR_REGISTRY_DB_PASSWORD"] != "hunter2" {
+		t.Errorf("credentials env = %v, want MIRROR_REGISTRY_DB_PASSWORD", creds.InstallEnv)
+	}
+
+	// Flags passed to the resumed install take precedence
+	resumed, values, repos := newInstallCmd()
+	if err := resumed.Flags().Parse([]string{"--resume", "--ldap-uri", "ldaps://ldap2.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range []map[string][]string{state.Install.Flags, creds.InstallFlags} {
+		if err := restoreInstallFlags(resumed, flags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"auth": "ldap", "ldap-uri": "ldaps://ldap2.example.com", "ldap-base-dn": "dc=example,dc=com", "s3-secret-key": "abc", "db-uri": "postgresql://quay:pw@db/quay", "initPassword": ""}
+	for name, value := range want {
+		if *values[name] != value {
+			t.Errorf("--%s = %q, want %q", name, *values[name], value)
+		}
+	}
+	if !reflect.DeepEqual(*repos, []string{"ocp4/*", "rhel/*"}) || !resumed.Flags().Changed("replicate-repo") {
+		t.Errorf("--replicate-repo = %q, want [ocp4/* rhel/*]", *repos)
+	}
+}
@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Possible values of --auth
+const (
+	authDatabase = "database"
+	authLDAP     = "ldap"
+)
+
+// authType is how users log in to Quay
+var authType string
+
+// ldapURI is the URI of the LDAP server, such as ldaps://ldap.example.com
+var ldapURI string
+
+// ldapBaseDN is the DN under which users and groups are searched
+var ldapBaseDN string
+
+// ldapUserRDN is the RDN of the users, relative to ldapBaseDN
+var ldapUserRDN string
+
+// ldapBindDN is the DN Quay binds with to search the directory
+var ldapBindDN string
+
+// ldapBindPasswordFile is the path of a file containing the password of ldapBindDN
+var ldapBindPasswordFile string
+
+// ldapCACert is the path of the CA certificate that signed the LDAP server certificate
+var ldapCACert string
+
+// ldapSuperuserFilter is an LDAP filter selecting the users that are Quay superusers
+var ldapSuperuserFilter string
+
+// ldapUIDAttr is the attribute holding the user name
+var ldapUIDAttr string
+
+// ldapEmailAttr is the attribute holding the email address
+var ldapEmailAttr string
+
+// ldapAllowInsecure allows plain ldap:// connections when StartTLS fails
+var ldapAllowInsecure bool
+
+// ldapAttrPattern matches the LDAP attribute names accepted for --ldap-uid-attr and --ldap-email-attr
+var ldapAttrPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// ldapSettings describes the directory users log in with
+type ldapSettings struct {
+	URI             string
+	BaseDN          string
+	UserRDN         string
+	BindDN          string
+	BindPassword    string
+	CACert          string
+	SuperuserFilter string
+	UIDAttr         string
+	EmailAttr       string
+	AllowInsecure   bool
+}
+
+// ldapSettingsFromFlags reads the LDAP settings from the flags and the environment
+func ldapSettingsFromFlags() (*ldapSettings, error) {
+	settings := &ldapSettings{
+		URI:             ldapURI,
+		BaseDN:          ldapBaseDN,
+		UserRDN:         ldapUserRDN,
+		BindDN:          ldapBindDN,
+		CACert:          ldapCACert,
+		SuperuserFilter: ldapSuperuserFilter,
+		UIDAttr:         ldapUIDAttr,
+		EmailAttr:       ldapEmailAttr,
+		AllowInsecure:   ldapAllowInsecure,
+	}
+	if settings.URI == "" || settings.BaseDN == "" {
+		return nil, errors.New("--ldap-uri and --ldap-base-dn are required with --auth ldap")
+	}
+	u, err := url.Parse(settings.URI)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid LDAP URI %q. Use ldap://host[:port] or ldaps://host[:port]", settings.URI)
+	}
+	if _, err := ldap.ParseDN(settings.BaseDN); err != nil {
+		return nil, fmt.Errorf("Invalid --ldap-base-dn %q: %w", settings.BaseDN, err)
+	}
+	if _, err := ldap.ParseDN(settings.UserRDN); err != nil {
+		return nil, fmt.Errorf("Invalid --ldap-user-rdn %q: %w", settings.UserRDN, err)
+	}
+	for _, attr := range []string{settings.UIDAttr, settings.EmailAttr} {
+		if !ldapAttrPattern.MatchString(attr) {
+			return nil, fmt.Errorf("Invalid LDAP attribute name %q", attr)
+		}
+	}
+	if settings.SuperuserFilter != "" {
+		if _, err := ldap.CompileFilter(settings.SuperuserFilter); err != nil {
+			return nil, fmt.Errorf("Invalid --ldap-superuser-filter %q: %w", settings.SuperuserFilter, err)
+		}
+	}
+	if settings.BindDN != "" {
+		settings.BindPassword, err = ldapBindPassword()
+		if err != nil {
+			return nil, err
+		}
+		if settings.BindPassword == "" {
+			return nil, errors.New("The password of --ldap-bind-dn is required. Supply it with --ldap-bind-password-file or $MIRROR_REGISTRY_LDAP_BIND_PASSWORD")
+		}
+	}
+	if settings.CACert != "" && !pathExists(settings.CACert) {
+		return nil, errors.New("Could not find LDAP CA certificate at " + settings.CACert)
+	}
+	return settings, nil
+}
+
+// ldapBindPassword reads the password of the bind DN from --ldap-bind-password-file or the environment
+func ldapBindPassword() (string, error) {
+	if ldapBindPasswordFile != "" {
+		data, err := ioutil.ReadFile(ldapBindPasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv("MIRROR_REGISTRY_LDAP_BIND_PASSWORD"), nil
+}
+
+// userBase returns the DN under which users are searched
+func (s *ldapSettings) userBase() string {
+	if s.UserRDN == "" {
+		return s.BaseDN
+	}
+	return s.UserRDN + "," + s.BaseDN
+}
+
+// tlsConfig trusts the system certificates and --ldap-ca-cert
+func (s *ldapSettings) tlsConfig() (*tls.Config, error) {
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if s.CACert != "" {
+		pem, err := ioutil.ReadFile(s.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate found in " + s.CACert)
+		}
+	}
+	return &tls.Config{RootCAs: pool, ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}, nil
+}
+
+// dial connects to the directory the way Quay does: ldaps:// uses TLS, and
+// ldap:// is upgraded with StartTLS unless that fails and insecure
+// connections are allowed.
+func (s *ldapSettings) dial() (*ldap.Conn, error) {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second})
+	conn, err := ldap.DialURL(s.URI, dialer, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s: %w", s.URI, err)
+	}
+	conn.SetTimeout(30 * time.Second)
+	if !strings.HasPrefix(s.URI, "ldap://") {
+		return conn, nil
+	}
+	if err := conn.StartTLS(tlsConfig); err != nil {
+		conn.Close()
+		if !s.AllowInsecure {
+			return nil, fmt.Errorf("StartTLS failed on %s: %w. Use ldaps://, or pass --ldap-allow-insecure to send passwords in clear text", s.URI, err)
+		}
+		log.Warnf("StartTLS failed on %s, using an insecure connection: %s", s.URI, err.Error())
+		conn, err = ldap.DialURL(s.URI, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("Could not connect to %s: %w", s.URI, err)
+		}
+		conn.SetTimeout(30 * time.Second)
+	}
+	return conn, nil
+}
+
+// validate checks from the installer host that the bind DN can bind, and that
+// users with a user name can be found under the user base.
+func (s *ldapSettings) validate() error {
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if s.BindDN != "" {
+		err = conn.Bind(s.BindDN, s.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return fmt.Errorf("Could not bind to %s as %q: %w", s.URI, s.BindDN, err)
+	}
+
+	users, err := s.search(conn, fmt.Sprintf("(%s=*)", s.UIDAttr))
+	if err != nil {
+		return fmt.Errorf("Could not search for users under %s: %w", s.userBase(), err)
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("No user with a %s attribute was found under %s. Check --ldap-base-dn, --ldap-user-rdn and --ldap-uid-attr", s.UIDAttr, s.userBase())
+	}
+	for _, user := range users {
+		if user.GetAttributeValue(s.EmailAttr) == "" {
+			log.Warnf("User %s has no %s attribute. Quay requires an email address to log in, check --ldap-email-attr", user.GetAttributeValue(s.UIDAttr), s.EmailAttr)
+			break
+		}
+	}
+	log.Infof("Found users under %s, for example %s", s.userBase(), users[0].GetAttributeValue(s.UIDAttr))
+
+	if s.SuperuserFilter != "" {
+		superusers, err := s.search(conn, fmt.Sprintf("(&(%s=*)%s)", s.UIDAttr, s.SuperuserFilter))
+		if err != nil {
+			return fmt.Errorf("Could not search for superusers with %s: %w", s.SuperuserFilter, err)
+		}
+		if len(superusers) == 0 {
+			log.Warnf("No user matches --ldap-superuser-filter %s, so Quay will have no superuser from the directory", s.SuperuserFilter)
+		}
+	}
+	return nil
+}
+
+// search returns up to 10 entries under the user base. Reaching the size limit is not an error.
+func (s *ldapSettings) search(conn *ldap.Conn, filter string) ([]*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(s.userBase(), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 10, 30, false,
+		filter, []string{s.UIDAttr, s.EmailAttr}, nil)
+	result, err := conn.Search(request)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return result.Entries, nil
+}
+
+// quayConfig returns the config.yaml entries of the directory
+func (s *ldapSettings) quayConfig() map[string]interface{} {
+	config := map[string]interface{}{
+		"AUTHENTICATION_TYPE":          "LDAP",
+		"LDAP_URI":                     s.URI,
+		"LDAP_BASE_DN":                 splitDN(s.BaseDN),
+		"LDAP_USER_RDN":                splitDN(s.UserRDN),
+		"LDAP_UID_ATTR":                s.UIDAttr,
+		"LDAP_EMAIL_ATTR":              s.EmailAttr,
+		"LDAP_ALLOW_INSECURE_FALLBACK": s.AllowInsecure,
+	}
+	if s.BindDN != "" {
+		config["LDAP_ADMIN_DN"] = s.BindDN
+		config["LDAP_ADMIN_PASSWD"] = s.BindPassword
+	}
+	if s.SuperuserFilter != "" {
+		config["LDAP_SUPERUSER_FILTER"] = s.SuperuserFilter
+	}
+	return config
+}
+
+// splitDN splits a DN into its RDNs, as Quay expects LDAP_BASE_DN and
+// LDAP_USER_RDN as lists. Escaped commas are kept in their RDN.
+func splitDN(dn string) []string {
+	rdns := []string{}
+	var current strings.Builder
+	escaped := false
+	for _, r := range dn {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			rdns = append(rdns, strings.TrimSpace(current.String()))
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		rdns = append(rdns, rest)
+	}
+	return rdns
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSplitDN(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want []string
+	}{
+		{"", []string{}},
+		{"dc=example,dc=com", []string{"dc=example", "dc=com"}},
+		{"ou=People, dc=example, dc=com", []string{"ou=People", "dc=example", "dc=com"}},
+		{`o=Acme\, Inc.,dc=com`, []string{`o=Acme\, Inc.`, "dc=com"}},
+	}
+	for _, tt := range tests {
+		if got := splitDN(tt.dn); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitDN(%q) = %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
+
+func TestLDAPQuayConfig(t *testing.T) {
+	settings := &ldapSettings{
+		URI:       "ldaps://ldap.example.com",
+		BaseDN:    "dc=example,dc=com",
+		UserRDN:   "ou=People",
+		UIDAttr:   "uid",
+		EmailAttr: "mail",
+	}
+	config := settings.quayConfig()
+	if config["AUTHENTICATION_TYPE"] != "LDAP" {
+		t.Errorf("AUTHENTICATION_TYPE = %v, want LDAP", config["AUTHENTICATION_TYPE"])
+	}
+	if !reflect.DeepEqual(config["LDAP_BASE_DN"], []string{"dc=example", "dc=com"}) {
+		t.Errorf("LDAP_BASE_DN = %v", config["LDAP_BASE_DN"])
+	}
+	for _, key := range []string{"LDAP_ADMIN_DN", "LDAP_ADMIN_PASSWD", "LDAP_SUPERUSER_FILTER"} {
+		if _, ok := config[key]; ok {
+			t.Errorf("%s is set without a bind DN or a superuser filter", key)
+		}
+	}
+
+	settings.BindDN, settings.BindPassword = "cn=admin,dc=example,dc=com", "secret"
+	settings.SuperuserFilter = "(memberOf=cn=admins,dc=example,dc=com)"
+	config = settings.quayConfig()
+	if config["LDAP_ADMIN_DN"] != settings.BindDN || config["LDAP_ADMIN_PASSWD"] != "secret" {
+		t.Errorf("bind credentials were not set: %v", config)
+	}
+	if config["LDAP_SUPERUSER_FILTER"] != settings.SuperuserFilter {
+		t.Errorf("LDAP_SUPERUSER_FILTER = %v", config["LDAP_SUPERUSER_FILTER"])
+	}
+}
+
+func TestLDAPSettingsFromFlags(t *testing.T) {
+	origURI, origBaseDN, origBindDN, origFilter := ldapURI, ldapBaseDN, ldapBindDN, ldapSuperuserFilter
+	origUIDAttr, origEmailAttr := ldapUIDAttr, ldapEmailAttr
+	defer func() {
+		ldapURI, ldapBaseDN, ldapBindDN, ldapSuperuserFilter = origURI, origBaseDN, origBindDN, origFilter
+		ldapUIDAttr, ldapEmailAttr = origUIDAttr, origEmailAttr
+	}()
+	t.Setenv("MIRROR_REGISTRY_LDAP_BIND_PASSWORD", "")
+
+	tests := []struct {
+		name    string
+		uri     string
+		baseDN  string
+		bindDN  string
+		filter  string
+		uidAttr string
+		wantErr bool
+	}{
+		{"valid", "ldap://ldap.example.com:389", "dc=example,dc=com", "", "", "uid", false},
+		{"missing uri", "", "dc=example,dc=com", "", "", "uid", true},
+		{"http uri", "https://ldap.example.com", "dc=example,dc=com", "", "", "uid", true},
+		{"invalid base dn", "ldaps://ldap.example.com", "example.com", "", "", "uid", true},
+		{"invalid filter", "ldaps://ldap.example.com", "dc=example,dc=com", "", "(memberOf=", "uid", true},
+		{"invalid attribute", "ldaps://ldap.example.com", "dc=example,dc=com", "", "", "u id", true},
+		{"bind dn without password", "ldaps://ldap.example.com", "dc=example,dc=com", "cn=admin,dc=example,dc=com", "", "uid", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ldapURI, ldapBaseDN, ldapBindDN, ldapSuperuserFilter = tt.uri, tt.baseDN, tt.bindDN, tt.filter
+			ldapUIDAttr, ldapEmailAttr = tt.uidAttr, "mail"
+			_, err := ldapSettingsFromFlags()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ldapSettingsFromFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	ldapURI, ldapBaseDN, ldapBindDN = "ldaps://ldap.example.com", "dc=example,dc=com", "cn=admin,dc=example,dc=com"
+	t.Setenv("MIRROR_REGISTRY_LDAP_BIND_PASSWORD", "secret")
+	settings, err := ldapSettingsFromFlags()
+	if err != nil {
+		t.Fatalf("ldapSettingsFromFlags returned error: %v", err)
+	}
+	if settings.BindPassword != "secret" {
+		t.Errorf("the bind password was not read from the environment: %+v", settings)
+	}
+}
+
+// TestLDAPValidate runs against a real directory, for example:
+//
+//	podman run -d --name openldap -p 1389:1389 -e LDAP_ADMIN_PASSWORD=secret -e LDAP_USERS=alice -e LDAP_PASSWORDS=password bitnami/openldap
+//	MIRROR_REGISTRY_TEST_LDAP_URI=ldap://localhost:1389 \
+//	MIRROR_REGISTRY_TEST_LDAP_BASE_DN=dc=example,dc=org \
+//	MIRROR_REGISTRY_TEST_LDAP_USER_RDN=ou=users \
+//	MIRROR_REGISTRY_TEST_LDAP_BIND_DN=cn=admin,dc=example,dc=org \
+//	MIRROR_REGISTRY_TEST_LDAP_BIND_PASSWORD=secret \
+//	go test ./cmd -run TestLDAPValidate
+func TestLDAPValidate(t *testing.T) {
+	uri := os.Getenv("MIRROR_REGISTRY_TEST_LDAP_URI")
+	if uri == "" {
+		t.Skip("MIRROR_REGISTRY_TEST_LDAP_URI is not set")
+	}
+	settings := &ldapSettings{
+		URI:           uri,
+		BaseDN:        os.Getenv("MIRROR_REGISTRY_TEST_LDAP_BASE_DN"),
+		UserRDN:       os.Getenv("MIRROR_REGISTRY_TEST_LDAP_USER_RDN"),
+		BindDN:        os.Getenv("MIRROR_REGISTRY_TEST_LDAP_BIND_DN"),
+		BindPassword:  os.Getenv("MIRROR_REGISTRY_TEST_LDAP_BIND_PASSWORD"),
+		CACert:        os.Getenv("MIRROR_REGISTRY_TEST_LDAP_CA_CERT"),
+		UIDAttr:       "uid",
+		EmailAttr:     "mail",
+		AllowInsecure: true,
+	}
+	if err := settings.validate(); err != nil {
+		t.Fatalf("validate returned error: %v", err)
+	}
+
+	wrongPassword := *settings
+	wrongPassword.BindPassword += "-wrong"
+	if wrongPassword.BindDN != "" {
+		if err := wrongPassword.validate(); err == nil {
+			t.Error("expected an error with a wrong bind password")
+		}
+	}
+
+	wrongBase := *settings
+	wrongBase.UserRDN = "ou=missing"
+	if err := wrongBase.validate(); err == nil {
+		t.Error("expected an error when no user is found")
+	}
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the name of the lock file created under quayRoot on the target
+const lockFileName = ".mirror-registry.lock"
+
+// staleLockAge is the age after which a lock is considered abandoned
+const staleLockAge = 24 * time.Hour
+
+// lockHeldExitCode is returned by the acquire script when the lock already exists
+const lockHeldExitCode = 3
+
+// breakLock holds whether or not to remove an existing lock on the target
+var breakLock bool
+
+// targetLock is the content of the lock file held on the target while an operation runs
+type targetLock struct {
+	Owner     string    `json:"owner"`
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Operation string    `json:"operation"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (l *targetLock) String() string {
+	return fmt.Sprintf("%s by %s@%s (pid %d) since %s", l.Operation, l.Owner, l.Host, l.PID, l.Timestamp.Local().Format("2006-01-02 15:04:05"))
+}
+
+// isStale reports whether the process holding the lock is known to be gone
+func (l *targetLock) isStale(localHost string, now time.Time) bool {
+	if now.Sub(l.Timestamp) > staleLockAge {
+		return true
+	}
+	if l.Host == localHost && l.PID > 0 {
+		return errors.Is(syscall.Kill(l.PID, 0), syscall.ESRCH)
+	}
+	return false
+}
+
+// lockFilePath returns the shell-quoted path of the lock file on the target
+func lockFilePath() string {
+	return targetPath(path.Join(quayRoot, lockFileName))
+}
+
+// acquireLock takes the lock on the target for the given operation and
+// registers its release when the installer exits.
+func acquireLock(operation string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	lock := &targetLock{
+		Owner:     os.Getenv("USER"),
+		PID:       os.Getpid(),
+		Host:      hostname,
+		Operation: operation,
+		Timestamp: time.Now().UTC(),
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	// noclobber makes the redirection fail if the lock file already exists
+	script := fmt.Sprintf(`mkdir -p %s && { ( set -o noclobber; echo %s > %s ) 2>/dev/null || { cat %s; exit %d; }; }`,
+		targetPath(quayRoot), shellQuote(string(data)), lockFilePath(), lockFilePath(), lockHeldExitCode)
+
+	out, err := runOnTarget(script, nil)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == lockHeldExitCode {
+		existing := &targetLock{}
+		if jsonErr := json.Unmarshal(out, existing); jsonErr != nil {
+			return fmt.Errorf("Found an unreadable lock file %s on %s. Re-run with --break-lock to remove it.", path.Join(quayRoot, lockFileName), targetHostname)
+		}
+		stale := existing.isStale(hostname, time.Now())
+		if !breakLock {
+			if stale {
+				return fmt.Errorf("Found a stale lock on %s left by %s. Re-run with --break-lock to remove it.", targetHostname, existing)
+			}
+			return fmt.Errorf("Another mirror-registry run holds the lock on %s: %s. Wait for it to finish, or re-run with --break-lock if you are sure it is no longer running.", targetHostname, existing)
+		}
+		if !stale {
+			log.Warnf("Breaking a lock that does not look stale: %s", existing)
+		} else {
+			log.Warnf("Breaking stale lock: %s", existing)
+		}
+		if _, err := runOnTarget("rm -f "+lockFilePath(), nil); err != nil {
+			return err
+		}
+		breakLock = false
+		return acquireLock(operation)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not take lock on %s: %w", targetHostname, err)
+	}
+	log.Infof("Acquired lock %s on %s", path.Join(quayRoot, lockFileName), targetHostname)
+
+	onExit(func() {
+		// Only remove the lock file if it is still the one written by this run
+		script := fmt.Sprintf(`[ "$(cat %s 2>/dev/null)" = %s ] && rm -f %s || true`, lockFilePath(), shellQuote(string(data)), lockFilePath())
+		if _, err := runOnTarget(script, nil); err != nil {
+			log.Warnf("Could not release lock on %s: %s", targetHostname, strings.TrimSpace(err.Error()))
+		}
+	})
+	return nil
+}
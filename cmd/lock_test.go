@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetLockIsStale(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		lock targetLock
+		want bool
+	}{
+		{
+			name: "running process on this host",
+			lock: targetLock{Host: "here", PID: os.Getpid(), Timestamp: now},
+			want: false,
+		},
+		{
+			name: "other host within age limit",
+			lock: targetLock{Host: "elsewhere", PID: 1234, Timestamp: now.Add(-time.Hour)},
+			want: false,
+		},
+		{
+			name: "other host past age limit",
+			lock: targetLock{Host: "elsewhere", PID: 1234, Timestamp: now.Add(-staleLockAge - time.Minute)},
+			want: true,
+		},
+		{
+			name: "dead process on this host",
+			lock: targetLock{Host: "here", PID: 1 << 22, Timestamp: now},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.lock.isStale("here", now); got != tt.want {
+				t.Errorf("isStale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	origHostname, origRoot, origBreak := targetHostname, quayRoot, breakLock
+	defer func() {
+		targetHostname, quayRoot, breakLock = origHostname, origRoot, origBreak
+		exitHooks = nil
+	}()
+	targetHostname = "localhost"
+	quayRoot = filepath.Join(t.TempDir(), "quay-install")
+	lockFile := filepath.Join(quayRoot, lockFileName)
+
+	if err := acquireLock("install"); err != nil {
+		t.Fatalf("acquireLock returned error: %v", err)
+	}
+	data, err := os.ReadFile(lockFile)
+	if err != nil {
+		t.Fatalf("lock file not created: %v", err)
+	}
+	lock := &targetLock{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		t.Fatalf("lock file is not valid JSON: %v", err)
+	}
+	if lock.PID != os.Getpid() || lock.Operation != "install" {
+		t.Errorf("lock = %+v, want pid %d and operation install", lock, os.Getpid())
+	}
+
+	// A second run must not be able to take the lock
+	saved := exitHooks
+	exitHooks = nil
+	err = acquireLock("upgrade")
+	if err == nil || !strings.Contains(err.Error(), "holds the lock") {
+		t.Errorf("second acquireLock error = %v, want lock held error", err)
+	}
+	exitHooks = saved
+
+	runExitHooks()
+	if pathExists(lockFile) {
+		t.Error("lock file still exists after release")
+	}
+
+	t.Run("stale lock requires --break-lock", func(t *testing.T) {
+		hostname, _ := os.Hostname()
+		stale, _ := json.Marshal(&targetLock{Owner: "someone", PID: 1 << 22, Host: hostname, Operation: "upgrade", Timestamp: time.Now().UTC()})
+		if err := os.WriteFile(lockFile, stale, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		breakLock = false
+		err := acquireLock("install")
+		if err == nil || !strings.Contains(err.Error(), "stale") {
+			t.Fatalf("acquireLock error = %v, want stale lock error", err)
+		}
+
+		breakLock = true
+		if err := acquireLock("install"); err != nil {
+			t.Fatalf("acquireLock with --break-lock returned error: %v", err)
+		}
+		runExitHooks()
+		if pathExists(lockFile) {
+			t.Error("lock file still exists after release")
+		}
+	})
+}
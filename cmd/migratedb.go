@@ -0,0 +1,450 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// migrateTo is the database backend to migrate Quay to
+var migrateTo string
+
+// migrateSource is the DB_URI of the database copied by the hidden copy subcommand
+var migrateSource string
+
+// migrateDest is the DB_URI of the database written by the hidden copy subcommand
+var migrateDest string
+
+// migrateResultPrefix marks the line carrying the JSON result of a subcommand run on the target
+const migrateResultPrefix = "mirror-registry-result: "
+
+// migrateDBCmd represents the migrate-db command
+var migrateDBCmd = &cobra.Command{
+	Use:   "migrate-db",
+	Short: "Move the Quay database from SQLite to an external PostgreSQL database.",
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		migrateDB(cobraCmd)
+	},
+}
+
+// migrateDBCopyCmd copies a database. It is run on the target by migrate-db and upgrade.
+var migrateDBCopyCmd = &cobra.Command{
+	Use:    "copy",
+	Short:  "Copy every table of a Quay database into an empty database with the same schema.",
+	Hidden: true,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		migrateDBCopy()
+	},
+}
+
+// migrateDBRevisionCmd prints the schema revision of a database. It is run on the target by migrate-db.
+var migrateDBRevisionCmd = &cobra.Command{
+	Use:    "revision",
+	Short:  "Print the alembic revision of a Quay database.",
+	Hidden: true,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		migrateDBRevision()
+	},
+}
+
+func init() {
+
+	// Add migrate-db command
+	rootCmd.AddCommand(migrateDBCmd)
+	migrateDBCmd.AddCommand(migrateDBCopyCmd)
+	migrateDBCmd.AddCommand(migrateDBRevisionCmd)
+
+	migrateDBCmd.Flags().StringVarP(&migrateTo, "to", "", "", "The database backend to migrate to. Only postgres is supported.")
+	migrateDBCmd.Flags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	migrateDBCmd.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	migrateDBCmd.Flags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	migrateDBCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	migrateDBCmd.Flags().StringVarP(&sqliteStorage, "sqliteStorage", "", "sqlite-storage", "The folder where quay sqlite data is saved, used when it cannot be read from the running Quay container. This defaults to a Podman named volume 'sqlite-storage'.")
+	migrateDBCmd.Flags().StringVarP(&dbURI, "db-uri", "", "", "The URI of the external PostgreSQL database to migrate to, for example postgresql://quay@db.example.com:5432/quay.")
+	migrateDBCmd.Flags().StringVarP(&dbHost, "db-host", "", "", "The host of the external PostgreSQL database to migrate to. Use instead of --db-uri.")
+	migrateDBCmd.Flags().IntVarP(&dbPort, "db-port", "", 5432, "The port of the external PostgreSQL database. This defaults to 5432.")
+	migrateDBCmd.Flags().StringVarP(&dbName, "db-name", "", "quay", "The name of the external PostgreSQL database. This defaults to quay.")
+	migrateDBCmd.Flags().StringVarP(&dbUser, "db-user", "", "", "The user Quay connects to the external PostgreSQL database with.")
+	migrateDBCmd.Flags().StringVarP(&dbPasswordFile, "db-password-file", "", "", "The path of a file containing the password of --db-user. Can also be set with $MIRROR_REGISTRY_DB_PASSWORD.")
+	migrateDBCmd.Flags().StringVarP(&dbSSLMode, "db-sslmode", "", "require", "The sslmode used to connect to the external PostgreSQL database when the URI does not set one. This defaults to require.")
+	migrateDBCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+	migrateDBCmd.Flags().BoolVarP(&autoApprove, "autoApprove", "", false, "Skips interactive approval")
+
+	migrateDBCopyCmd.Flags().StringVarP(&migrateSource, "source", "", os.Getenv("MIRROR_REGISTRY_MIGRATE_SOURCE"), "The DB_URI of the database to copy. This defaults to $MIRROR_REGISTRY_MIGRATE_SOURCE")
+	migrateDBCopyCmd.Flags().StringVarP(&migrateDest, "dest", "", os.Getenv("MIRROR_REGISTRY_MIGRATE_DEST"), "The DB_URI of the database to copy to. This defaults to $MIRROR_REGISTRY_MIGRATE_DEST")
+	migrateDBRevisionCmd.Flags().StringVarP(&migrateSource, "source", "", os.Getenv("MIRROR_REGISTRY_MIGRATE_SOURCE"), "The DB_URI of the database. This defaults to $MIRROR_REGISTRY_MIGRATE_SOURCE")
+
+}
+
+func migrateDB(cobraCmd *cobra.Command) {
+
+	var err error
+	log.Printf("Database migration has begun")
+
+	if migrateTo != databaseBackendPostgres {
+		check(fmt.Errorf("Unsupported migration target %q. Only --to postgres is supported.", migrateTo))
+	}
+	if !externalDatabaseRequested() {
+		check(errors.New("The PostgreSQL database to migrate to is required. Supply it with --db-uri or --db-host."))
+	}
+	configTarget(cobraCmd)
+	uri, err := postgresURIFromFlags()
+	check(err)
+	log.Infof("Checking PostgreSQL database %s", redactURI(uri))
+	err = preflightPostgres(context.Background(), uri)
+	check(err)
+	err = checkDatabaseEmpty(context.Background(), uri)
+	check(err)
+
+	if !autoApprove {
+		err = requireInteractive("approval", "Re-run with --autoApprove to migrate without prompting.")
+		check(err)
+		question := fmt.Sprintf("Quay on %s will be unavailable during the migration. Continue? [y/n]", targetHostname)
+		fmt.Println(question)
+		if !getApproval(question) {
+			log.Info("Migration cancelled.")
+			return
+		}
+	}
+
+	// Roll back and record the interruption on SIGINT/SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("migrate-db")
+	check(err)
+
+	state, err := beginOperation("migrate-db", false)
+	check(err)
+
+	counts, err := migrateToPostgres(ctx, state, uri)
+	if err == nil {
+		state.DatabaseBackend = databaseBackendPostgres
+	}
+	finishOperation(ctx, state, err)
+
+	printTableCounts(counts, verbose)
+	log.Printf("Quay on %s now uses the PostgreSQL database %s", targetHostname, redactURI(uri))
+	log.Printf("The SQLite database was left in place, and the previous config.yaml was saved as %s", quayConfigPath()+".sqlite")
+}
+
+// migrateToPostgres moves Quay from SQLite to PostgreSQL. If a step fails
+// after Quay was stopped, Quay is restarted on SQLite and the tables created
+// in PostgreSQL are dropped.
+func migrateToPostgres(ctx context.Context, state *installState, uri string) ([]tableCount, error) {
+	state.startStep("check-config")
+	config, err := readQuayConfig()
+	if err != nil {
+		return nil, err
+	}
+	current, err := configValue(config, "DB_URI")
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := current.(string); !ok || !strings.HasPrefix(s, "sqlite:") {
+		return nil, fmt.Errorf("Quay on %s does not use SQLite. DB_URI is %v", targetHostname, redactURI(fmt.Sprint(current)))
+	}
+	hostname, _ := configValue(config, "SERVER_HOSTNAME")
+	image, sqliteSource := runningQuayContainer()
+	state.completeStep("check-config")
+
+	state.startStep("prepare")
+	if err := checkTargetMachine(); err != nil {
+		return nil, err
+	}
+	migrator, err := uploadInstaller(".mirror-registry-migrator")
+	if err != nil {
+		return nil, err
+	}
+	envFile, err := writeTargetPrivateFile(".migrate-db.env", fmt.Sprintf("MIRROR_REGISTRY_MIGRATE_SOURCE=%s\nMIRROR_REGISTRY_MIGRATE_DEST=%s\n", current, uri))
+	if err != nil {
+		return nil, err
+	}
+	migrateConfig, err := setConfigValue(config, "DB_URI", uri)
+	if err != nil {
+		return nil, err
+	}
+	migrateConfigDir, err := prepareMigrateConfigDir(migrateConfig)
+	if err != nil {
+		return nil, err
+	}
+	state.completeStep("prepare")
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	state.startStep("stop-quay")
+	log.Info("Stopping Quay")
+	if err := systemctlOnTarget("stop", "quay-app.service"); err != nil {
+		return nil, err
+	}
+	state.completeStep("stop-quay")
+
+	configSwitched := false
+	rollback := func(cause error) error {
+		return rollbackToSQLite(uri, fmt.Sprint(hostname), configSwitched, cause)
+	}
+
+	runMigrator := func(args string) ([]byte, error) {
+		script := fmt.Sprintf(`podman run --rm --net host --user 0 -v %s:/sqlite:Z -v %s:/usr/local/bin/mirror-registry-migrator:Z --env-file %s --entrypoint /usr/local/bin/mirror-registry-migrator %s %s`,
+			shellQuote(sqliteSource), targetPath(migrator), targetPath(envFile), shellQuote(image), args)
+		return runOnTarget(script, nil)
+	}
+
+	state.startStep("read-revision")
+	out, err := runMigrator("migrate-db revision")
+	var revision string
+	if err == nil {
+		err = parseMigrateResult(out, &revision)
+	}
+	if err != nil {
+		return nil, rollback(fmt.Errorf("Could not read the schema revision of the SQLite database: %w", err))
+	}
+	state.completeStep("read-revision")
+	if ctx.Err() != nil {
+		return nil, rollback(ctx.Err())
+	}
+
+	state.startStep("create-schema")
+	log.Infof("Creating the Quay schema at revision %s in PostgreSQL", revision)
+	script := fmt.Sprintf(`podman run --rm --net host -v %s:/quay-registry/conf/stack:Z %s migrate %s`, targetPath(migrateConfigDir), shellQuote(image), shellQuote(revision))
+	if out, err := runOnTarget(script, nil); err != nil {
+		log.Debug(string(out))
+		return nil, rollback(fmt.Errorf("Could not create the Quay schema in PostgreSQL: %w", err))
+	}
+	state.completeStep("create-schema")
+	if ctx.Err() != nil {
+		return nil, rollback(ctx.Err())
+	}
+
+	state.startStep("copy-data")
+	log.Info("Copying data from SQLite to PostgreSQL. This may take some time.")
+	out, err = runMigrator("migrate-db copy")
+	log.Debug(string(out))
+	var counts []tableCount
+	if resultErr := parseMigrateResult(out, &counts); err == nil {
+		err = resultErr
+	}
+	if err != nil {
+		printTableCounts(counts, verbose)
+		return counts, rollback(fmt.Errorf("Could not copy the data to PostgreSQL: %w", err))
+	}
+	state.completeStep("copy-data")
+	if ctx.Err() != nil {
+		return counts, rollback(ctx.Err())
+	}
+
+	state.startStep("switch-config")
+	if err := writeQuayConfig(migrateConfig, ".sqlite"); err != nil {
+		return counts, rollback(err)
+	}
+	configSwitched = true
+	state.completeStep("switch-config")
+
+	return counts, startOnPostgres(state, uri, fmt.Sprint(hostname))
+}
+
+// startOnPostgres starts Quay once config.yaml points to PostgreSQL, and rolls
+// back to SQLite if it does not become healthy.
+func startOnPostgres(state *installState, uri, hostname string) error {
+	state.startStep("start-quay")
+	log.Info("Starting Quay on PostgreSQL")
+	if err := systemctlOnTarget("start", "quay-app.service"); err != nil {
+		return rollbackToSQLite(uri, hostname, true, err)
+	}
+	if err := waitForQuayOnTarget(hostname); err != nil {
+		return rollbackToSQLite(uri, hostname, true, err)
+	}
+	state.completeStep("start-quay")
+	return nil
+}
+
+// rollbackToSQLite restarts Quay on SQLite after a failed migration and drops
+// the tables created in PostgreSQL. Quay may already be running on PostgreSQL
+// when the failure happened after starting it, so it is stopped first.
+func rollbackToSQLite(uri, hostname string, configSwitched bool, cause error) error {
+	log.Errorf("Migration failed: %s", cause.Error())
+	log.Warn("Rolling back to SQLite")
+	stopped := true
+	if err := systemctlOnTarget("stop", "quay-app.service"); err != nil {
+		log.Warnf("Could not stop Quay, the tables created in PostgreSQL are kept: %s", err.Error())
+		stopped = false
+	}
+	if configSwitched {
+		if err := restoreQuayConfig(".sqlite"); err != nil {
+			log.Warnf("Could not restore config.yaml: %s", err.Error())
+		}
+	}
+	if stopped {
+		if err := dropAllTables(context.Background(), uri); err != nil {
+			log.Warnf("Could not drop the tables created in PostgreSQL: %s", err.Error())
+		}
+	}
+	// A unit that could not be stopped is restarted to read the restored config.yaml
+	action := "start"
+	if !stopped {
+		action = "restart"
+	}
+	if err := systemctlOnTarget(action, "quay-app.service"); err != nil {
+		log.Warnf("Could not restart Quay: %s", err.Error())
+	} else if err := waitForQuayOnTarget(hostname); err != nil {
+		log.Warn(err.Error())
+	} else {
+		log.Info("Quay is running on SQLite again")
+	}
+	return cause
+}
+
+// runningQuayContainer returns the image of the quay-app container and the
+// volume or directory mounted at /sqlite, falling back to the flags when the
+// container cannot be inspected.
+func runningQuayContainer() (string, string) {
+	format := `{{.ImageName}}{{"\n"}}{{range .Mounts}}{{if eq .Destination "/sqlite"}}{{if .Name}}{{.Name}}{{else}}{{.Source}}{{end}}{{end}}{{end}}`
+	out, err := runOnTarget("podman inspect --format "+shellQuote(format)+" quay-app", nil)
+	image, source := quayImage, sqliteStorage
+	if err != nil {
+		log.Debugf("Could not inspect quay-app container, using %s and %s: %s", image, source, err.Error())
+		return image, source
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) != "" {
+		image = strings.TrimSpace(lines[0])
+	}
+	if len(lines) > 1 && strings.TrimSpace(lines[1]) != "" {
+		source = strings.TrimSpace(lines[1])
+	}
+	return image, source
+}
+
+// writeTargetPrivateFile writes a file under quayRoot only readable by the
+// target user. The file is removed when the installer exits.
+func writeTargetPrivateFile(name, content string) (string, error) {
+	remote := path.Join(quayRoot, name)
+	if _, err := runOnTarget(fmt.Sprintf(`umask 077 && cat > %s`, targetPath(remote)), strings.NewReader(content)); err != nil {
+		return "", err
+	}
+	onExit(func() {
+		runOnTarget("rm -f "+targetPath(remote), nil)
+	})
+	return remote, nil
+}
+
+// prepareMigrateConfigDir creates a copy of quay-config holding the given
+// config.yaml, used to run the Quay migrations against another database.
+func prepareMigrateConfigDir(config []byte) (string, error) {
+	dir := path.Join(quayRoot, ".quay-config-migrate")
+	script := fmt.Sprintf(`umask 077 && rm -rf %s && cp -a %s %s && cat > %s`,
+		targetPath(dir), targetPath(path.Join(quayRoot, "quay-config")), targetPath(dir), targetPath(path.Join(dir, "config.yaml")))
+	if _, err := runOnTarget(script, bytes.NewReader(config)); err != nil {
+		return "", err
+	}
+	onExit(func() {
+		runOnTarget("rm -rf "+targetPath(dir), nil)
+	})
+	return dir, nil
+}
+
+// checkDatabaseEmpty returns an error if the database already has tables
+func checkDatabaseEmpty(ctx context.Context, uri string) error {
+	db, dialect, err := openDatabase(uri)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tables, err := dialect.tables(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(tables) > 0 {
+		return fmt.Errorf("The database %s already has %d tables. Migrate to an empty database.", redactURI(uri), len(tables))
+	}
+	return nil
+}
+
+// dropAllTables drops the tables created in a database that was empty before the migration
+func dropAllTables(ctx context.Context, uri string) error {
+	db, dialect, err := openDatabase(uri)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tables, err := dialect.tables(ctx, db)
+	if err != nil || len(tables) == 0 {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "DROP TABLE IF EXISTS "+quoteIdents(tables)+" CASCADE")
+	return err
+}
+
+// printMigrateResult prints the result of a subcommand run on the target on a line of its own
+func printMigrateResult(v interface{}) {
+	data, err := json.Marshal(v)
+	check(err)
+	fmt.Println(migrateResultPrefix + string(data))
+}
+
+// parseMigrateResult reads the result printed by printMigrateResult
+func parseMigrateResult(out []byte, v interface{}) error {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, migrateResultPrefix) {
+			return json.Unmarshal([]byte(strings.TrimPrefix(line, migrateResultPrefix)), v)
+		}
+	}
+	return errors.New("No result found in the output of the migration container")
+}
+
+// printTableCounts prints the row counts and checksums of the copied tables.
+// Unless all is set, only the tables that differ are listed.
+func printTableCounts(counts []tableCount, all bool) {
+	if len(counts) == 0 {
+		return
+	}
+	var rows int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tSOURCE ROWS\tDEST ROWS\tSOURCE CHECKSUM\tDEST CHECKSUM")
+	for _, count := range counts {
+		rows += count.Source
+		if all || count.Source != count.Dest || count.SourceChecksum != count.DestChecksum {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", count.Table, count.Source, count.Dest, orDash(count.SourceChecksum), orDash(count.DestChecksum))
+		}
+	}
+	w.Flush()
+	log.Infof("Copied %d tables with %d rows", len(counts), rows)
+}
+
+func migrateDBCopy() {
+	src, srcDialect, err := openDatabase(migrateSource)
+	check(err)
+	defer src.Close()
+	dst, dstDialect, err := openDatabase(migrateDest)
+	check(err)
+	defer dst.Close()
+
+	counts, err := copyDatabase(context.Background(), src, srcDialect, dst, dstDialect)
+	printTableCounts(counts, true)
+	printMigrateResult(counts)
+	check(err)
+}
+
+func migrateDBRevision() {
+	db, _, err := openDatabase(migrateSource)
+	check(err)
+	defer db.Close()
+
+	revision, err := schemaRevision(context.Background(), db)
+	check(err)
+	printMigrateResult(revision)
+}
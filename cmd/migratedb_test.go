@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestStartOnPostgresRollsBack(t *testing.T) {
+	origHostname, origQuayRoot := targetHostname, quayRoot
+	origSystemctl, origWait := systemctlOnTarget, waitForQuayOnTarget
+	defer func() {
+		targetHostname, quayRoot = origHostname, origQuayRoot
+		systemctlOnTarget, waitForQuayOnTarget = origSystemctl, origWait
+	}()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "localhost"
+
+	tests := []struct {
+		name string
+		// failStart makes starting quay-app fail, otherwise Quay starts but is not healthy
+		failStart   bool
+		failStop    bool
+		wantActions []string
+	}{
+		{"health check fails", false, false, []string{"start", "stop", "start"}},
+		{"start fails", true, false, []string{"start", "stop", "start"}},
+		{"stop fails", false, true, []string{"start", "stop", "restart"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quayRoot = t.TempDir()
+			if err := os.MkdirAll(targetStateDir(), 0700); err != nil {
+				t.Fatal(err)
+			}
+			configDir := path.Join(quayRoot, "quay-config")
+			writeTestDir(t, configDir, map[string][]byte{
+				"config.yaml":        []byte("DB_URI: postgresql://quay@db/quay\n"),
+				"config.yaml.sqlite": []byte("DB_URI: sqlite:////sqlite/quay_sqlite.db\n"),
+			})
+			// An empty database stands in for PostgreSQL
+			uri := "sqlite:///" + path.Join(t.TempDir(), "postgres.db")
+
+			var actions []string
+			starts := 0
+			systemctlOnTarget = func(action, unit string) error {
+				actions = append(actions, action)
+				switch {
+				case action == "start":
+					starts++
+					if tt.failStart && starts == 1 {
+						return errors.New("start failed")
+					}
+				case action == "stop" && tt.failStop:
+					return errors.New("stop failed")
+				}
+				return nil
+			}
+			healthChecks := 0
+			waitForQuayOnTarget = func(hostname string) error {
+				healthChecks++
+				if healthChecks == 1 && !tt.failStart {
+					return errors.New("Quay did not become alive")
+				}
+				return nil
+			}
+
+			if err := startOnPostgres(&installState{}, uri, "quay.example.com:8443"); err == nil {
+				t.Fatal("startOnPostgres() succeeded, want an error")
+			}
+			if !reflect.DeepEqual(actions, tt.wantActions) {
+				t.Errorf("systemctl actions = %q, want %q", actions, tt.wantActions)
+			}
+			if healthChecks == 0 {
+				t.Error("Quay was not checked again after the rollback")
+			}
+			config, err := ioutil.ReadFile(path.Join(configDir, "config.yaml"))
+			if err != nil || string(config) != "DB_URI: sqlite:////sqlite/quay_sqlite.db\n" {
+				t.Errorf("config.yaml = %q, %v, want the SQLite config", config, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// oidcIssuer is the issuer URL of the OIDC provider, such as https://keycloak.example.com/realms/quay
+var oidcIssuer string
+
+// oidcClientID is the ID of the client registered for Quay in the OIDC provider
+var oidcClientID string
+
+// oidcClientSecretFile is the path of a file containing the secret of oidcClientID
+var oidcClientSecretFile string
+
+// oidcLoginScopes is the comma-separated list of scopes requested at login
+var oidcLoginScopes string
+
+// oidcCACert is the path of the CA certificate that signed the certificate of the OIDC provider
+var oidcCACert string
+
+// oidcServiceName is the name of the login button shown by Quay
+var oidcServiceName string
+
+// oidcSettings describes the OIDC provider users can log in with
+type oidcSettings struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	CACert       string
+	ServiceName  string
+}
+
+// oidcDiscovery is the part of the discovery document of an issuer that Quay relies on
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	ScopesSupported       []string `json:"scopes_supported"`
+}
+
+// oidcRequested reports whether OIDC settings were passed
+func oidcRequested() bool {
+	return oidcIssuer != ""
+}
+
+// oidcSettingsFromFlags reads the OIDC settings from the flags and the environment
+func oidcSettingsFromFlags() (*oidcSettings, error) {
+	settings := &oidcSettings{
+		Issuer:      strings.TrimSuffix(oidcIssuer, "/"),
+		ClientID:    oidcClientID,
+		CACert:      oidcCACert,
+		ServiceName: oidcServiceName,
+	}
+	u, err := url.Parse(settings.Issuer)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid OIDC issuer %q. Use https://host[/path]", oidcIssuer)
+	}
+	if settings.ClientID == "" {
+		return nil, errors.New("--oidc-client-id is required with --oidc-issuer")
+	}
+	settings.ClientSecret, err = oidcClientSecret()
+	if err != nil {
+		return nil, err
+	}
+	if settings.ClientSecret == "" {
+		return nil, errors.New("The OIDC client secret is required with --oidc-issuer. Supply it with --oidc-client-secret-file or $MIRROR_REGISTRY_OIDC_CLIENT_SECRET")
+	}
+	for _, scope := range strings.Split(oidcLoginScopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			settings.Scopes = append(settings.Scopes, scope)
+		}
+	}
+	if !contains(settings.Scopes, "openid") {
+		return nil, errors.New("--oidc-login-scopes must include openid")
+	}
+	if settings.CACert != "" && !pathExists(settings.CACert) {
+		return nil, errors.New("Could not find OIDC CA certificate at " + settings.CACert)
+	}
+	return settings, nil
+}
+
+// oidcClientSecret reads the client secret from --oidc-client-secret-file or the environment
+func oidcClientSecret() (string, error) {
+	if oidcClientSecretFile != "" {
+		data, err := ioutil.ReadFile(oidcClientSecretFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv("MIRROR_REGISTRY_OIDC_CLIENT_SECRET"), nil
+}
+
+// httpClient returns a client trusting the system certificates and --oidc-ca-cert
+func (s *oidcSettings) httpClient() (*http.Client, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if s.CACert != "" {
+		pem, err := ioutil.ReadFile(s.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate found in " + s.CACert)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// validate fetches the discovery document of the issuer from the installer host
+// and checks that it describes the issuer and publishes its signing keys.
+func (s *oidcSettings) validate(ctx context.Context) error {
+	client, err := s.httpClient()
+	if err != nil {
+		return err
+	}
+	discoveryURL := s.Issuer + "/.well-known/openid-configuration"
+	var discovery oidcDiscovery
+	if err := getJSON(ctx, client, discoveryURL, &discovery); err != nil {
+		return fmt.Errorf("Could not read the OIDC discovery document: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != s.Issuer {
+		return fmt.Errorf("The discovery document of %s names the issuer %q. Pass that URL to --oidc-issuer", s.Issuer, discovery.Issuer)
+	}
+	for name, endpoint := range map[string]string{
+		"authorization_endpoint": discovery.AuthorizationEndpoint,
+		"token_endpoint":         discovery.TokenEndpoint,
+		"jwks_uri":               discovery.JWKSURI,
+	} {
+		if endpoint == "" {
+			return fmt.Errorf("The discovery document of %s has no %s", s.Issuer, name)
+		}
+	}
+	if len(discovery.ScopesSupported) > 0 {
+		for _, scope := range s.Scopes {
+			if !contains(discovery.ScopesSupported, scope) {
+				log.Warnf("The scope %s is not listed as supported by %s", scope, s.Issuer)
+			}
+		}
+	}
+
+	var keys struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := getJSON(ctx, client, discovery.JWKSURI, &keys); err != nil {
+		return fmt.Errorf("Could not read the signing keys of %s: %w", s.Issuer, err)
+	}
+	if len(keys.Keys) == 0 {
+		return fmt.Errorf("%s publishes no signing keys at %s", s.Issuer, discovery.JWKSURI)
+	}
+	return nil
+}
+
+// getJSON fetches a URL and decodes its JSON body into out
+func getJSON(ctx context.Context, client *http.Client, rawURL string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", rawURL, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("GET %s did not return JSON: %w", rawURL, err)
+	}
+	return nil
+}
+
+// quayConfig returns the OIDC_LOGIN_CONFIG entry of config.yaml. Quay expects
+// OIDC_SERVER to end with a slash.
+func (s *oidcSettings) quayConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"OIDC_SERVER":   s.Issuer + "/",
+		"CLIENT_ID":     s.ClientID,
+		"CLIENT_SECRET": s.ClientSecret,
+		"LOGIN_SCOPES":  s.Scopes,
+		"SERVICE_NAME":  s.ServiceName,
+	}
+}
+
+// oidcRunnerFlags checks the OIDC settings against the issuer and returns the
+// mount flags and the extra vars argument passing them to the playbook
+func oidcRunnerFlags() (string, string, error) {
+	settings, err := oidcSettingsFromFlags()
+	if err != nil {
+		return "", "", err
+	}
+	log.Infof("Checking OIDC issuer %s", settings.Issuer)
+	if err := settings.validate(context.Background()); err != nil {
+		return "", "", err
+	}
+	mountFlags, varsArg, err := runnerVarsFlags("oidc.json", map[string]interface{}{
+		"oidc_login_config": settings.quayConfig(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if settings.CACert != "" {
+		caCertAbs, err := filepath.Abs(settings.CACert)
+		if err != nil {
+			return "", "", err
+		}
+		mountFlags += fmt.Sprintf(" -v %s:/runner/certs/oidc-ca.crt:Z ", caCertAbs)
+	}
+	return mountFlags, varsArg, nil
+}
+
+// contains reports whether values contains value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOIDCSettingsFromFlags(t *testing.T) {
+	origIssuer, origClientID, origSecretFile, origScopes := oidcIssuer, oidcClientID, oidcClientSecretFile, oidcLoginScopes
+	defer func() {
+		oidcIssuer, oidcClientID, oidcClientSecretFile, oidcLoginScopes = origIssuer, origClientID, origSecretFile, origScopes
+	}()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MIRROR_REGISTRY_OIDC_CLIENT_SECRET", "")
+
+	tests := []struct {
+		name       string
+		issuer     string
+		clientID   string
+		secretFile string
+		scopes     string
+		wantErr    bool
+	}{
+		{"valid", "https://sso.example.com/realms/quay/", "quay", secretFile, "openid, email", false},
+		{"http issuer", "http://sso.example.com/realms/quay", "quay", secretFile, "openid", true},
+		{"missing client id", "https://sso.example.com/realms/quay", "", secretFile, "openid", true},
+		{"missing secret", "https://sso.example.com/realms/quay", "quay", "", "openid", true},
+		{"missing openid scope", "https://sso.example.com/realms/quay", "quay", secretFile, "email,profile", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oidcIssuer, oidcClientID, oidcClientSecretFile, oidcLoginScopes = tt.issuer, tt.clientID, tt.secretFile, tt.scopes
+			settings, err := oidcSettingsFromFlags()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("oidcSettingsFromFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if settings.Issuer != "https://sso.example.com/realms/quay" || settings.ClientSecret != "s3cret" {
+				t.Errorf("unexpected settings: %+v", settings)
+			}
+			if !reflect.DeepEqual(settings.Scopes, []string{"openid", "email"}) {
+				t.Errorf("Scopes = %q", settings.Scopes)
+			}
+			if server := settings.quayConfig()["OIDC_SERVER"]; server != "https://sso.example.com/realms/quay/" {
+				t.Errorf("OIDC_SERVER = %v, want a trailing slash", server)
+			}
+		})
+	}
+}
+
+func TestOIDCValidate(t *testing.T) {
+	var issuer string
+	var keys []interface{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/realms/quay/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/protocol/openid-connect/auth",
+				"token_endpoint":         issuer + "/protocol/openid-connect/token",
+				"jwks_uri":               issuer + "/protocol/openid-connect/certs",
+				"scopes_supported":       []string{"openid", "email"},
+			})
+		case "/realms/quay/protocol/openid-connect/certs":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	caCert := filepath.Join(t.TempDir(), "ca.crt")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caCert, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings := &oidcSettings{Issuer: server.URL + "/realms/quay", Scopes: []string{"openid"}, CACert: caCert}
+
+	issuer, keys = settings.Issuer, []interface{}{map[string]string{"kid": "1", "kty": "RSA"}}
+	if err := settings.validate(context.Background()); err != nil {
+		t.Errorf("validate returned error: %v", err)
+	}
+
+	issuer = server.URL + "/realms/other"
+	if err := settings.validate(context.Background()); err == nil {
+		t.Error("expected an error when the discovery document names another issuer")
+	}
+
+	issuer, keys = settings.Issuer, nil
+	if err := settings.validate(context.Background()); err == nil {
+		t.Error("expected an error when the issuer publishes no signing keys")
+	}
+
+	untrusted := *settings
+	untrusted.CACert = ""
+	if err := untrusted.validate(context.Background()); err == nil {
+		t.Error("expected an error when the certificate of the issuer is not trusted")
+	}
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// httpProxy is the proxy used for plain HTTP requests by Quay, its pod and the installer
+var httpProxy string
+
+// httpsProxy is the proxy used for HTTPS requests by Quay, its pod and the installer
+var httpsProxy string
+
+// noProxy is the comma-separated list of hosts reached without the proxy
+var noProxy string
+
+// proxyLocalHosts are always reached without the proxy, as the containers of
+// the pod share its network namespace
+var proxyLocalHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// proxySettings describes the proxy of the target
+type proxySettings struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    []string
+}
+
+// proxyRequested reports whether proxy settings were passed
+func proxyRequested() bool {
+	return httpProxy != "" || httpsProxy != "" || noProxy != ""
+}
+
+// proxySettingsFromFlags reads the proxy flags. hostname is the Quay hostname,
+// which is added to the hosts reached without the proxy with the pod-local addresses.
+func proxySettingsFromFlags(hostname string) (*proxySettings, error) {
+	if httpProxy == "" && httpsProxy == "" {
+		return nil, errors.New("--no-proxy requires --http-proxy or --https-proxy")
+	}
+	for _, proxy := range []string{httpProxy, httpsProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid proxy URL %q. Use http://[user:password@]host:port", redactURI(proxy))
+		}
+	}
+	settings := &proxySettings{HTTPProxy: httpProxy, HTTPSProxy: httpsProxy}
+	hosts := append(strings.Split(noProxy, ","), proxyLocalHosts...)
+	if hostname != "" {
+		hosts = append(hosts, strings.Split(hostname, ":")[0])
+	}
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" && !contains(settings.NoProxy, host) {
+			settings.NoProxy = append(settings.NoProxy, host)
+		}
+	}
+	return settings, nil
+}
+
+// env returns the proxy variables in both the upper and lower case spellings,
+// as tools disagree on which one they read
+func (p *proxySettings) env() map[string]string {
+	env := map[string]string{}
+	for name, value := range map[string]string{
+		"HTTP_PROXY":  p.HTTPProxy,
+		"HTTPS_PROXY": p.HTTPSProxy,
+		"NO_PROXY":    strings.Join(p.NoProxy, ","),
+	} {
+		if value != "" {
+			env[name] = value
+			env[strings.ToLower(name)] = value
+		}
+	}
+	return env
+}
+
+// proxyRunnerFlags returns the flags passing the proxy to the runner container
+// and the extra vars argument passing it to the playbook. The variables are
+// set in the environment of the installer and copied by name, so that
+// proxy credentials do not appear on the podman command line.
+func proxyRunnerFlags(hostname string) (string, string, error) {
+	settings, err := proxySettingsFromFlags(hostname)
+	if err != nil {
+		return "", "", err
+	}
+	env := settings.env()
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var flags string
+	for _, name := range names {
+		if err := os.Setenv(name, env[name]); err != nil {
+			return "", "", err
+		}
+		flags += fmt.Sprintf(" -e %s ", name)
+	}
+	mountFlags, varsArg, err := runnerVarsFlags("proxy.json", map[string]interface{}{
+		"proxy_settings": env,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return flags + mountFlags, varsArg, nil
+}
@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// pushFrom is the local image to push, such as oci:/path/layout:tag
+var pushFrom string
+
+// pushTo is the repository and tag to push to, such as ocp4/openshift/release:4.14.1
+var pushTo string
+
+// repositoryPattern matches the repository names accepted by Quay
+var repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)+$`)
+
+// tagPattern matches valid tags
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// pushCmd represents the push command
+var pushCmd = &cobra.Command{
+	Use:   "push",
+	Short: "Push a local OCI image layout or docker-archive to Quay.",
+	Args:  cobra.NoArgs,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		push(cobraCmd)
+	},
+}
+
+func init() {
+
+	// Add push command
+	rootCmd.AddCommand(pushCmd)
+
+	pushCmd.Flags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	pushCmd.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	pushCmd.Flags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	pushCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	pushCmd.Flags().StringVarP(&quayHostname, "quayHostname", "", "", "The SERVER_HOSTNAME of Quay. This defaults to the value used by the last install, or <targetHostname>:8443")
+	pushCmd.Flags().StringVarP(&pushFrom, "from", "", "", "The image to push: oci:/path[:tag], oci-archive:/path.tar[:tag] or docker-archive:/path.tar[:name:tag].")
+	pushCmd.Flags().StringVarP(&pushTo, "to", "", "", "The repository and tag to push to, such as ocp4/openshift/release:4.14.1. The tag defaults to the one the image was saved with.")
+	pushCmd.Flags().StringVarP(&registryUsername, "username", "", "", "The Quay user to push as. This defaults to the init user stored by install.")
+	pushCmd.Flags().StringVarP(&registryPasswordFile, "password-file", "", "", "The path of a file containing the password of --username. Can also be set with $MIRROR_REGISTRY_PASSWORD.")
+	pushCmd.Flags().IntVarP(&registryParallel, "parallel", "", 4, "The number of blobs uploaded at the same time.")
+	pushCmd.MarkFlagRequired("from")
+	pushCmd.MarkFlagRequired("to")
+
+}
+
+// registryTarget reuses the quayRoot and quayHostname of the last install unless they were passed
+func registryTarget(cobraCmd *cobra.Command) {
+	err := loadSSHKeys()
+	check(err)
+
+	previous, err := loadInstallState()
+	check(err)
+	if !cobraCmd.Flags().Changed("quayRoot") && previous.QuayRoot != "" {
+		quayRoot = previous.QuayRoot
+	}
+	if quayHostname == "" {
+		quayHostname = previous.QuayHostname
+	}
+	if quayHostname == "" {
+		quayHostname = targetHostname + ":8443"
+	}
+}
+
+// parseImageReference splits org/repo:tag into the repository and the tag. The
+// hostname of Quay may prefix the repository. defaultTag is used when no tag is given.
+func parseImageReference(ref, defaultTag string) (string, string, error) {
+	ref = strings.TrimPrefix(ref, quayHostname+"/")
+	repo, tag := ref, defaultTag
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repo, tag = ref[:i], ref[i+1:]
+	}
+	if !repositoryPattern.MatchString(repo) {
+		return "", "", fmt.Errorf("Invalid repository %q. Use lowercase ORG/REPO", repo)
+	}
+	if tag == "" {
+		return "", "", fmt.Errorf("%s has no tag. Add one, such as %s:latest", ref, repo)
+	}
+	if !tagPattern.MatchString(tag) {
+		return "", "", fmt.Errorf("Invalid tag %q", tag)
+	}
+	return repo, tag, nil
+}
+
+// blobLocations remembers a repository of the registry holding each blob, so
+// that later pushes mount the blob from there instead of uploading it again
+type blobLocations struct {
+	file string
+	mu   sync.Mutex
+	repo map[string]string
+}
+
+// loadBlobLocations reads the blob locations of the current target
+func loadBlobLocations() *blobLocations {
+	locations := &blobLocations{file: path.Join(targetStateDir(), "blob-locations.json"), repo: map[string]string{}}
+	if data, err := ioutil.ReadFile(locations.file); err == nil {
+		if err := json.Unmarshal(data, &locations.repo); err != nil {
+			log.Debugf("Ignoring %s: %s", locations.file, err.Error())
+		}
+	}
+	return locations
+}
+
+func (l *blobLocations) get(digest string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.repo[digest]
+}
+
+func (l *blobLocations) add(digest, repo string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.repo[digest] = repo
+}
+
+// save writes the blob locations to a file only readable by the current user
+func (l *blobLocations) save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(path.Dir(l.file), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(l.repo)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.file, data, 0600)
+}
+
+// imagePusher pushes the manifests and blobs of a local image to a repository
+type imagePusher struct {
+	client    *registryClient
+	source    *imageSource
+	repo      string
+	parallel  int
+	locations *blobLocations
+
+	mu       sync.Mutex
+	uploaded int
+	mounted  int
+	existing int
+	bytes    int64
+}
+
+// pushManifest pushes the blobs of a manifest, or the manifests of an index,
+// before the manifest itself
+func (p *imagePusher) pushManifest(desc ociDescriptor, reference string) error {
+	data, manifest, err := p.source.readManifest(desc)
+	if err != nil {
+		return err
+	}
+	if manifest.isIndex() {
+		for _, child := range manifest.Manifests {
+			if err := p.pushManifest(child, child.Digest); err != nil {
+				return fmt.Errorf("%s: %w", child.Platform, err)
+			}
+		}
+	} else if err := p.pushBlobs(manifest.blobs()); err != nil {
+		return err
+	}
+	if err := p.client.putManifest(p.repo, reference, manifest.MediaType, data); err != nil {
+		return err
+	}
+	log.Debugf("Pushed manifest %s as %s:%s", desc.Digest, p.repo, reference)
+	return nil
+}
+
+// pushBlobs pushes blobs, up to p.parallel at a time, and returns the first error
+func (p *imagePusher) pushBlobs(blobs []ociDescriptor) error {
+	seen := map[string]bool{}
+	sem := make(chan struct{}, p.parallel)
+	errs := make(chan error, len(blobs))
+	var wg sync.WaitGroup
+	for _, blob := range blobs {
+		if seen[blob.Digest] {
+			continue
+		}
+		seen[blob.Digest] = true
+		wg.Add(1)
+		go func(blob ociDescriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs <- p.pushBlob(blob)
+		}(blob)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushBlob skips a blob the repository has, mounts it from another repository
+// known to have it, or uploads it
+func (p *imagePusher) pushBlob(blob ociDescriptor) error {
+	exists, err := p.client.blobExists(p.repo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		p.count(&p.existing, 0)
+		p.locations.add(blob.Digest, p.repo)
+		return nil
+	}
+
+	var location string
+	if from := p.locations.get(blob.Digest); from != "" && from != p.repo {
+		location, err = p.client.startUpload(p.repo, blob.Digest, from)
+		if err == nil && location == "" {
+			log.Debugf("Mounted blob %s from %s", blob.Digest, from)
+			p.count(&p.mounted, 0)
+			p.locations.add(blob.Digest, p.repo)
+			return nil
+		}
+		if err != nil {
+			log.Debugf("Could not mount blob %s from %s: %s", blob.Digest, from, err.Error())
+		}
+	}
+	if location == "" {
+		if location, err = p.client.startUpload(p.repo, blob.Digest, ""); err != nil {
+			return err
+		}
+	}
+
+	r, err := p.source.open(blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if r.Size() != blob.Size {
+		return fmt.Errorf("blob %s has %d bytes, the manifest expects %d", blob.Digest, r.Size(), blob.Size)
+	}
+	log.Infof("Uploading blob %s (%s)", blob.Digest, formatBytes(blob.Size))
+	if err := p.client.uploadBlob(p.repo, location, blob, r); err != nil {
+		return err
+	}
+	p.count(&p.uploaded, blob.Size)
+	p.locations.add(blob.Digest, p.repo)
+	return nil
+}
+
+// count adds a blob to one of the counters of the summary
+func (p *imagePusher) count(counter *int, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	*counter++
+	p.bytes += size
+}
+
+func push(cobraCmd *cobra.Command) {
+
+	audit := auditCommand("push")
+	if registryParallel < 1 {
+		check(errors.New("--parallel must be at least 1"))
+	}
+	source, err := openImageSource(pushFrom)
+	check(err)
+	defer source.Close()
+
+	registryTarget(cobraCmd)
+	repo, tag, err := parseImageReference(pushTo, source.refName)
+	check(err)
+	client, err := quayRegistryClient()
+	check(err)
+
+	pusher := &imagePusher{
+		client:    client,
+		source:    source,
+		repo:      repo,
+		parallel:  registryParallel,
+		locations: loadBlobLocations(),
+	}
+	log.Infof("Pushing %s to %s/%s:%s", pushFrom, quayHostname, repo, tag)
+	err = pusher.pushManifest(source.root, tag)
+	if saveErr := pusher.locations.save(); saveErr != nil {
+		log.Warnf("Could not save the blob locations: %s", saveErr.Error())
+	}
+	if err != nil {
+		check(fmt.Errorf("%w. Run the same command again to continue, the blobs already pushed are not uploaded again", err))
+	}
+	log.Infof("Pushed %s/%s:%s: %d blobs uploaded (%s), %d mounted from other repositories, %d already present",
+		quayHostname, repo, tag, pusher.uploaded, formatBytes(pusher.bytes), pusher.mounted, pusher.existing)
+	audit.Status = statusSucceeded
+}
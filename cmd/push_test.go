@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testImageFiles returns the files of an OCI image layout holding a
+// multi-architecture image tagged v1, with a layer shared by both platforms
+func testImageFiles(t *testing.T) (map[string][]byte, ociDescriptor) {
+	files := map[string][]byte{"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`)}
+	blob := func(mediaType string, data []byte) ociDescriptor {
+		desc := ociDescriptor{MediaType: mediaType, Digest: sha256Digest(data), Size: int64(len(data))}
+		files[blobPath(desc.Digest)] = data
+		return desc
+	}
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	shared := blob(mediaTypeOCILayer, []byte("shared layer"))
+	index := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	for _, arch := range []string{"amd64", "arm64"} {
+		manifest := ociManifest{
+			SchemaVersion: 2,
+			MediaType:     mediaTypeOCIManifest,
+			Config:        descriptorPointer(blob(mediaTypeOCIConfig, []byte(`{"architecture":"`+arch+`"}`))),
+			Layers:        []ociDescriptor{shared, blob(mediaTypeOCILayer, []byte(arch+" layer"))},
+		}
+		desc := blob(mediaTypeOCIManifest, marshal(manifest))
+		desc.Platform = &ociPlatform{OS: "linux", Architecture: arch}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	root := blob(mediaTypeOCIIndex, marshal(index))
+	root.Annotations = map[string]string{ociRefNameAnnotation: "v1"}
+	files["index.json"] = marshal(ociManifest{SchemaVersion: 2, Manifests: []ociDescriptor{root}})
+	return files, root
+}
+
+func descriptorPointer(desc ociDescriptor) *ociDescriptor {
+	return &desc
+}
+
+// writeTestDir writes files into a directory
+func writeTestDir(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeTestTar writes files into a tar file
+func writeTestTar(t *testing.T, file string, files map[string][]byte) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(files[name])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseImageSource(t *testing.T) {
+	dir := t.TempDir()
+	archive := path.Join(dir, "image:v1.tar")
+	writeTestTar(t, archive, map[string][]byte{"manifest.json": []byte("[]")})
+
+	tests := []struct {
+		source                     string
+		transport, file, reference string
+		wantErr                    bool
+	}{
+		{"oci:" + dir, "oci", dir, "", false},
+		{"oci:" + dir + ":v1", "oci", dir, "v1", false},
+		{"docker-archive:" + archive + ":quay.io/org/image:v1", "docker-archive", archive, "quay.io/org/image:v1", false},
+		{"oci-archive:" + archive, "oci-archive", archive, "", false},
+		{"docker://quay.io/org/image:v1", "", "", "", true},
+		{"oci:" + dir + "/missing:v1", "", "", "", true},
+	}
+	for _, tt := range tests {
+		transport, file, reference, err := parseImageSource(tt.source)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseImageSource(%q) error = %v, wantErr %v", tt.source, err, tt.wantErr)
+			continue
+		}
+		if transport != tt.transport || file != tt.file || reference != tt.reference {
+			t.Errorf("parseImageSource(%q) = %q, %q, %q, want %q, %q, %q", tt.source, transport, file, reference, tt.transport, tt.file, tt.reference)
+		}
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	origHostname := quayHostname
+	defer func() { quayHostname = origHostname }()
+	quayHostname = "quay.example.com:8443"
+
+	tests := []struct {
+		ref, defaultTag string
+		repo, tag       string
+		wantErr         bool
+	}{
+		{"ocp4/openshift/release:4.14.1", "", "ocp4/openshift/release", "4.14.1", false},
+		{"quay.example.com:8443/ocp4/release", "v1", "ocp4/release", "v1", false},
+		{"ocp4/release", "", "", "", true},
+		{"release:v1", "", "", "", true},
+		{"OCP4/release:v1", "", "", "", true},
+		{"ocp4/release:-v1", "", "", "", true},
+	}
+	for _, tt := range tests {
+		repo, tag, err := parseImageReference(tt.ref, tt.defaultTag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseImageReference(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			continue
+		}
+		if repo != tt.repo || tag != tt.tag {
+			t.Errorf("parseImageReference(%q) = %q, %q, want %q, %q", tt.ref, repo, tag, tt.repo, tt.tag)
+		}
+	}
+}
+
+func TestPushImage(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	files, root := testImageFiles(t)
+	dir := t.TempDir()
+	writeTestDir(t, path.Join(dir, "layout"), files)
+	writeTestTar(t, path.Join(dir, "layout.tar"), files)
+
+	fake, client := newFakeRegistry(t)
+	locations := loadBlobLocations()
+	tests := []struct {
+		source                      string
+		repo                        string
+		uploaded, mounted, existing int
+	}{
+		// 2 configs, 2 platform layers and the shared layer, which the
+		// second platform finds already pushed
+		{"oci:" + path.Join(dir, "layout") + ":v1", "ocp4/image", 5, 0, 1},
+		{"oci-archive:" + path.Join(dir, "layout.tar"), "ocp4/image", 0, 0, 6},
+		{"oci:" + path.Join(dir, "layout"), "ocp4/copy", 0, 5, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			source, err := openImageSource(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+			if source.root.Digest != root.Digest || source.refName != "v1" {
+				t.Fatalf("root = %s %q, want %s v1", source.root.Digest, source.refName, root.Digest)
+			}
+			pusher := &imagePusher{client: client, source: source, repo: tt.repo, parallel: 2, locations: locations}
+			if err := pusher.pushManifest(source.root, source.refName); err != nil {
+				t.Fatal(err)
+			}
+			if pusher.uploaded != tt.uploaded || pusher.mounted != tt.mounted || pusher.existing != tt.existing {
+				t.Errorf("uploaded %d, mounted %d, existing %d, want %d, %d, %d",
+					pusher.uploaded, pusher.mounted, pusher.existing, tt.uploaded, tt.mounted, tt.existing)
+			}
+			if digest, err := client.headManifest(tt.repo, "v1"); err != nil || digest != root.Digest {
+				t.Errorf("%s:v1 = %q, %v, want %s", tt.repo, digest, err, root.Digest)
+			}
+		})
+	}
+	if err := locations.save(); err != nil {
+		t.Fatal(err)
+	}
+	if saved := loadBlobLocations(); len(saved.repo) != 5 {
+		t.Errorf("%d saved blob locations, want 5", len(saved.repo))
+	}
+	if fake.mounts != 5 {
+		t.Errorf("%d mounts, want 5", fake.mounts)
+	}
+}
+
+func TestPushDockerArchive(t *testing.T) {
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	layer := []byte("layer")
+	archive := path.Join(t.TempDir(), "image.tar")
+	writeTestTar(t, archive, map[string][]byte{
+		"manifest.json":   []byte(`[{"Config":"config.json","RepoTags":["quay.io/org/image:v2"],"Layers":["layer/layer.tar"]}]`),
+		"config.json":     config,
+		"layer/layer.tar": layer,
+	})
+
+	source, err := openImageSource("docker-archive:" + archive + ":org/image:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if source.refName != "v2" {
+		t.Errorf("refName = %q, want v2", source.refName)
+	}
+	data, manifest, err := source.readManifest(source.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config.Digest != sha256Digest(config) || len(manifest.Layers) != 1 || manifest.Layers[0].Digest != sha256Digest(layer) || manifest.Layers[0].MediaType != mediaTypeOCILayer {
+		t.Fatalf("manifest = %s", data)
+	}
+
+	fake, client := newFakeRegistry(t)
+	pusher := &imagePusher{client: client, source: source, repo: "org/image", parallel: 1, locations: &blobLocations{repo: map[string]string{}}}
+	if err := pusher.pushManifest(source.root, "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.blobs[sha256Digest(layer)], layer) {
+		t.Errorf("layer = %q, want %q", fake.blobs[sha256Digest(layer)], layer)
+	}
+	if tags, err := client.tags("org/image"); err != nil || len(tags) != 1 || tags[0] != "v2" {
+		t.Errorf("tags() = %q, %v, want [v2]", tags, err)
+	}
+}
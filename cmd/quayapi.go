@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// quayClient calls the Quay API with an OAuth access token
+type quayClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// quayAPIError is a failed call to the Quay API
+type quayAPIError struct {
+	method  string
+	path    string
+	status  int
+	message string
+}
+
+func (e *quayAPIError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("%s %s returned %d", e.method, e.path, e.status)
+	}
+	return fmt.Sprintf("%s %s returned %d: %s", e.method, e.path, e.status, e.message)
+}
+
+// isNotFound reports whether err is a Quay API call that returned 404
+func isNotFound(err error) bool {
+	var apiErr *quayAPIError
+	return errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound
+}
+
+// resolveAPIToken returns the API token from --token, $MIRROR_REGISTRY_TOKEN
+// or the credentials of the init user, in that order
+func resolveAPIToken() string {
+	if apiToken != "" {
+		return apiToken
+	}
+	if token := os.Getenv("MIRROR_REGISTRY_TOKEN"); token != "" {
+		return token
+	}
+	return storedAPIToken()
+}
+
+// quayTLSConfig trusts the system certificates and the certificate Quay
+// serves, which is read from the target so that the self-signed certificate
+// generated by install is trusted.
+func quayTLSConfig() *tls.Config {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	cert, err := runOnTarget("cat "+targetPath(path.Join(quayRoot, "quay-config", "ssl.cert")), nil)
+	if err != nil || !pool.AppendCertsFromPEM(cert) {
+		log.Debugf("Could not read the Quay certificate from %s, using the system trust store", targetHostname)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+}
+
+// newQuayClient returns a client for the Quay API at https://<hostname>
+func newQuayClient(hostname, token string) *quayClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = quayTLSConfig()
+	return &quayClient{
+		baseURL: "https://" + hostname,
+		token:   token,
+		client:  &http.Client{Transport: transport, Timeout: 60 * time.Second},
+	}
+}
+
+// do calls the API and decodes the JSON response into out when it is not nil
+func (c *quayClient) do(method, apiPath string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+apiPath, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	log.Debugf("Quay API: %s %s", method, apiPath)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &quayAPIError{method: method, path: apiPath, status: resp.StatusCode, message: quayErrorMessage(data)}
+	}
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// quayErrorMessage extracts the message of an API error response
+func quayErrorMessage(data []byte) string {
+	var body struct {
+		ErrorMessage string `json:"error_message"`
+		Detail       string `json:"detail"`
+		Message      string `json:"message"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		return strings.TrimSpace(string(data))
+	}
+	for _, message := range []string{body.ErrorMessage, body.Detail, body.Message} {
+		if message != "" {
+			return message
+		}
+	}
+	return ""
+}
+
+// apiPath builds an API path, escaping each element
+func apiPath(elements ...string) string {
+	escaped := make([]string, len(elements))
+	for i, element := range elements {
+		escaped[i] = url.PathEscape(element)
+	}
+	return "/api/v1/" + strings.Join(escaped, "/")
+}
@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configOverridesFile is kept next to config.yaml and merged over it by install and upgrade
+const configOverridesFile = "config-overrides.yaml"
+
+// generatedConfigFile is the config.yaml rendered from the template by the last install
+const generatedConfigFile = "config.generated.yaml"
+
+// protectedConfigKeys cannot be overridden, as Quay could no longer read its data
+var protectedConfigKeys = []string{"SECRET_KEY", "DATABASE_SECRET_KEY"}
+
+// configOverrideFile is the path of a local file copied to config-overrides.yaml on the target
+var configOverrideFile string
+
+// quayConfigPath returns the path of config.yaml on the target
+func quayConfigPath() string {
+	return path.Join(quayRoot, "quay-config", "config.yaml")
+}
+
+// readQuayConfigFile reads a file next to config.yaml on the target. A
+// missing file returns no data and no error.
+func readQuayConfigFile(name string) ([]byte, error) {
+	file := targetPath(path.Join(quayRoot, "quay-config", name))
+	out, err := runOnTarget(fmt.Sprintf(`if [ -f %s ]; then cat %s; fi`, file, file), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s on %s: %w", name, targetHostname, err)
+	}
+	return out, nil
+}
+
+// readQuayConfig reads config.yaml from the target
+func readQuayConfig() ([]byte, error) {
+	out, err := runOnTarget("cat "+targetPath(quayConfigPath()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s on %s: %w", quayConfigPath(), targetHostname, err)
+	}
+	return out, nil
+}
+
+// writeQuayConfig replaces config.yaml on the target, keeping the previous
+// version next to it with the given suffix when backupSuffix is not empty.
+func writeQuayConfig(data []byte, backupSuffix string) error {
+	file := targetPath(quayConfigPath())
+	script := fmt.Sprintf(`umask 077 && cat > %s.new && `, file)
+	if backupSuffix != "" {
+		script += fmt.Sprintf(`cp -p %s %s && `, file, targetPath(quayConfigPath()+backupSuffix))
+	}
+	script += fmt.Sprintf(`chmod --reference=%s %s.new && mv %s.new %s`, file, file, file, file)
+	if _, err := runOnTarget(script, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("Could not write %s on %s: %w", quayConfigPath(), targetHostname, err)
+	}
+	return nil
+}
+
+// restoreQuayConfig puts back the config.yaml saved by writeQuayConfig
+func restoreQuayConfig(backupSuffix string) error {
+	script := fmt.Sprintf(`mv %s %s`, targetPath(quayConfigPath()+backupSuffix), targetPath(quayConfigPath()))
+	_, err := runOnTarget(script, nil)
+	return err
+}
+
+// configValue returns the value of a top-level key of a Quay config
+func configValue(data []byte, key string) (interface{}, error) {
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return config[key], nil
+}
+
+// setConfigValue sets a top-level key of a Quay config, keeping the order and
+// comments of the other keys.
+func setConfigValue(data []byte, key string, value interface{}) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config.yaml is not a mapping")
+	}
+
+	var valueNode yaml.Node
+	if err := valueNode.Encode(value); err != nil {
+		return nil, err
+	}
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			root.Content[i+1] = &valueNode
+			found = true
+			break
+		}
+	}
+	if !found {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, &valueNode)
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// parseConfig parses a Quay config into a map. An empty document is an empty map.
+func parseConfig(data []byte) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadConfigOverrides reads a local overrides file and checks that it can be
+// merged into config.yaml
+func loadConfigOverrides(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a YAML mapping of config.yaml keys: %w", file, err)
+	}
+	for _, key := range protectedConfigKeys {
+		if _, ok := overrides[key]; ok {
+			return nil, fmt.Errorf("%s cannot override %s", file, key)
+		}
+	}
+	if len(overrides) == 0 {
+		return nil, errors.New(file + " has no settings")
+	}
+	return overrides, nil
+}
+
+// mergeConfig deep-merges overrides into base the way the playbook does with
+// combine(recursive=True): mappings are merged, any other value is replaced.
+func mergeConfig(base, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		baseMap, baseIsMap := merged[key].(map[string]interface{})
+		overrideMap, overrideIsMap := value.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[key] = mergeConfig(baseMap, overrideMap)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// configChange is a setting that differs between two configs. Old or New is
+// nil when the setting was added or removed.
+type configChange struct {
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+// diffConfig returns the settings that differ between old and new, sorted by
+// path. Nested mappings are compared key by key.
+func diffConfig(old, new map[string]interface{}) []configChange {
+	var changes []configChange
+	diffConfigInto(&changes, "", old, new)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diffConfigInto(changes *[]configChange, prefix string, old, new map[string]interface{}) {
+	keys := map[string]bool{}
+	for key := range old {
+		keys[key] = true
+	}
+	for key := range new {
+		keys[key] = true
+	}
+	for key := range keys {
+		oldValue, newValue := old[key], new[key]
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := newValue.(map[string]interface{})
+		switch {
+		case oldIsMap && newIsMap:
+			diffConfigInto(changes, prefix+key+".", oldMap, newMap)
+		case formatConfigValue(oldValue) != formatConfigValue(newValue):
+			*changes = append(*changes, configChange{Path: prefix + key, Old: oldValue, New: newValue})
+		}
+	}
+}
+
+// hasConfigPath reports whether a dotted path from diffConfig is set in config
+func hasConfigPath(config map[string]interface{}, configPath string) bool {
+	var current interface{} = config
+	for _, key := range strings.Split(configPath, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			// A whole mapping replaced by a scalar is reported at its own path
+			return true
+		}
+		if current, ok = m[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// configPathsNotIn returns the paths of the changes that are not set in config
+func configPathsNotIn(changes []configChange, config map[string]interface{}) []string {
+	var paths []string
+	for _, change := range changes {
+		if !hasConfigPath(config, change.Path) {
+			paths = append(paths, change.Path)
+		}
+	}
+	return paths
+}
+
+// formatConfigValue prints a config value on one line
+func formatConfigValue(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSetConfigValue(t *testing.T) {
+	config := []byte("SERVER_HOSTNAME: quay.example.com:8443\nDB_URI: sqlite:////sqlite/quay_sqlite.db\nFEATURE_MAILING: false\n")
+
+	tests := []struct {
+		name  string
+		key   string
+		value interface{}
+		want  string
+	}{
+		{
+			name:  "replace existing key",
+			key:   "DB_URI",
+			value: "postgresql://quay@db:5432/quay",
+			want:  "SERVER_HOSTNAME: quay.example.com:8443\nDB_URI: postgresql://quay@db:5432/quay\nFEATURE_MAILING: false\n",
+		},
+		{
+			name:  "append new key",
+			key:   "DB_CONNECTION_ARGS",
+			value: map[string]interface{}{"sslmode": "require"},
+			want:  "SERVER_HOSTNAME: quay.example.com:8443\nDB_URI: sqlite:////sqlite/quay_sqlite.db\nFEATURE_MAILING: false\nDB_CONNECTION_ARGS:\n  sslmode: require\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setConfigValue(config, tt.key, tt.value)
+			if err != nil {
+				t.Fatalf("setConfigValue returned error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("setConfigValue() =\n%s\nwant\n%s", got, tt.want)
+			}
+			value, err := configValue(got, tt.key)
+			if err != nil || value == nil {
+				t.Errorf("configValue(%s) = %v, %v", tt.key, value, err)
+			}
+		})
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	base, _ := parseConfig([]byte("REGISTRY_TITLE: Red Hat Quay\nFEATURE_MAILING: false\nTAG_EXPIRATION_OPTIONS: [2w, 4w]\nUSER_EVENTS_REDIS:\n  host: localhost\n  port: 6379\n"))
+	overrides, _ := parseConfig([]byte("REGISTRY_TITLE: Acme Registry\nTAG_EXPIRATION_OPTIONS: [1d]\nUSER_EVENTS_REDIS:\n  port: 6380\nFEATURE_PROXY_CACHE: true\n"))
+
+	merged := mergeConfig(base, overrides)
+	want, _ := parseConfig([]byte("REGISTRY_TITLE: Acme Registry\nFEATURE_MAILING: false\nTAG_EXPIRATION_OPTIONS: [1d]\nUSER_EVENTS_REDIS:\n  host: localhost\n  port: 6380\nFEATURE_PROXY_CACHE: true\n"))
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeConfig() = %v, want %v", merged, want)
+	}
+	if base["REGISTRY_TITLE"] != "Red Hat Quay" || base["USER_EVENTS_REDIS"].(map[string]interface{})["port"] != 6379 {
+		t.Errorf("mergeConfig modified its base: %v", base)
+	}
+
+	changes := diffConfig(base, merged)
+	var paths []string
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	wantPaths := []string{"FEATURE_PROXY_CACHE", "REGISTRY_TITLE", "TAG_EXPIRATION_OPTIONS", "USER_EVENTS_REDIS.port"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("diffConfig() paths = %q, want %q", paths, wantPaths)
+	}
+	if changes[0].Old != nil || changes[0].New != true {
+		t.Errorf("added setting = %+v", changes[0])
+	}
+	for _, path := range wantPaths {
+		if !hasConfigPath(overrides, path) {
+			t.Errorf("hasConfigPath(%s) = false", path)
+		}
+	}
+	if hasConfigPath(overrides, "USER_EVENTS_REDIS.host") {
+		t.Error("hasConfigPath(USER_EVENTS_REDIS.host) = true")
+	}
+	if paths := configPathsNotIn(changes, overrides); paths != nil {
+		t.Errorf("configPathsNotIn(overrides) = %q, want none", paths)
+	}
+	if paths := configPathsNotIn(changes, nil); !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("configPathsNotIn(nil) = %q, want %q", paths, wantPaths)
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", "FEATURE_PROXY_CACHE: true\nREGISTRY_TITLE: Acme\n", false},
+		{"not a mapping", "- FEATURE_PROXY_CACHE\n", true},
+		{"empty", "", true},
+		{"secret key", "SECRET_KEY: abc\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name+".yaml")
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfigOverrides(file)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfigOverrides() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,783 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registryUsername is the user pushing to and pulling from the registry API of Quay
+var registryUsername string
+
+// registryPasswordFile is the path of a file containing the password of registryUsername
+var registryPasswordFile string
+
+// registryParallel is the number of blobs copied at the same time
+var registryParallel int
+
+// Media types of the manifests the registry client understands
+const (
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig          = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer           = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip       = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// manifestMediaTypes are accepted when fetching manifests, in order of preference
+var manifestMediaTypes = []string{mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerManifestList, mediaTypeDockerManifest}
+
+// registryChunkSize is the size of the chunks blobs are uploaded in, so that a
+// failed chunk is sent again from the last byte the registry received
+var registryChunkSize int64 = 16 << 20
+
+// registryRetries is how many times a failed chunk is retried
+const registryRetries = 3
+
+// registryRetryDelay is the wait before the first retry, doubled for each following one
+var registryRetryDelay = time.Second
+
+// digestPattern matches the digests of blobs and manifests
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ociDescriptor points to a blob or a manifest
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Platform     *ociPlatform      `json:"platform,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ociPlatform is the platform of a manifest listed in an index
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String returns the platform as os/architecture[/variant]
+func (p *ociPlatform) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ociManifest is an image manifest or an index, in the OCI or Docker v2 format
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        *ociDescriptor    `json:"config,omitempty"`
+	Layers        []ociDescriptor   `json:"layers,omitempty"`
+	Manifests     []ociDescriptor   `json:"manifests,omitempty"`
+	Subject       *ociDescriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// isIndex reports whether the manifest lists other manifests
+func (m *ociManifest) isIndex() bool {
+	return m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerManifestList || (m.Config == nil && len(m.Manifests) > 0)
+}
+
+// blobs returns the config and the layers of an image manifest
+func (m *ociManifest) blobs() []ociDescriptor {
+	var blobs []ociDescriptor
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	return append(blobs, m.Layers...)
+}
+
+// parseManifest decodes a manifest and fills in its media type from the
+// Content-Type of the registry when the manifest does not include it
+func parseManifest(data []byte, mediaType string) (*ociManifest, error) {
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest: %w", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = mediaType
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = mediaTypeOCIManifest
+		if manifest.Config == nil {
+			manifest.MediaType = mediaTypeOCIIndex
+		}
+	}
+	return manifest, nil
+}
+
+// registryClient calls the registry API (/v2) of Quay or another registry with
+// basic or bearer token authentication
+type registryClient struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+
+	mu        sync.Mutex
+	challenge *registryChallenge
+	tokens    map[string]string
+}
+
+// registryChallenge is how the registry asked to authenticate
+type registryChallenge struct {
+	scheme  string
+	realm   string
+	service string
+}
+
+// newRegistryClient returns a client for the registry at baseURL, such as https://quay.example.com:8443
+func newRegistryClient(baseURL, username, password string, tlsConfig *tls.Config) *registryClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ResponseHeaderTimeout = 5 * time.Minute
+	return &registryClient{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		username: username,
+		password: password,
+		client:   &http.Client{Transport: transport},
+		tokens:   map[string]string{},
+	}
+}
+
+// registryPassword reads the password of --username from --password-file or the environment
+func registryPassword() (string, error) {
+	if registryPasswordFile != "" {
+		data, err := ioutil.ReadFile(registryPasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv("MIRROR_REGISTRY_PASSWORD"), nil
+}
+
+// quayRegistryClient returns a client for the registry of the target, using
+// --username or the init user stored by install
+func quayRegistryClient() (*registryClient, error) {
+	username, password := registryUsername, ""
+	if username != "" {
+		var err error
+		if password, err = registryPassword(); err != nil {
+			return nil, err
+		}
+	} else {
+		creds, err := loadCredentials()
+		if err != nil {
+			return nil, err
+		}
+		username, password = creds.InitUser, creds.InitPassword
+		if creds.Passwords[username] != "" {
+			password = creds.Passwords[username]
+		}
+	}
+	if username == "" || password == "" {
+		return nil, errors.New("Registry credentials are required. Supply them with --username and --password-file or $MIRROR_REGISTRY_PASSWORD, or install with this installer to store the credentials of the init user")
+	}
+	return newRegistryClient("https://"+quayHostname, username, password, quayTLSConfig()), nil
+}
+
+// registryTLSConfig trusts the system certificates and the CA certificate in caCert, if set
+func registryTLSConfig(caCert string) (*tls.Config, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate found in " + caCert)
+		}
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// repositoryScope returns the token scope for actions on a repository
+func repositoryScope(repo string, actions ...string) string {
+	return "repository:" + repo + ":" + strings.Join(actions, ",")
+}
+
+// discover asks the registry how to authenticate, once
+func (c *registryClient) discover() (*registryChallenge, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.challenge != nil {
+		return c.challenge, nil
+	}
+	resp, err := c.client.Get(c.baseURL + "/v2/")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	challenge := &registryChallenge{}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		challenge = parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	default:
+		return nil, fmt.Errorf("%s/v2/ returned %d. Is it a container registry?", c.baseURL, resp.StatusCode)
+	}
+	c.challenge = challenge
+	return challenge, nil
+}
+
+// challengeParam matches the parameters of a WWW-Authenticate header
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://quay.example.com/v2/auth",service="quay.example.com"
+func parseChallenge(header string) *registryChallenge {
+	challenge := &registryChallenge{scheme: strings.ToLower(strings.SplitN(header, " ", 2)[0])}
+	for _, match := range challengeParam.FindAllStringSubmatch(header, -1) {
+		switch strings.ToLower(match[1]) {
+		case "realm":
+			challenge.realm = match[2]
+		case "service":
+			challenge.service = match[2]
+		}
+	}
+	return challenge
+}
+
+// token returns a bearer token for the scopes, fetching it from the realm of the registry
+func (c *registryClient) token(challenge *registryChallenge, scopes []string) (string, error) {
+	key := strings.Join(scopes, " ")
+	c.mu.Lock()
+	token, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok {
+		return token, nil
+	}
+
+	query := url.Values{}
+	if challenge.service != "" {
+		query.Set("service", challenge.service)
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	req, err := http.NewRequest("GET", challenge.realm+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Could not log in to %s as %s: %s returned %d", c.baseURL, c.username, challenge.realm, resp.StatusCode)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	token = body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	c.mu.Lock()
+	c.tokens[key] = token
+	c.mu.Unlock()
+	return token, nil
+}
+
+// do sends a request authenticated for the scopes. A request with a body is
+// sent again after an expired token is renewed only when it can be rewound.
+func (c *registryClient) do(req *http.Request, scopes ...string) (*http.Response, error) {
+	challenge, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		switch challenge.scheme {
+		case "basic":
+			req.SetBasicAuth(c.username, c.password)
+		case "bearer":
+			token, err := c.token(challenge, scopes)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		log.Debugf("Registry: %s %s", req.Method, req.URL.Path)
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || challenge.scheme != "bearer" || attempt > 0 || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		resp.Body.Close()
+		c.mu.Lock()
+		delete(c.tokens, strings.Join(scopes, " "))
+		c.mu.Unlock()
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// registryError returns the error of an unexpected response and closes its body
+func registryError(resp *http.Response) error {
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	message := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		message = body.Errors[0].Code + ": " + body.Errors[0].Message
+	}
+	if message == "" {
+		return fmt.Errorf("%s %s returned %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode)
+	}
+	return fmt.Errorf("%s %s returned %d: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, message)
+}
+
+// url returns the URL of a path of the registry API of a repository
+func (c *registryClient) url(repo string, elements ...string) string {
+	return c.baseURL + "/v2/" + repo + "/" + strings.Join(elements, "/")
+}
+
+// resolve returns an upload location, which may be relative, as an absolute URL
+func (c *registryClient) resolve(location string) (string, error) {
+	base, err := url.Parse(c.baseURL + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// blobExists reports whether the repository has a blob
+func (c *registryClient) blobExists(repo, digest string) (bool, error) {
+	req, err := http.NewRequest("HEAD", c.url(repo, "blobs", digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req, repositoryScope(repo, "pull"))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("HEAD %s returned %d", req.URL.Path, resp.StatusCode)
+}
+
+// getBlob returns the content of a blob. The registry may redirect to its storage.
+func (c *registryClient) getBlob(repo, digest string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.url(repo, "blobs", digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, repositoryScope(repo, "pull"))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, registryError(resp)
+	}
+	return resp.Body, nil
+}
+
+// startUpload starts a blob upload, or mounts the blob from another repository
+// of the registry when from is set. It returns the location of the upload, or
+// an empty location when the blob was mounted.
+func (c *registryClient) startUpload(repo, digest, from string) (string, error) {
+	uploadURL := c.url(repo, "blobs", "uploads") + "/"
+	scopes := []string{repositoryScope(repo, "pull", "push")}
+	if from != "" {
+		uploadURL += "?" + url.Values{"mount": {digest}, "from": {from}}.Encode()
+		scopes = append(scopes, repositoryScope(from, "pull"))
+	}
+	req, err := http.NewRequest("POST", uploadURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req, scopes...)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		resp.Body.Close()
+		if from != "" {
+			return "", nil
+		}
+		return "", fmt.Errorf("POST %s created a blob without an upload", req.URL.Path)
+	case http.StatusAccepted:
+		resp.Body.Close()
+		return c.resolve(resp.Header.Get("Location"))
+	}
+	return "", registryError(resp)
+}
+
+// uploadStatus returns how many bytes of an upload the registry received
+func (c *registryClient) uploadStatus(repo, location string) (int64, string, error) {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := c.do(req, repositoryScope(repo, "pull", "push"))
+	if err != nil {
+		return 0, "", err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return 0, "", registryError(resp)
+	}
+	resp.Body.Close()
+	if next := resp.Header.Get("Location"); next != "" {
+		if location, err = c.resolve(next); err != nil {
+			return 0, "", err
+		}
+	}
+	return parseUploadRange(resp.Header.Get("Range")), location, nil
+}
+
+// parseUploadRange returns the number of bytes received from a Range header such as 0-1023
+func parseUploadRange(header string) int64 {
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return end + 1
+}
+
+// withQuery adds query parameters to a URL that may already have some
+func withQuery(rawURL string, query url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + query.Encode()
+	}
+	return rawURL + "?" + query.Encode()
+}
+
+// uploadBlob uploads a blob in chunks read from r, which may be a stream from
+// another registry. Only the current chunk is kept in memory.
+func (c *registryClient) uploadBlob(repo, location string, desc ociDescriptor, r io.Reader) error {
+	size := registryChunkSize
+	if desc.Size < size {
+		size = desc.Size
+	}
+	buf := make([]byte, size)
+	var offset int64
+	for offset < desc.Size {
+		chunk := buf
+		if desc.Size-offset < int64(len(chunk)) {
+			chunk = chunk[:desc.Size-offset]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return fmt.Errorf("Could not read blob %s: %w", desc.Digest, err)
+		}
+		var err error
+		if location, err = c.uploadChunk(repo, location, desc, offset, chunk); err != nil {
+			return err
+		}
+		offset += int64(len(chunk))
+	}
+
+	req, err := http.NewRequest("PUT", withQuery(location, url.Values{"digest": {desc.Digest}}), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, repositoryScope(repo, "pull", "push"))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return registryError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadChunk sends a chunk starting at offset. When it fails, the rest of
+// the chunk is sent again from the last byte the registry received.
+func (c *registryClient) uploadChunk(repo, location string, desc ociDescriptor, offset int64, chunk []byte) (string, error) {
+	at, data := offset, chunk
+	for failures := 1; ; failures++ {
+		next, err := c.patchChunk(repo, location, at, data)
+		if err == nil {
+			return next, nil
+		}
+		if failures > registryRetries {
+			return "", fmt.Errorf("Could not upload blob %s: %w", desc.Digest, err)
+		}
+		log.Warnf("Upload of blob %s failed at %d of %d bytes, resuming: %s", desc.Digest, at, desc.Size, err.Error())
+		time.Sleep(registryRetryDelay << (failures - 1))
+		received, statusLocation, statusErr := c.uploadStatus(repo, location)
+		if statusErr != nil {
+			return "", fmt.Errorf("Could not upload blob %s: %w", desc.Digest, statusErr)
+		}
+		if received < offset || received > offset+int64(len(chunk)) {
+			return "", fmt.Errorf("Could not upload blob %s: the registry received %d bytes, expected %d to %d", desc.Digest, received, offset, offset+int64(len(chunk)))
+		}
+		location, at, data = statusLocation, received, chunk[received-offset:]
+		if len(data) == 0 {
+			return location, nil
+		}
+	}
+}
+
+// patchChunk sends one chunk of an upload and returns the location of the next one
+func (c *registryClient) patchChunk(repo, location string, offset int64, chunk []byte) (string, error) {
+	req, err := http.NewRequest("PATCH", location, bytes.NewReader(chunk))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1))
+	resp, err := c.do(req, repositoryScope(repo, "pull", "push"))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		return "", registryError(resp)
+	}
+	resp.Body.Close()
+	if next := resp.Header.Get("Location"); next != "" {
+		return c.resolve(next)
+	}
+	return location, nil
+}
+
+// getManifest returns a manifest by tag or digest with its media type and digest
+func (c *registryClient) getManifest(repo, reference string) ([]byte, string, string, error) {
+	req, err := http.NewRequest("GET", c.url(repo, "manifests", reference), nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.do(req, repositoryScope(repo, "pull"))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", registryError(resp)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	digest := sha256Digest(data)
+	if digestPattern.MatchString(reference) && reference != digest {
+		return nil, "", "", fmt.Errorf("The manifest %s of %s has the digest %s", reference, repo, digest)
+	}
+	return data, strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0], digest, nil
+}
+
+// headManifest returns the digest of a manifest, or an empty digest when it does not exist
+func (c *registryClient) headManifest(repo, reference string) (string, error) {
+	req, err := http.NewRequest("HEAD", c.url(repo, "manifests", reference), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.do(req, repositoryScope(repo, "pull"))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+		data, _, digest, err := c.getManifest(repo, reference)
+		if err != nil || len(data) == 0 {
+			return "", err
+		}
+		return digest, nil
+	case http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden:
+		return "", nil
+	}
+	return "", fmt.Errorf("HEAD %s returned %d", req.URL.Path, resp.StatusCode)
+}
+
+// putManifest uploads a manifest under a tag or its digest
+func (c *registryClient) putManifest(repo, reference, mediaType string, data []byte) error {
+	req, err := http.NewRequest("PUT", c.url(repo, "manifests", reference), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(req, repositoryScope(repo, "pull", "push"))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return registryError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// nextLink returns the path of the next page from a Link header such as </v2/_catalog?last=b&n=100>; rel="next"
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 || !strings.Contains(parts[1], `rel="next"`) {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+	}
+	return ""
+}
+
+// list pages through a list endpoint and calls add with each decoded page
+func (c *registryClient) list(firstPath string, scope string, page interface{}, add func()) error {
+	next := firstPath
+	for next != "" {
+		target, err := c.resolve(next)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req, scope)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return registryError(resp)
+		}
+		err = json.NewDecoder(resp.Body).Decode(page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		add()
+		next = nextLink(resp.Header.Get("Link"))
+	}
+	return nil
+}
+
+// tags returns the tags of a repository
+func (c *registryClient) tags(repo string) ([]string, error) {
+	var page struct {
+		Tags []string `json:"tags"`
+	}
+	var tags []string
+	err := c.list("/v2/"+repo+"/tags/list?n=1000", repositoryScope(repo, "pull"), &page, func() {
+		tags = append(tags, page.Tags...)
+		page.Tags = nil
+	})
+	return tags, err
+}
+
+// catalog returns the repositories of the registry the user can see
+func (c *registryClient) catalog() ([]string, error) {
+	var page struct {
+		Repositories []string `json:"repositories"`
+	}
+	var repos []string
+	err := c.list("/v2/_catalog?n=1000", "registry:catalog:*", &page, func() {
+		repos = append(repos, page.Repositories...)
+		page.Repositories = nil
+	})
+	return repos, err
+}
+
+// referrers returns the manifests whose subject is a manifest, such as
+// signatures and SBOMs. Registries without the referrers API have none.
+func (c *registryClient) referrers(repo, digest string) ([]ociDescriptor, error) {
+	req, err := http.NewRequest("GET", c.url(repo, "referrers", digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mediaTypeOCIIndex)
+	resp, err := c.do(req, repositoryScope(repo, "pull"))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		resp.Body.Close()
+		return nil, nil
+	default:
+		return nil, registryError(resp)
+	}
+	defer resp.Body.Close()
+	var index ociManifest
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("Invalid referrers of %s@%s: %w", repo, digest, err)
+	}
+	return index.Manifests, nil
+}
+
+// sha256Digest returns the digest of data
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// digestReader returns the digest and the size of what r returns
+func digestReader(r io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// blobPath returns the path of a blob in an OCI image layout
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is a minimal in-memory registry API with bearer token
+// authentication, chunked uploads and cross-repository mounts
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	repoBlobs map[string]map[string]bool
+	manifests map[string]fakeManifest
+	uploads   map[string]*bytes.Buffer
+	nextID    int
+	// failPatches makes the next PATCH requests store half of their chunk and fail
+	failPatches int
+	patches     int
+	mounts      int
+}
+
+// fakeManifest is a manifest stored by the fake registry
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, *registryClient) {
+	fake := &fakeRegistry{
+		blobs:     map[string][]byte{},
+		repoBlobs: map[string]map[string]bool{},
+		manifests: map[string]fakeManifest{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+	return fake, newRegistryClient(server.URL, "admin", "secret", tlsConfig)
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/v2/auth" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "t0ken"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer t0ken" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/v2/auth",service="fake"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case p == "_catalog":
+		var repos []string
+		for repo := range f.repoBlobs {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": repos})
+	case strings.HasSuffix(p, "/tags/list"):
+		repo := strings.TrimSuffix(p, "/tags/list")
+		tags := []string{}
+		for key := range f.manifests {
+			if strings.HasPrefix(key, repo+":") {
+				tags = append(tags, strings.TrimPrefix(key, repo+":"))
+			}
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repo, "tags": tags})
+	case strings.Contains(p, "/blobs/uploads/"):
+		parts := strings.SplitN(p, "/blobs/uploads/", 2)
+		f.serveUpload(w, r, parts[0], parts[1])
+	case strings.Contains(p, "/blobs/"):
+		parts := strings.SplitN(p, "/blobs/", 2)
+		data, ok := f.blobs[parts[1]]
+		if !ok || !f.repoBlobs[parts[0]][parts[1]] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case strings.Contains(p, "/referrers/"):
+		parts := strings.SplitN(p, "/referrers/", 2)
+		index := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{}}
+		for key, stored := range f.manifests {
+			manifest, _ := parseManifest(stored.data, stored.mediaType)
+			if strings.HasPrefix(key, parts[0]+"@") && manifest.Subject != nil && manifest.Subject.Digest == parts[1] {
+				index.Manifests = append(index.Manifests, ociDescriptor{MediaType: manifest.MediaType, Digest: sha256Digest(stored.data), Size: int64(len(stored.data)), ArtifactType: manifest.ArtifactType})
+			}
+		}
+		w.Header().Set("Content-Type", mediaTypeOCIIndex)
+		json.NewEncoder(w).Encode(index)
+	case strings.Contains(p, "/manifests/"):
+		parts := strings.SplitN(p, "/manifests/", 2)
+		f.serveManifest(w, r, parts[0], parts[1])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	query := r.URL.Query()
+	if r.Method == "POST" {
+		if from, digest := query.Get("from"), query.Get("mount"); from != "" && f.repoBlobs[from][digest] {
+			f.addBlob(repo, digest)
+			f.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		f.nextID++
+		id = fmt.Sprint(f.nextID)
+		f.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	upload, ok := f.uploads[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Range", fmt.Sprintf("0-%d", upload.Len()-1))
+		w.WriteHeader(http.StatusNoContent)
+	case "PATCH":
+		f.patches++
+		if !strings.HasPrefix(r.Header.Get("Content-Range"), fmt.Sprintf("%d-", upload.Len())) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if f.failPatches > 0 {
+			f.failPatches--
+			upload.Write(data[:len(data)/2])
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		upload.Write(data)
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		digest := query.Get("digest")
+		if sha256Digest(upload.Bytes()) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest did not match"}]}`)
+			return
+		}
+		f.blobs[digest] = upload.Bytes()
+		f.addBlob(repo, digest)
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, reference string) {
+	key := repo + "@" + reference
+	if !digestPattern.MatchString(reference) {
+		key = repo + ":" + reference
+	}
+	if r.Method == "PUT" {
+		data, _ := ioutil.ReadAll(r.Body)
+		manifest, err := parseManifest(data, r.Header.Get("Content-Type"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var refs []ociDescriptor
+		if manifest.isIndex() {
+			refs = manifest.Manifests
+		} else {
+			refs = manifest.blobs()
+		}
+		for _, ref := range refs {
+			if _, ok := f.manifests[repo+"@"+ref.Digest]; !ok && !f.repoBlobs[repo][ref.Digest] {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"errors":[{"code":"MANIFEST_BLOB_UNKNOWN","message":"%s"}]}`, ref.Digest)
+				return
+			}
+		}
+		stored := fakeManifest{mediaType: r.Header.Get("Content-Type"), data: data}
+		f.manifests[key] = stored
+		f.manifests[repo+"@"+sha256Digest(data)] = stored
+		if f.repoBlobs[repo] == nil {
+			f.repoBlobs[repo] = map[string]bool{}
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	stored, ok := f.manifests[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", stored.mediaType)
+	w.Header().Set("Docker-Content-Digest", sha256Digest(stored.data))
+	if r.Method == "GET" {
+		w.Write(stored.data)
+	}
+}
+
+func (f *fakeRegistry) addBlob(repo, digest string) {
+	if f.repoBlobs[repo] == nil {
+		f.repoBlobs[repo] = map[string]bool{}
+	}
+	f.repoBlobs[repo][digest] = true
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := map[string]registryChallenge{
+		`Bearer realm="https://quay.example.com:8443/v2/auth",service="quay.example.com:8443"`: {scheme: "bearer", realm: "https://quay.example.com:8443/v2/auth", service: "quay.example.com:8443"},
+		`Basic realm="registry"`: {scheme: "basic", realm: "registry"},
+	}
+	for header, want := range tests {
+		if got := parseChallenge(header); *got != want {
+			t.Errorf("parseChallenge(%q) = %+v, want %+v", header, *got, want)
+		}
+	}
+}
+
+func TestParseUploadRange(t *testing.T) {
+	tests := map[string]int64{"0-1023": 1024, "bytes=0-9": 10, "0--1": 0, "": 0}
+	for header, want := range tests {
+		if got := parseUploadRange(header); got != want {
+			t.Errorf("parseUploadRange(%q) = %d, want %d", header, got, want)
+		}
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	tests := map[string]string{
+		`</v2/_catalog?last=b&n=100>; rel="next"`:       "/v2/_catalog?last=b&n=100",
+		`<https://a/v2/x/tags/list?last=1>; rel="next"`: "https://a/v2/x/tags/list?last=1",
+		"": "",
+	}
+	for header, want := range tests {
+		if got := nextLink(header); got != want {
+			t.Errorf("nextLink(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestUploadBlobResumes(t *testing.T) {
+	origChunk, origDelay := registryChunkSize, registryRetryDelay
+	defer func() { registryChunkSize, registryRetryDelay = origChunk, origDelay }()
+	registryChunkSize, registryRetryDelay = 10, 0
+
+	fake, client := newFakeRegistry(t)
+	fake.failPatches = 2
+	data := []byte(strings.Repeat("0123456789", 5) + "tail")
+	desc := ociDescriptor{Digest: sha256Digest(data), Size: int64(len(data))}
+	location, err := client.startUpload("ocp4/release", desc.Digest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.uploadBlob("ocp4/release", location, desc, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.blobs[desc.Digest], data) {
+		t.Errorf("stored blob = %q, want %q", fake.blobs[desc.Digest], data)
+	}
+	// The first chunk fails twice, storing 5 then 2 bytes, and is resumed at 5
+	// then at 7, before the 5 other chunks
+	if fake.patches != 8 {
+		t.Errorf("%d PATCH requests, want 8", fake.patches)
+	}
+	if exists, err := client.blobExists("ocp4/release", desc.Digest); err != nil || !exists {
+		t.Errorf("blobExists() = %v, %v, want true", exists, err)
+	}
+}
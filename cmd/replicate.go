@@ -0,0 +1,574 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// replicateSource is the URL of the registry replicated from, such as https://mirror1.example.com:8443
+var replicateSource string
+
+// replicateDest is the URL of the registry replicated to. It defaults to the Quay of the target.
+var replicateDest string
+
+// replicateSourceUsername is the user reading from the source registry
+var replicateSourceUsername string
+
+// replicateSourcePasswordFile is the path of a file containing the password of replicateSourceUsername
+var replicateSourcePasswordFile string
+
+// replicateSourceCACert is the CA certificate of the source registry
+var replicateSourceCACert string
+
+// replicateDestCACert is the CA certificate of the destination registry
+var replicateDestCACert string
+
+// replicateRepos are patterns of the repositories to replicate, such as ocp4/*
+var replicateRepos []string
+
+// replicateDryRun only lists the tags that would be copied
+var replicateDryRun bool
+
+// replicateInterval is how often the replication timer set up by install runs
+var replicateInterval time.Duration
+
+// installerBinaryName is the copy of the installer in the state directory,
+// mounted into the runner at /runner/state, which the playbooks install on the
+// target to run the replication timer
+const installerBinaryName = "mirror-registry"
+
+// replicateCmd represents the replicate command
+var replicateCmd = &cobra.Command{
+	Use:   "replicate",
+	Short: "Copy the repositories of another registry that are missing or differ to Quay.",
+	Args:  cobra.NoArgs,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		replicate(cobraCmd)
+	},
+}
+
+func init() {
+
+	// Add replicate command
+	rootCmd.AddCommand(replicateCmd)
+
+	replicateCmd.Flags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	replicateCmd.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	replicateCmd.Flags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	replicateCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	replicateCmd.Flags().StringVarP(&quayHostname, "quayHostname", "", "", "The SERVER_HOSTNAME of Quay. This defaults to the value used by the last install, or <targetHostname>:8443")
+	replicateCmd.Flags().StringVarP(&replicateSource, "source", "", "", "The URL of the registry to replicate from, such as https://mirror1.example.com:8443.")
+	replicateCmd.Flags().StringVarP(&replicateSourceUsername, "source-username", "", "", "The user reading from the source registry.")
+	replicateCmd.Flags().StringVarP(&replicateSourcePasswordFile, "source-password-file", "", "", "The path of a file containing the password of --source-username. Can also be set with $MIRROR_REGISTRY_SOURCE_PASSWORD.")
+	replicateCmd.Flags().StringVarP(&replicateSourceCACert, "source-ca-cert", "", "", "The path to the CA certificate that signed the certificate of the source registry.")
+	replicateCmd.Flags().StringVarP(&replicateDest, "dest", "", "", "The URL of the registry to replicate to. This defaults to the Quay of the target.")
+	replicateCmd.Flags().StringVarP(&registryUsername, "dest-username", "", "", "The user pushing to the destination registry. This defaults to the init user stored by install.")
+	replicateCmd.Flags().StringVarP(&registryPasswordFile, "dest-password-file", "", "", "The path of a file containing the password of --dest-username. Can also be set with $MIRROR_REGISTRY_PASSWORD.")
+	replicateCmd.Flags().StringVarP(&replicateDestCACert, "dest-ca-cert", "", "", "The path to the CA certificate that signed the certificate of --dest. The certificate of the Quay of the target is trusted by default.")
+	replicateCmd.Flags().StringArrayVarP(&replicateRepos, "repo", "", nil, "Only replicate the repositories matching this pattern, such as ocp4/* or ocp4/openshift/release. Can be repeated. All repositories the source user can see are replicated by default.")
+	replicateCmd.Flags().BoolVarP(&replicateDryRun, "dry-run", "", false, "List the tags that are missing or differ without copying anything.")
+	replicateCmd.Flags().IntVarP(&registryParallel, "parallel", "", 4, "The number of blobs copied at the same time.")
+	replicateCmd.MarkFlagRequired("source")
+
+}
+
+// matchRepos returns the repositories matching one of the patterns, or all
+// repositories when there is no pattern
+func matchRepos(repos, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return repos, nil
+	}
+	var matched []string
+	for _, repo := range repos {
+		for _, pattern := range patterns {
+			ok, err := path.Match(pattern, repo)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid --repo %q: %w", pattern, err)
+			}
+			if ok {
+				matched = append(matched, repo)
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// tagDiff is a tag of the source with its manifest digest in both registries
+type tagDiff struct {
+	repo, tag    string
+	source, dest string
+}
+
+// action describes what replicating the tag does
+func (d tagDiff) action() string {
+	switch {
+	case d.dest == "":
+		return "copy"
+	case d.dest != d.source:
+		return "update"
+	}
+	return "up to date"
+}
+
+// shortDigest returns the first 12 characters of the hash of a digest
+func shortDigest(digest string) string {
+	hash := strings.TrimPrefix(digest, "sha256:")
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	if hash == "" {
+		return "-"
+	}
+	return hash
+}
+
+// replicator copies manifests and blobs from one registry to another. Only
+// what the destination is missing is copied, and nothing is ever deleted.
+type replicator struct {
+	source   *registryClient
+	dest     *registryClient
+	parallel int
+
+	mu sync.Mutex
+	// copied are the manifests, as repo@digest, known to be in the destination
+	copied map[string]bool
+	// blobRepos is a repository of the destination holding each blob, to mount it from
+	blobRepos map[string]string
+	manifests int
+	uploaded  int
+	mounted   int
+	existing  int
+	bytes     int64
+}
+
+func newReplicator(source, dest *registryClient, parallel int) *replicator {
+	return &replicator{source: source, dest: dest, parallel: parallel, copied: map[string]bool{}, blobRepos: map[string]string{}}
+}
+
+// diff compares the digests of the tags of a repository in both registries
+func (r *replicator) diff(repo string) ([]tagDiff, error) {
+	tags, err := r.source.tags(repo)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+	var diffs []tagDiff
+	for _, tag := range tags {
+		source, err := r.source.headManifest(repo, tag)
+		if err != nil {
+			return nil, err
+		}
+		if source == "" {
+			continue
+		}
+		dest, err := r.dest.headManifest(repo, tag)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, tagDiff{repo: repo, tag: tag, source: source, dest: dest})
+	}
+	return diffs, nil
+}
+
+// copyTag copies the manifest of a tag when it is missing or differs, and the
+// referrers of the manifest that are missing
+func (r *replicator) copyTag(d tagDiff) error {
+	if d.source != d.dest {
+		log.Infof("Copying %s:%s (%s)", d.repo, d.tag, shortDigest(d.source))
+		if err := r.copyMissingManifest(d.repo, d.source); err != nil {
+			return err
+		}
+		return r.putManifest(d.repo, d.source, d.tag)
+	}
+	r.markCopied(d.repo, d.source)
+	return r.copyReferrers(d.repo, d.source)
+}
+
+// markCopied records that the destination has a manifest
+func (r *replicator) markCopied(repo, digest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.copied[repo+"@"+digest] = true
+}
+
+// isCopied reports whether the destination is known to have a manifest
+func (r *replicator) isCopied(repo, digest string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.copied[repo+"@"+digest]
+}
+
+// copyManifest copies a manifest by digest with its blobs, or an index with
+// the manifests it lists, followed by their referrers
+func (r *replicator) copyManifest(repo, digest string) error {
+	if r.isCopied(repo, digest) {
+		return nil
+	}
+	data, mediaType, _, err := r.source.getManifest(repo, digest)
+	if err != nil {
+		return err
+	}
+	manifest, err := parseManifest(data, mediaType)
+	if err != nil {
+		return err
+	}
+	if manifest.isIndex() {
+		for _, child := range manifest.Manifests {
+			if err := r.copyMissingManifest(repo, child.Digest); err != nil {
+				return fmt.Errorf("%s: %w", child.Platform, err)
+			}
+		}
+	} else if err := r.copyBlobs(repo, manifest.blobs()); err != nil {
+		return err
+	}
+	if err := r.dest.putManifest(repo, digest, manifest.MediaType, data); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.manifests++
+	r.mu.Unlock()
+	r.markCopied(repo, digest)
+	return r.copyReferrers(repo, digest)
+}
+
+// copyMissingManifest copies a manifest by digest unless the destination has it
+func (r *replicator) copyMissingManifest(repo, digest string) error {
+	if r.isCopied(repo, digest) {
+		return nil
+	}
+	existing, err := r.dest.headManifest(repo, digest)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		r.markCopied(repo, digest)
+		return r.copyReferrers(repo, digest)
+	}
+	return r.copyManifest(repo, digest)
+}
+
+// copyReferrers copies the signatures, SBOMs and other manifests referring to a manifest
+func (r *replicator) copyReferrers(repo, digest string) error {
+	referrers, err := r.source.referrers(repo, digest)
+	if err != nil {
+		return err
+	}
+	for _, referrer := range referrers {
+		if err := r.copyMissingManifest(repo, referrer.Digest); err != nil {
+			return fmt.Errorf("referrer %s: %w", referrer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// putManifest tags a manifest the destination has
+func (r *replicator) putManifest(repo, digest, tag string) error {
+	data, mediaType, _, err := r.source.getManifest(repo, digest)
+	if err != nil {
+		return err
+	}
+	manifest, err := parseManifest(data, mediaType)
+	if err != nil {
+		return err
+	}
+	return r.dest.putManifest(repo, tag, manifest.MediaType, data)
+}
+
+// copyBlobs copies blobs, up to r.parallel at a time, and returns the first error
+func (r *replicator) copyBlobs(repo string, blobs []ociDescriptor) error {
+	seen := map[string]bool{}
+	sem := make(chan struct{}, r.parallel)
+	errs := make(chan error, len(blobs))
+	var wg sync.WaitGroup
+	for _, blob := range blobs {
+		if seen[blob.Digest] {
+			continue
+		}
+		seen[blob.Digest] = true
+		wg.Add(1)
+		go func(blob ociDescriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs <- r.copyBlob(repo, blob)
+		}(blob)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlob skips a blob the repository of the destination has, mounts it from
+// another repository of the destination, or streams it from the source
+func (r *replicator) copyBlob(repo string, blob ociDescriptor) error {
+	exists, err := r.dest.blobExists(repo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		r.count(&r.existing, repo, blob.Digest, 0)
+		return nil
+	}
+
+	var location string
+	r.mu.Lock()
+	from := r.blobRepos[blob.Digest]
+	r.mu.Unlock()
+	if from != "" && from != repo {
+		location, err = r.dest.startUpload(repo, blob.Digest, from)
+		if err == nil && location == "" {
+			r.count(&r.mounted, repo, blob.Digest, 0)
+			return nil
+		}
+		if err != nil {
+			log.Debugf("Could not mount blob %s from %s: %s", blob.Digest, from, err.Error())
+		}
+	}
+	if location == "" {
+		if location, err = r.dest.startUpload(repo, blob.Digest, ""); err != nil {
+			return err
+		}
+	}
+
+	body, err := r.source.getBlob(repo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	log.Debugf("Copying blob %s (%s)", blob.Digest, formatBytes(blob.Size))
+	if err := r.dest.uploadBlob(repo, location, blob, io.LimitReader(body, blob.Size)); err != nil {
+		return err
+	}
+	r.count(&r.uploaded, repo, blob.Digest, blob.Size)
+	return nil
+}
+
+// count adds a blob to one of the counters of the summary and records where it is
+func (r *replicator) count(counter *int, repo, digest string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*counter++
+	r.bytes += size
+	r.blobRepos[digest] = repo
+}
+
+// replicateSourcePassword reads the password of --source-username from a file or the environment
+func replicateSourcePassword() (string, error) {
+	password := os.Getenv("MIRROR_REGISTRY_SOURCE_PASSWORD")
+	if replicateSourcePasswordFile != "" {
+		data, err := ioutil.ReadFile(replicateSourcePasswordFile)
+		if err != nil {
+			return "", err
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	if replicateSourceUsername != "" && password == "" {
+		return "", errors.New("The source username requires a password file or $MIRROR_REGISTRY_SOURCE_PASSWORD")
+	}
+	return password, nil
+}
+
+// validateRegistryURL checks that a registry URL is http(s)://host[:port]
+func validateRegistryURL(registryURL string) error {
+	u, err := url.Parse(registryURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return fmt.Errorf("Invalid registry URL %q. Use https://<hostname>[:<port>]", registryURL)
+	}
+	return nil
+}
+
+// replicateRunnerFlags checks the replication settings of install and returns
+// the flag mounting them into the runner and the argument passing them to the
+// playbook. The installer copies itself into the state directory so that the
+// playbook installs the same binary on the target for the timer to run.
+func replicateRunnerFlags() (string, string, error) {
+	if authType != authDatabase {
+		return "", "", errors.New("--replicate-from pushes as the init user, which is only created with --auth database")
+	}
+	if err := validateRegistryURL(replicateSource); err != nil {
+		return "", "", err
+	}
+	if replicateInterval < time.Minute {
+		return "", "", errors.New("--replicate-interval must be at least 1m")
+	}
+	if _, err := matchRepos(nil, replicateRepos); err != nil {
+		return "", "", err
+	}
+	password, err := replicateSourcePassword()
+	if err != nil {
+		return "", "", err
+	}
+	var caCert string
+	if replicateSourceCACert != "" {
+		if _, err := registryTLSConfig(replicateSourceCACert); err != nil {
+			return "", "", err
+		}
+		data, err := ioutil.ReadFile(replicateSourceCACert)
+		if err != nil {
+			return "", "", err
+		}
+		caCert = string(data)
+	}
+	if err := copyInstallerBinary(); err != nil {
+		return "", "", fmt.Errorf("Could not copy the installer for the replication timer: %w", err)
+	}
+	return runnerVarsFlags("replicate.json", map[string]interface{}{
+		"replicate_source":   strings.TrimSuffix(replicateSource, "/"),
+		"replicate_interval": int(replicateInterval.Seconds()),
+		"replicate_username": replicateSourceUsername,
+		"replicate_password": password,
+		"replicate_ca_cert":  caCert,
+		"replicate_repos":    replicateRepos,
+	})
+}
+
+// checkReplicateSource lists the repositories of the source from the installer
+// host. The timer runs on the target, so a failure is only reported.
+func checkReplicateSource() {
+	password, _ := replicateSourcePassword()
+	tlsConfig, err := registryTLSConfig(replicateSourceCACert)
+	if err == nil {
+		_, err = newRegistryClient(replicateSource, replicateSourceUsername, password, tlsConfig).catalog()
+	}
+	if err != nil {
+		log.Warnf("Could not list the repositories of %s from this host: %s. Check that the target can reach it", replicateSource, err.Error())
+	}
+}
+
+// copyInstallerBinary copies the running installer into the state directory,
+// from where the playbooks install it on the target. The copy is removed when
+// the installer exits.
+func copyInstallerBinary() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(executable)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(targetStateDir(), 0700); err != nil {
+		return err
+	}
+	file := path.Join(targetStateDir(), installerBinaryName)
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	onExit(func() {
+		os.Remove(file)
+	})
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// replicateClients returns the clients of the source and destination registries
+func replicateClients(cobraCmd *cobra.Command) (*registryClient, *registryClient, error) {
+	sourcePassword, err := replicateSourcePassword()
+	if err != nil {
+		return nil, nil, err
+	}
+	sourceTLS, err := registryTLSConfig(replicateSourceCACert)
+	if err != nil {
+		return nil, nil, err
+	}
+	source := newRegistryClient(replicateSource, replicateSourceUsername, sourcePassword, sourceTLS)
+
+	if replicateDest == "" {
+		registryTarget(cobraCmd)
+		dest, err := quayRegistryClient()
+		return source, dest, err
+	}
+	destPassword, err := registryPassword()
+	if err != nil {
+		return nil, nil, err
+	}
+	destTLS, err := registryTLSConfig(replicateDestCACert)
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, newRegistryClient(replicateDest, registryUsername, destPassword, destTLS), nil
+}
+
+func replicate(cobraCmd *cobra.Command) {
+
+	audit := auditCommand("replicate")
+	if registryParallel < 1 {
+		check(errors.New("--parallel must be at least 1"))
+	}
+	for _, u := range []string{replicateSource, replicateDest} {
+		if u != "" {
+			check(validateRegistryURL(u))
+		}
+	}
+	_, err := matchRepos(nil, replicateRepos)
+	check(err)
+	source, dest, err := replicateClients(cobraCmd)
+	check(err)
+
+	all, err := source.catalog()
+	check(err)
+	repos, err := matchRepos(all, replicateRepos)
+	check(err)
+	sort.Strings(repos)
+	log.Infof("Comparing %d repositories of %s with %s", len(repos), source.baseURL, dest.baseURL)
+
+	r := newReplicator(source, dest, registryParallel)
+	var diffs []tagDiff
+	for _, repo := range repos {
+		repoDiffs, err := r.diff(repo)
+		if err != nil {
+			check(fmt.Errorf("Could not compare %s: %w", repo, err))
+		}
+		diffs = append(diffs, repoDiffs...)
+	}
+
+	counts := map[string]int{}
+	for _, d := range diffs {
+		counts[d.action()]++
+	}
+	if replicateDryRun {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REPOSITORY\tTAG\tSOURCE\tDESTINATION\tACTION")
+		for _, d := range diffs {
+			if d.action() != "up to date" {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.repo, d.tag, shortDigest(d.source), shortDigest(d.dest), d.action())
+			}
+		}
+		w.Flush()
+		log.Infof("%d tags to copy, %d to update, %d up to date", counts["copy"], counts["update"], counts["up to date"])
+		audit.Status = statusSucceeded
+		return
+	}
+
+	for _, d := range diffs {
+		if err := r.copyTag(d); err != nil {
+			check(fmt.Errorf("Could not replicate %s:%s: %w. Run the same command again to continue, the blobs already copied are not copied again", d.repo, d.tag, err))
+		}
+	}
+	log.Infof("Replicated %d tags (%d copied, %d updated, %d up to date): %d manifests and %d blobs copied (%s), %d blobs mounted, %d already present",
+		len(diffs), counts["copy"], counts["update"], counts["up to date"], r.manifests, r.uploaded, formatBytes(r.bytes), r.mounted, r.existing)
+	audit.Status = statusSucceeded
+}
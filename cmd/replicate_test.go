@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestMatchRepos(t *testing.T) {
+	repos := []string{"ocp4/openshift/release", "ocp4/ubi9", "team/app"}
+	tests := []struct {
+		patterns []string
+		want     []string
+	}{
+		{nil, repos},
+		{[]string{"ocp4/*"}, []string{"ocp4/ubi9"}},
+		{[]string{"ocp4/*/*", "team/app"}, []string{"ocp4/openshift/release", "team/app"}},
+		{[]string{"other/*"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := matchRepos(repos, tt.patterns)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matchRepos(%q) = %q, %v, want %q", tt.patterns, got, err, tt.want)
+		}
+	}
+	if _, err := matchRepos(repos, []string{"ocp4/["}); err == nil {
+		t.Error("matchRepos() accepted an invalid pattern")
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	files, root := testImageFiles(t)
+	dir := t.TempDir()
+	writeTestDir(t, path.Join(dir, "layout"), files)
+	layout, err := openImageSource("oci:" + path.Join(dir, "layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layout.Close()
+
+	// The source has the image in two repositories, and a signature of it in the first one
+	sourceFake, source := newFakeRegistry(t)
+	for _, repo := range []string{"ocp4/image", "ocp4/copy"} {
+		pusher := &imagePusher{client: source, source: layout, repo: repo, parallel: 2, locations: &blobLocations{repo: map[string]string{}}}
+		if err := pusher.pushManifest(layout.root, "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signature := []byte("signature")
+	sourceFake.blobs[sha256Digest(signature)] = signature
+	sourceFake.addBlob("ocp4/image", sha256Digest(signature))
+	empty := []byte("{}")
+	sourceFake.blobs[sha256Digest(empty)] = empty
+	sourceFake.addBlob("ocp4/image", sha256Digest(empty))
+	referrer, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		ArtifactType:  "application/vnd.dev.cosign.simplesigning.v1+json",
+		Config:        &ociDescriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: sha256Digest(empty), Size: 2},
+		Layers:        []ociDescriptor{{MediaType: "application/octet-stream", Digest: sha256Digest(signature), Size: int64(len(signature))}},
+		Subject:       &ociDescriptor{MediaType: mediaTypeOCIIndex, Digest: root.Digest, Size: root.Size},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.putManifest("ocp4/image", sha256Digest(referrer), mediaTypeOCIManifest, referrer); err != nil {
+		t.Fatal(err)
+	}
+
+	destFake, dest := newFakeRegistry(t)
+	r := newReplicator(source, dest, 2)
+	var diffs []tagDiff
+	for _, repo := range []string{"ocp4/copy", "ocp4/image"} {
+		repoDiffs, err := r.diff(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffs = append(diffs, repoDiffs...)
+	}
+	want := []tagDiff{{"ocp4/copy", "v1", root.Digest, ""}, {"ocp4/image", "v1", root.Digest, ""}}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Fatalf("diff() = %+v, want %+v", diffs, want)
+	}
+	for _, d := range diffs {
+		if err := r.copyTag(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 platform manifests and the index in each repository, and the signature
+	if r.manifests != 7 || r.uploaded != 5+2 || r.mounted != 5 {
+		t.Errorf("%d manifests, %d blobs uploaded, %d mounted, want 7, 7, 5", r.manifests, r.uploaded, r.mounted)
+	}
+	if digest, err := dest.headManifest("ocp4/image", sha256Digest(referrer)); err != nil || digest == "" {
+		t.Errorf("the signature was not copied: %v", err)
+	}
+	if destFake.mounts != 5 {
+		t.Errorf("%d mounts, want 5", destFake.mounts)
+	}
+
+	// Nothing is copied again
+	again := newReplicator(source, dest, 2)
+	diffs, err = again.diff("ocp4/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].action() != "up to date" {
+		t.Fatalf("diff() = %+v, want up to date", diffs)
+	}
+	if err := again.copyTag(diffs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if again.manifests != 0 || again.uploaded != 0 {
+		t.Errorf("%d manifests and %d blobs copied again", again.manifests, again.uploaded)
+	}
+}
+
+func TestValidateRegistryURL(t *testing.T) {
+	tests := map[string]bool{
+		"https://mirror1.example.com:8443":  true,
+		"https://mirror1.example.com:8443/": true,
+		"http://localhost:5000":             true,
+		"mirror1.example.com:8443":          false,
+		"https://mirror1.example.com/v2":    false,
+		"ftp://mirror1.example.com":         false,
+	}
+	for u, valid := range tests {
+		if err := validateRegistryURL(u); (err == nil) != valid {
+			t.Errorf("validateRegistryURL(%q) = %v, want valid %v", u, err, valid)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// mirrorUpstream is the repository mirrored from, such as quay.io/openshift-release-dev/ocp-release
+var mirrorUpstream string
+
+// mirrorTags is the comma-separated list of tag globs to mirror
+var mirrorTags string
+
+// mirrorInterval is the time between two syncs of a mirrored repository
+var mirrorInterval time.Duration
+
+// mirrorRobot is the robot account of the organization the mirror worker pushes with
+var mirrorRobot string
+
+// mirrorUsername is the user name for the upstream registry
+var mirrorUsername string
+
+// mirrorPasswordFile is the path of a file containing the password of mirrorUsername
+var mirrorPasswordFile string
+
+// mirrorVerifyTLS checks the certificate of the upstream registry
+var mirrorVerifyTLS bool
+
+// mirrorVisibility is the visibility of the repositories created by repo-mirror add
+var mirrorVisibility string
+
+// mirrorNamespace limits repo-mirror list to one organization
+var mirrorNamespace string
+
+// mirrorWait makes repo-mirror sync wait for the sync to finish
+var mirrorWait bool
+
+// mirrorTimeout is how long repo-mirror sync --wait waits
+var mirrorTimeout time.Duration
+
+// mirrorDeleteRepository makes repo-mirror remove delete the repository and its images
+var mirrorDeleteRepository bool
+
+// quayDateFormat is the date format of the Quay mirror API
+const quayDateFormat = "2006-01-02T15:04:05Z"
+
+// repoMirrorCmd represents the repo-mirror command
+var repoMirrorCmd = &cobra.Command{
+	Use:   "repo-mirror",
+	Short: "Manage repositories that Quay keeps in sync with an upstream registry.",
+}
+
+var repoMirrorAddCmd = &cobra.Command{
+	Use:   "add ORG/REPO",
+	Short: "Create or update a mirrored repository.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		repoMirrorAdd(cobraCmd, args[0])
+	},
+}
+
+var repoMirrorListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the mirrored repositories and the state of their last sync.",
+	Args:  cobra.NoArgs,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		repoMirrorList(cobraCmd)
+	},
+}
+
+var repoMirrorSyncCmd = &cobra.Command{
+	Use:   "sync ORG/REPO",
+	Short: "Sync a mirrored repository now.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		repoMirrorSync(cobraCmd, args[0])
+	},
+}
+
+var repoMirrorRemoveCmd = &cobra.Command{
+	Use:   "remove ORG/REPO",
+	Short: "Stop mirroring a repository and make it a normal repository again.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		repoMirrorRemove(cobraCmd, args[0])
+	},
+}
+
+func init() {
+
+	// Add repo-mirror command
+	rootCmd.AddCommand(repoMirrorCmd)
+	repoMirrorCmd.AddCommand(repoMirrorAddCmd)
+	repoMirrorCmd.AddCommand(repoMirrorListCmd)
+	repoMirrorCmd.AddCommand(repoMirrorSyncCmd)
+	repoMirrorCmd.AddCommand(repoMirrorRemoveCmd)
+
+	repoMirrorCmd.PersistentFlags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	repoMirrorCmd.PersistentFlags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	repoMirrorCmd.PersistentFlags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	repoMirrorCmd.PersistentFlags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	repoMirrorCmd.PersistentFlags().StringVarP(&quayHostname, "quayHostname", "", "", "The SERVER_HOSTNAME of Quay. This defaults to the value used by the last install, or <targetHostname>:8443")
+	repoMirrorCmd.PersistentFlags().StringVarP(&apiToken, "token", "", "", "The OAuth access token used to call the Quay API. Can also be set with $MIRROR_REGISTRY_TOKEN. This defaults to the token of the init user stored by install.")
+
+	repoMirrorAddCmd.Flags().StringVarP(&mirrorUpstream, "upstream", "", "", "The repository to mirror, without a tag, such as quay.io/openshift-release-dev/ocp-release.")
+	repoMirrorAddCmd.Flags().StringVarP(&mirrorTags, "tags", "", "", "The comma-separated tags to mirror. Globs such as 4.14.* are supported.")
+	repoMirrorAddCmd.Flags().DurationVarP(&mirrorInterval, "interval", "", 24*time.Hour, "The time between two syncs, such as 30m or 24h.")
+	repoMirrorAddCmd.Flags().StringVarP(&mirrorRobot, "robot", "", "mirror", "The robot account of the organization the mirror worker pushes with. It is created and granted write access when missing.")
+	repoMirrorAddCmd.Flags().StringVarP(&mirrorUsername, "username", "", "", "The user name for the upstream registry.")
+	repoMirrorAddCmd.Flags().StringVarP(&mirrorPasswordFile, "password-file", "", "", "The path of a file containing the password for the upstream registry. Can also be set with $MIRROR_REGISTRY_UPSTREAM_PASSWORD.")
+	repoMirrorAddCmd.Flags().BoolVarP(&mirrorVerifyTLS, "verify-tls", "", true, "Check the certificate of the upstream registry.")
+	repoMirrorAddCmd.Flags().StringVarP(&mirrorVisibility, "visibility", "", "private", "The visibility of the repository when it is created, private or public.")
+	repoMirrorAddCmd.Flags().StringVarP(&httpProxy, "http-proxy", "", "", "The proxy the mirror worker uses for plain HTTP requests to the upstream registry.")
+	repoMirrorAddCmd.Flags().StringVarP(&httpsProxy, "https-proxy", "", "", "The proxy the mirror worker uses for HTTPS requests to the upstream registry.")
+	repoMirrorAddCmd.Flags().StringVarP(&noProxy, "no-proxy", "", "", "The comma-separated hosts the mirror worker reaches without the proxy.")
+	repoMirrorAddCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+	repoMirrorAddCmd.MarkFlagRequired("upstream")
+	repoMirrorAddCmd.MarkFlagRequired("tags")
+
+	repoMirrorListCmd.Flags().StringVarP(&mirrorNamespace, "namespace", "", "", "Only list the repositories of this organization. This defaults to every organization of the user of the token.")
+
+	repoMirrorSyncCmd.Flags().BoolVarP(&mirrorWait, "wait", "", false, "Wait for the sync to finish and fail if it does.")
+	repoMirrorSyncCmd.Flags().DurationVarP(&mirrorTimeout, "timeout", "", time.Hour, "How long --wait waits for the sync to finish.")
+
+	repoMirrorRemoveCmd.Flags().BoolVarP(&mirrorDeleteRepository, "delete-repository", "", false, "Delete the repository and its images instead of keeping them as a normal repository.")
+	repoMirrorRemoveCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+
+}
+
+// repoMirrorRule selects the upstream tags to mirror
+type repoMirrorRule struct {
+	RuleKind  string   `json:"rule_kind"`
+	RuleValue []string `json:"rule_value"`
+}
+
+// repoMirrorConfig is the mirror configuration of a repository as returned by Quay
+type repoMirrorConfig struct {
+	IsEnabled                bool                   `json:"is_enabled"`
+	ExternalReference        string                 `json:"external_reference"`
+	ExternalRegistryUsername string                 `json:"external_registry_username"`
+	ExternalRegistryConfig   map[string]interface{} `json:"external_registry_config"`
+	SyncInterval             int                    `json:"sync_interval"`
+	SyncStartDate            string                 `json:"sync_start_date"`
+	SyncExpirationDate       string                 `json:"sync_expiration_date"`
+	SyncRetriesRemaining     int                    `json:"sync_retries_remaining"`
+	SyncStatus               string                 `json:"sync_status"`
+	RootRule                 repoMirrorRule         `json:"root_rule"`
+	Robot                    string                 `json:"robot_username"`
+}
+
+// repoMirrorSettings is a mirror configuration read from the flags
+type repoMirrorSettings struct {
+	Upstream  string
+	Tags      []string
+	Interval  time.Duration
+	Robot     string
+	Username  string
+	Password  string
+	VerifyTLS bool
+	Proxy     *proxySettings
+}
+
+// splitRepository splits ORG/REPO into the organization and the repository, which may be nested
+func splitRepository(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(ref, ":@") {
+		return "", "", fmt.Errorf("Invalid repository %q. Use ORG/REPO without a tag", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// repoMirrorSettingsFromFlags reads the settings of repo-mirror add for a repository of org
+func repoMirrorSettingsFromFlags(org string) (*repoMirrorSettings, error) {
+	settings := &repoMirrorSettings{
+		Upstream:  mirrorUpstream,
+		Interval:  mirrorInterval,
+		Username:  mirrorUsername,
+		VerifyTLS: mirrorVerifyTLS,
+	}
+	if strings.Contains(settings.Upstream, "://") {
+		return nil, fmt.Errorf("Invalid upstream %q. Use registry/repository without a scheme, such as quay.io/org/repo", mirrorUpstream)
+	}
+	host := strings.SplitN(settings.Upstream, "/", 2)[0]
+	last := settings.Upstream[strings.LastIndex(settings.Upstream, "/")+1:]
+	if !strings.Contains(settings.Upstream, "/") || !strings.ContainsAny(host, ".:") || strings.ContainsAny(last, ":@") {
+		return nil, fmt.Errorf("Invalid upstream %q. Use registry/repository without a tag, such as quay.io/org/repo", mirrorUpstream)
+	}
+	for _, tag := range strings.Split(mirrorTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			settings.Tags = append(settings.Tags, tag)
+		}
+	}
+	if len(settings.Tags) == 0 {
+		return nil, errors.New("--tags needs at least one tag or glob, such as latest or v1.*")
+	}
+	if settings.Interval < time.Minute {
+		return nil, errors.New("--interval must be at least 1m")
+	}
+
+	settings.Robot = mirrorRobot
+	if i := strings.Index(mirrorRobot, "+"); i >= 0 {
+		if mirrorRobot[:i] != org {
+			return nil, fmt.Errorf("The robot account %s must belong to the organization %s", mirrorRobot, org)
+		}
+		settings.Robot = mirrorRobot[i+1:]
+	}
+	if settings.Robot == "" {
+		return nil, errors.New("--robot must name a robot account")
+	}
+
+	if mirrorPasswordFile != "" {
+		data, err := ioutil.ReadFile(mirrorPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		settings.Password = strings.TrimRight(string(data), "\r\n")
+	} else {
+		settings.Password = os.Getenv("MIRROR_REGISTRY_UPSTREAM_PASSWORD")
+	}
+	if settings.Password != "" && settings.Username == "" {
+		return nil, errors.New("--username is required with an upstream password")
+	}
+
+	if proxyRequested() {
+		proxy, err := proxySettingsFromFlags("")
+		if err != nil {
+			return nil, err
+		}
+		settings.Proxy = proxy
+	}
+	return settings, nil
+}
+
+// body returns the request body of the Quay mirror API for a repository of org
+func (s *repoMirrorSettings) body(org string, start time.Time) map[string]interface{} {
+	registryConfig := map[string]interface{}{
+		"verify_tls":      s.VerifyTLS,
+		"unsigned_images": false,
+	}
+	if s.Proxy != nil {
+		registryConfig["proxy"] = map[string]string{
+			"http_proxy":  s.Proxy.HTTPProxy,
+			"https_proxy": s.Proxy.HTTPSProxy,
+			"no_proxy":    strings.Join(s.Proxy.NoProxy, ","),
+		}
+	}
+	body := map[string]interface{}{
+		"is_enabled":                 true,
+		"external_reference":         s.Upstream,
+		"external_registry_username": nil,
+		"external_registry_password": nil,
+		"external_registry_config":   registryConfig,
+		"sync_interval":              int(s.Interval.Seconds()),
+		"sync_start_date":            start.UTC().Format(quayDateFormat),
+		"root_rule":                  repoMirrorRule{RuleKind: "tag_glob_csv", RuleValue: s.Tags},
+		"robot_username":             org + "+" + s.Robot,
+	}
+	if s.Username != "" {
+		body["external_registry_username"] = s.Username
+		body["external_registry_password"] = s.Password
+	}
+	return body
+}
+
+// repoMirrorClient returns a Quay API client for the target of the last install
+func repoMirrorClient(cobraCmd *cobra.Command) *quayClient {
+	err := loadSSHKeys()
+	check(err)
+
+	previous, err := loadInstallState()
+	check(err)
+	if !cobraCmd.Flags().Changed("quayRoot") && previous.QuayRoot != "" {
+		quayRoot = previous.QuayRoot
+	}
+	if quayHostname == "" {
+		quayHostname = previous.QuayHostname
+	}
+	if quayHostname == "" {
+		quayHostname = targetHostname + ":8443"
+	}
+	apiToken = resolveAPIToken()
+	if apiToken == "" {
+		check(errors.New("An API token is required. Supply it with --token or $MIRROR_REGISTRY_TOKEN, or install with this installer to store the token of the init user"))
+	}
+	return newQuayClient(quayHostname, apiToken)
+}
+
+func repoMirrorAdd(cobraCmd *cobra.Command, ref string) {
+
+	org, name, err := splitRepository(ref)
+	check(err)
+	settings, err := repoMirrorSettingsFromFlags(org)
+	check(err)
+	if !oneOf(mirrorVisibility, "private", "public") {
+		check(errors.New("--visibility must be private or public"))
+	}
+	client := repoMirrorClient(cobraCmd)
+
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("repo-mirror")
+	check(err)
+
+	state, err := beginOperation("repo-mirror", false)
+	check(err)
+
+	state.startStep("add-mirror")
+	err = addRepoMirror(client, org, name, settings)
+	if err == nil {
+		state.completeStep("add-mirror")
+		log.Infof("%s/%s mirrors %s every %s. Run 'mirror-registry repo-mirror sync %s' to sync it now", org, name, settings.Upstream, settings.Interval, ref)
+	}
+	finishOperation(ctx, state, err)
+}
+
+// addRepoMirror creates the repository and the robot account when they are
+// missing, puts the repository in the mirror state and configures its mirror.
+// Running it again updates the configuration.
+func addRepoMirror(client *quayClient, org, name string, settings *repoMirrorSettings) error {
+	if err := client.do("GET", apiPath("organization", org), nil, nil); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("The organization %s does not exist. Create it with 'mirror-registry apply' or in the Quay UI", org)
+		}
+		return err
+	}
+	if _, err := ensureRobot(client, org, settings.Robot, "Pushes the images of mirrored repositories"); err != nil {
+		return err
+	}
+
+	var current struct {
+		IsPublic bool   `json:"is_public"`
+		State    string `json:"state"`
+	}
+	visibility := mirrorVisibility
+	err := client.do("GET", repositoryPath(org, name), nil, &current)
+	if err == nil && current.IsPublic {
+		visibility = "public"
+	} else if err == nil {
+		visibility = "private"
+	} else if !isNotFound(err) {
+		return err
+	}
+	repo := bootstrapRepository{
+		Name:        name,
+		Visibility:  visibility,
+		Description: "Mirror of " + settings.Upstream,
+		Permissions: []bootstrapPermission{{Robot: settings.Robot, Role: "write"}},
+	}
+	if err := applyRepository(client, org, repo); err != nil {
+		return err
+	}
+	if current.State != "MIRROR" {
+		if err := client.do("PUT", repositoryPath(org, name, "changestate"), map[string]string{"state": "MIRROR"}, nil); err != nil {
+			return err
+		}
+		log.Infof("Switched %s/%s to the mirror state", org, name)
+	}
+
+	body := settings.body(org, time.Now())
+	err = client.do("GET", repositoryPath(org, name, "mirror"), nil, nil)
+	switch {
+	case err == nil:
+		err = client.do("PUT", repositoryPath(org, name, "mirror"), body, nil)
+	case isNotFound(err):
+		err = client.do("POST", repositoryPath(org, name, "mirror"), body, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not configure the mirror of %s/%s: %w", org, name, err)
+	}
+	log.Infof("Configured %s/%s to mirror tags %s of %s", org, name, strings.Join(settings.Tags, ","), settings.Upstream)
+	return nil
+}
+
+// mirroredRepository is a repository with its mirror configuration
+type mirroredRepository struct {
+	Name   string
+	Mirror repoMirrorConfig
+}
+
+// listRepoMirrors returns the mirrored repositories of the organizations
+func listRepoMirrors(client *quayClient, orgs []string) ([]mirroredRepository, error) {
+	var mirrors []mirroredRepository
+	for _, org := range orgs {
+		nextPage := ""
+		for {
+			var page struct {
+				Repositories []struct {
+					Namespace string `json:"namespace"`
+					Name      string `json:"name"`
+					State     string `json:"state"`
+				} `json:"repositories"`
+				NextPage string `json:"next_page"`
+			}
+			query := url.Values{"namespace": {org}}
+			if nextPage != "" {
+				query.Set("next_page", nextPage)
+			}
+			if err := client.do("GET", apiPath("repository")+"?"+query.Encode(), nil, &page); err != nil {
+				return nil, err
+			}
+			for _, repo := range page.Repositories {
+				if repo.State != "" && repo.State != "MIRROR" {
+					continue
+				}
+				var mirror repoMirrorConfig
+				err := client.do("GET", repositoryPath(repo.Namespace, repo.Name, "mirror"), nil, &mirror)
+				if isNotFound(err) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				mirrors = append(mirrors, mirroredRepository{Name: repo.Namespace + "/" + repo.Name, Mirror: mirror})
+			}
+			if page.NextPage == "" {
+				break
+			}
+			nextPage = page.NextPage
+		}
+	}
+	return mirrors, nil
+}
+
+func repoMirrorList(cobraCmd *cobra.Command) {
+
+	client := repoMirrorClient(cobraCmd)
+	orgs := []string{mirrorNamespace}
+	if mirrorNamespace == "" {
+		var user struct {
+			Organizations []struct {
+				Name string `json:"name"`
+			} `json:"organizations"`
+		}
+		err := client.do("GET", apiPath("user")+"/", nil, &user)
+		check(err)
+		orgs = nil
+		for _, org := range user.Organizations {
+			orgs = append(orgs, org.Name)
+		}
+	}
+	mirrors, err := listRepoMirrors(client, orgs)
+	check(err)
+	if len(mirrors) == 0 {
+		log.Info("No mirrored repositories found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tUPSTREAM\tTAGS\tINTERVAL\tROBOT\tSTATUS\tNEXT SYNC")
+	for _, repo := range mirrors {
+		status := repo.Mirror.SyncStatus
+		if !repo.Mirror.IsEnabled {
+			status = "DISABLED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", repo.Name, repo.Mirror.ExternalReference,
+			strings.Join(repo.Mirror.RootRule.RuleValue, ","), time.Duration(repo.Mirror.SyncInterval)*time.Second,
+			repo.Mirror.Robot, status, repo.Mirror.SyncStartDate)
+	}
+	w.Flush()
+}
+
+func repoMirrorSync(cobraCmd *cobra.Command, ref string) {
+
+	org, name, err := splitRepository(ref)
+	check(err)
+	client := repoMirrorClient(cobraCmd)
+
+	err = client.do("POST", repositoryPath(org, name, "mirror", "sync-now"), nil, nil)
+	if isNotFound(err) {
+		check(fmt.Errorf("%s is not a mirrored repository. Configure it with 'mirror-registry repo-mirror add'", ref))
+	}
+	check(err)
+	log.Infof("Requested a sync of %s", ref)
+	if !mirrorWait {
+		return
+	}
+
+	ctx, stop := newSignalContext()
+	defer stop()
+	err = waitForRepoMirrorSync(ctx.Done(), client, org, name, mirrorTimeout, 10*time.Second)
+	check(err)
+	log.Infof("%s is in sync with its upstream", ref)
+}
+
+// waitForRepoMirrorSync polls the mirror of a repository until its sync succeeds or fails
+func waitForRepoMirrorSync(done <-chan struct{}, client *quayClient, org, name string, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var mirror repoMirrorConfig
+		if err := client.do("GET", repositoryPath(org, name, "mirror"), nil, &mirror); err != nil {
+			return err
+		}
+		switch mirror.SyncStatus {
+		case "SYNC_SUCCESS":
+			return nil
+		case "SYNC_FAILED", "SYNC_CANCEL":
+			return fmt.Errorf("The sync of %s/%s ended with %s. Check the logs of the quay-repomirror container on %s", org, name, mirror.SyncStatus, targetHostname)
+		}
+		log.Debugf("Sync of %s/%s is %s", org, name, mirror.SyncStatus)
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The sync of %s/%s did not finish within %s", org, name, timeout)
+		}
+		select {
+		case <-done:
+			return errors.New("Interrupted while waiting for the sync")
+		case <-time.After(interval):
+		}
+	}
+}
+
+func repoMirrorRemove(cobraCmd *cobra.Command, ref string) {
+
+	org, name, err := splitRepository(ref)
+	check(err)
+	client := repoMirrorClient(cobraCmd)
+
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("repo-mirror")
+	check(err)
+
+	state, err := beginOperation("repo-mirror", false)
+	check(err)
+
+	state.startStep("remove-mirror")
+	err = removeRepoMirror(client, org, name, mirrorDeleteRepository)
+	if err == nil {
+		state.completeStep("remove-mirror")
+	}
+	finishOperation(ctx, state, err)
+}
+
+// removeRepoMirror disables the mirror of a repository and makes it a normal
+// repository again, or deletes it with its images
+func removeRepoMirror(client *quayClient, org, name string, deleteRepository bool) error {
+	if deleteRepository {
+		if err := client.do("DELETE", repositoryPath(org, name), nil, nil); err != nil {
+			return err
+		}
+		log.Infof("Deleted repository %s/%s", org, name)
+		return nil
+	}
+	var mirror repoMirrorConfig
+	err := client.do("GET", repositoryPath(org, name, "mirror"), nil, &mirror)
+	if isNotFound(err) {
+		return fmt.Errorf("%s/%s is not a mirrored repository", org, name)
+	}
+	if err != nil {
+		return err
+	}
+	if mirror.IsEnabled {
+		if err := client.do("PUT", repositoryPath(org, name, "mirror"), map[string]bool{"is_enabled": false}, nil); err != nil {
+			return err
+		}
+	}
+	if err := client.do("PUT", repositoryPath(org, name, "changestate"), map[string]string{"state": "NORMAL"}, nil); err != nil {
+		return err
+	}
+	log.Infof("Stopped mirroring %s/%s. Its images are kept", org, name)
+	return nil
+}
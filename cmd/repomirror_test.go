@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepoMirrorSettingsFromFlags(t *testing.T) {
+	origUpstream, origTags, origInterval, origRobot, origUsername, origPasswordFile := mirrorUpstream, mirrorTags, mirrorInterval, mirrorRobot, mirrorUsername, mirrorPasswordFile
+	defer func() {
+		mirrorUpstream, mirrorTags, mirrorInterval, mirrorRobot, mirrorUsername, mirrorPasswordFile = origUpstream, origTags, origInterval, origRobot, origUsername, origPasswordFile
+	}()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MIRROR_REGISTRY_UPSTREAM_PASSWORD", "")
+
+	tests := []struct {
+		name     string
+		upstream string
+		tags     string
+		interval time.Duration
+		robot    string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"valid", "quay.io/openshift-release-dev/ocp-release", "4.14.*, latest", time.Hour, "ocp4+pusher", "user", passwordFile, false},
+		{"registry with port", "registry.example.com:5000/team/app", "v1", time.Hour, "pusher", "user", passwordFile, false},
+		{"scheme", "https://quay.io/org/repo", "latest", time.Hour, "pusher", "", "", true},
+		{"tag", "quay.io/org/repo:latest", "latest", time.Hour, "pusher", "", "", true},
+		{"no registry", "library/busybox", "latest", time.Hour, "pusher", "", "", true},
+		{"no tags", "quay.io/org/repo", " , ", time.Hour, "pusher", "", "", true},
+		{"short interval", "quay.io/org/repo", "latest", time.Second, "pusher", "", "", true},
+		{"robot of another organization", "quay.io/org/repo", "latest", time.Hour, "other+pusher", "", "", true},
+		{"password without user", "quay.io/org/repo", "latest", time.Hour, "pusher", "", passwordFile, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirrorUpstream, mirrorTags, mirrorInterval, mirrorRobot, mirrorUsername, mirrorPasswordFile = tt.upstream, tt.tags, tt.interval, tt.robot, tt.username, tt.password
+			settings, err := repoMirrorSettingsFromFlags("ocp4")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("repoMirrorSettingsFromFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if settings.Robot != "pusher" || settings.Password != "s3cret" {
+				t.Errorf("unexpected settings: %+v", settings)
+			}
+			if tt.name == "valid" && !reflect.DeepEqual(settings.Tags, []string{"4.14.*", "latest"}) {
+				t.Errorf("Tags = %q", settings.Tags)
+			}
+		})
+	}
+}
+
+func TestAddRepoMirror(t *testing.T) {
+	fake := &fakeQuay{objects: map[string]map[string]interface{}{
+		"/api/v1/organization/ocp4": {"name": "ocp4"},
+	}}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	client := &quayClient{baseURL: server.URL, token: "token", client: server.Client()}
+
+	settings := &repoMirrorSettings{
+		Upstream:  "quay.io/openshift-release-dev/ocp-release",
+		Tags:      []string{"4.14.*"},
+		Interval:  24 * time.Hour,
+		Robot:     "mirror",
+		VerifyTLS: true,
+	}
+	if err := addRepoMirror(client, "ocp4", "openshift/release", settings); err != nil {
+		t.Fatalf("addRepoMirror() returned error: %v", err)
+	}
+	want := []string{
+		"PUT /api/v1/organization/ocp4/robots/mirror",
+		"POST /api/v1/repository",
+		"PUT /api/v1/repository/ocp4/openshift/release/permissions/user/ocp4+mirror",
+		"PUT /api/v1/repository/ocp4/openshift/release/changestate",
+		"POST /api/v1/repository/ocp4/openshift/release/mirror",
+	}
+	if strings.Join(fake.writes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("first run made calls\n%s\nwant\n%s", strings.Join(fake.writes, "\n"), strings.Join(want, "\n"))
+	}
+	mirror := fake.objects["/api/v1/repository/ocp4/openshift/release/mirror"]
+	if mirror["robot_username"] != "ocp4+mirror" || mirror["sync_interval"] != float64(86400) || mirror["external_registry_username"] != nil {
+		t.Errorf("unexpected mirror configuration: %v", mirror)
+	}
+
+	// Running it again only updates the mirror configuration
+	fake.writes = nil
+	if err := addRepoMirror(client, "ocp4", "openshift/release", settings); err != nil {
+		t.Fatalf("second addRepoMirror() returned error: %v", err)
+	}
+	if strings.Join(fake.writes, "\n") != "PUT /api/v1/repository/ocp4/openshift/release/mirror" {
+		t.Errorf("second run made calls %q", fake.writes)
+	}
+
+	fake.writes = nil
+	if err := removeRepoMirror(client, "ocp4", "openshift/release", false); err != nil {
+		t.Fatalf("removeRepoMirror() returned error: %v", err)
+	}
+	want = []string{
+		"PUT /api/v1/repository/ocp4/openshift/release/mirror",
+		"PUT /api/v1/repository/ocp4/openshift/release/changestate",
+	}
+	if strings.Join(fake.writes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("remove made calls %q", fake.writes)
+	}
+	if state := fake.objects["/api/v1/repository/ocp4/openshift/release"]["state"]; state != "NORMAL" {
+		t.Errorf("repository state = %v, want NORMAL", state)
+	}
+
+	if err := addRepoMirror(client, "missing", "repo", settings); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("addRepoMirror() for a missing organization = %v", err)
+	}
+}
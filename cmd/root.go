@@ -20,12 +20,16 @@ var verbose bool
 // noColor is the optional flag for controlling ANSI sequence output
 var noColor bool
 
+// nonInteractive is the optional flag that makes the installer fail instead of prompting
+var nonInteractive bool
+
 // version is an optional command that will display the current release version
 var releaseVersion string
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Display verbose logs")
 	rootCmd.PersistentFlags().BoolVarP(&noColor, "no-color", "c", false, "Control colored output")
+	rootCmd.PersistentFlags().BoolVarP(&nonInteractive, "non-interactive", "", envBool("MIRROR_REGISTRY_NON_INTERACTIVE"), "Never prompt for input and fail if a required input is missing. This defaults to $MIRROR_REGISTRY_NON_INTERACTIVE")
 }
 
 var (
@@ -39,6 +43,9 @@ var (
 				log.SetLevel(logrus.InfoLevel)
 			}
 		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			runExitHooks()
+		},
 	}
 )
 
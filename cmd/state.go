@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Possible values of installState.Status
+const (
+	statusRunning     = "running"
+	statusSucceeded   = "succeeded"
+	statusFailed      = "failed"
+	statusInterrupted = "interrupted"
+)
+
+// installState is the record of the last installer operation against a target.
+// It is kept on the machine running the installer so that an interrupted or
+// failed run can be reported on and picked up again.
+type installState struct {
+	Operation       string          `json:"operation"`
+	Status          string          `json:"status"`
+	Step            string          `json:"step,omitempty"`
+	Install         installProgress `json:"install"`
+	TargetHostname  string          `json:"targetHostname"`
+	TargetUsername  string          `json:"targetUsername"`
+	QuayRoot        string          `json:"quayRoot"`
+	QuayHostname    string          `json:"quayHostname,omitempty"`
+	QuayStorage     string          `json:"quayStorage,omitempty"`
+	SqliteStorage   string          `json:"sqliteStorage,omitempty"`
+	StorageBackend  string          `json:"storageBackend,omitempty"`
+	DatabaseBackend string          `json:"databaseBackend,omitempty"`
+	AuthType        string          `json:"authType,omitempty"`
+	InitTokenUser   string          `json:"initTokenUser,omitempty"`
+	StartedAt       time.Time       `json:"startedAt"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+}
+
+// installProgress is the progress of the last install. It is kept apart from
+// the last operation, so that running other operations after a failed
+// install does not prevent resuming it.
+type installProgress struct {
+	Status         string   `json:"status,omitempty"`
+	Step           string   `json:"step,omitempty"`
+	CompletedSteps []string `json:"completedSteps,omitempty"`
+	// Flags are the flags passed to the install, restored by --resume. Those
+	// holding secrets are kept in credentials.json.
+	Flags map[string][]string `json:"flags,omitempty"`
+}
+
+// installCredentials are the secrets generated for a target. They are kept in
+// a file only readable by the current user so that they can be reused.
+type installCredentials struct {
+	InitUser     string `json:"initUser"`
+	InitPassword string `json:"initPassword"`
+	InitToken    string `json:"initToken,omitempty"`
+	// Passwords are the passwords set by user reset-password for users other than the init user
+	Passwords map[string]string `json:"passwords,omitempty"`
+	// InstallFlags are the flags holding secrets passed to an unfinished install
+	InstallFlags map[string][]string `json:"installFlags,omitempty"`
+	// InstallEnv are the secrets an unfinished install read from the environment
+	InstallEnv map[string]string `json:"installEnv,omitempty"`
+}
+
+// stateRoot returns the local directory where the installer keeps state between runs
+func stateRoot() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return path.Join(dir, "mirror-registry")
+	}
+	return path.Join(os.Getenv("HOME"), ".local", "state", "mirror-registry")
+}
+
+// targetStateDir returns the state directory for the current target host
+func targetStateDir() string {
+	host := strings.Split(targetHostname, ":")[0]
+	if host == "localhost" {
+		host = getFQDN()
+	}
+	return path.Join(stateRoot(), host)
+}
+
+// progressFile is where the playbooks record which step they are running.
+// The directory is mounted into the runner container at /runner/state.
+func progressFile() string {
+	return path.Join(targetStateDir(), "progress")
+}
+
+// initTokenFile is where the install playbook writes the API token returned
+// when the init user is created. It is mounted at /runner/state.
+func initTokenFile() string {
+	return path.Join(targetStateDir(), "init-token")
+}
+
+// collectInitToken moves the API token written by the install playbook into
+// the credentials of the current target, and records in the state which user
+// it belongs to. Nothing changes when the playbook did not return a token.
+func collectInitToken(state *installState, creds *installCredentials) {
+	data, err := ioutil.ReadFile(initTokenFile())
+	if err != nil {
+		return
+	}
+	creds.InitToken = strings.TrimSpace(string(data))
+	if err := creds.save(); err != nil {
+		log.Warnf("Could not save the API token of %s: %s", creds.InitUser, err.Error())
+		return
+	}
+	os.Remove(initTokenFile())
+	state.InitTokenUser = creds.InitUser
+	if err := state.save(); err != nil {
+		log.Warnf("Could not save install state: %s", err.Error())
+	}
+}
+
+// storedAPIToken returns the API token of the init user kept for the current target, if any
+func storedAPIToken() string {
+	creds, err := loadCredentials()
+	if err != nil {
+		log.Debugf("Could not read the credentials of %s: %s", targetHostname, err.Error())
+		return ""
+	}
+	return creds.InitToken
+}
+
+// loadInstallState reads the install state of the current target. A missing
+// state file is not an error and yields an empty state.
+func loadInstallState() (*installState, error) {
+	state := &installState{}
+	data, err := ioutil.ReadFile(path.Join(targetStateDir(), "state.json"))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// save writes the install state of the current target
+func (s *installState) save() error {
+	dir := targetStateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, "state.json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, "state.json"))
+}
+
+// beginOperation marks the start of an operation and clears the progress left
+// by a previous run. The progress of an install is only cleared by a new
+// install, and kept when resuming.
+func beginOperation(operation string, resume bool) (*installState, error) {
+	state, err := loadInstallState()
+	if err != nil {
+		return nil, err
+	}
+	state.Operation = operation
+	state.Status = statusRunning
+	state.Step = ""
+	if operation == "install" {
+		if !resume {
+			state.Install = installProgress{}
+		}
+		state.Install.Status = statusRunning
+		state.Install.Step = ""
+	}
+	state.TargetHostname = targetHostname
+	state.TargetUsername = targetUsername
+	state.QuayRoot = quayRoot
+	state.StartedAt = time.Now().UTC()
+	if err := state.save(); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(progressFile(), nil, 0600); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// finish records the outcome of the operation along with the step the playbook reached
+func (s *installState) finish(status string) {
+	current, completed, err := readProgress(progressFile())
+	if err != nil {
+		log.Warnf("Could not read playbook progress: %s", err.Error())
+	}
+	s.Status = status
+	s.Step = current
+	switch {
+	case s.Operation == "install":
+		s.Install.Status = status
+		s.Install.Step = current
+		for _, step := range completed {
+			s.addCompletedStep(step)
+		}
+		if status == statusSucceeded {
+			clearInstallSecrets()
+		}
+	case s.Operation == "uninstall" && status == statusSucceeded:
+		// Nothing is left to resume once Quay is removed
+		s.Install = installProgress{}
+		clearInstallSecrets()
+	}
+	if err := s.save(); err != nil {
+		log.Warnf("Could not save install state: %s", err.Error())
+	}
+}
+
+// clearInstallSecrets removes the secrets kept for --resume from the
+// credentials of the current target, once there is no install left to resume
+func clearInstallSecrets() {
+	creds, err := loadCredentials()
+	if err != nil {
+		log.Warnf("Could not read the credentials of %s: %s", targetHostname, err.Error())
+		return
+	}
+	if creds.InstallFlags == nil && creds.InstallEnv == nil {
+		return
+	}
+	creds.InstallFlags, creds.InstallEnv = nil, nil
+	if err := creds.save(); err != nil {
+		log.Warnf("Could not remove the install secrets from credentials.json: %s", err.Error())
+	}
+}
+
+// addCompletedStep records a completed step of the install once
+func (s *installState) addCompletedStep(step string) {
+	if !s.stepCompleted(step) {
+		s.Install.CompletedSteps = append(s.Install.CompletedSteps, step)
+	}
+}
+
+// stepCompleted reports whether a step was completed by this or an earlier run of the install
+func (s *installState) stepCompleted(step string) bool {
+	for _, completed := range s.Install.CompletedSteps {
+		if completed == step {
+			return true
+		}
+	}
+	return false
+}
+
+// resumable returns an error if there is no unfinished install to resume
+func (s *installState) resumable() error {
+	if s.Install.Status == "" {
+		return fmt.Errorf("No unfinished install found for %s. Run install without --resume.", targetHostname)
+	}
+	if s.Install.Status == statusSucceeded {
+		return fmt.Errorf("The last install on %s completed successfully. There is nothing to resume.", targetHostname)
+	}
+	return nil
+}
+
+// loadCredentials reads the credentials kept for the current target
+func loadCredentials() (*installCredentials, error) {
+	creds := &installCredentials{}
+	data, err := ioutil.ReadFile(path.Join(targetStateDir(), "credentials.json"))
+	if os.IsNotExist(err) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// save writes the credentials of the current target to a file only readable by the current user
+func (c *installCredentials) save() error {
+	dir := targetStateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := path.Join(dir, "credentials.json")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile does not change the mode of an existing file
+	return os.Chmod(file, 0600)
+}
+
+// startStep records in the progress file that a step run by the installer itself has started
+func (s *installState) startStep(step string) {
+	appendProgress("started " + step)
+}
+
+// completeStep records in the progress file that a step run by the installer itself has completed
+func (s *installState) completeStep(step string) {
+	appendProgress("completed " + step)
+}
+
+func appendProgress(line string) {
+	f, err := os.OpenFile(progressFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Warnf("Could not record progress: %s", err.Error())
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// readProgress parses the progress file written by the playbooks. It returns the
+// step that was started but not completed, if any, and the completed steps in order.
+func readProgress(file string) (string, []string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	var current string
+	var completed []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "started":
+			current = fields[1]
+		case "completed":
+			completed = append(completed, fields[1])
+			if current == fields[1] {
+				current = ""
+			}
+		}
+	}
+	return current, completed, scanner.Err()
+}
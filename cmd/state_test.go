@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadProgress(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		wantCurrent   string
+		wantCompleted []string
+	}{
+		{
+			name:          "empty",
+			content:       "",
+			wantCurrent:   "",
+			wantCompleted: nil,
+		},
+		{
+			name:          "interrupted mid step",
+			content:       "started install-deps\ncompleted install-deps\nstarted install-pod-service\n",
+			wantCurrent:   "install-pod-service",
+			wantCompleted: []string{"install-deps"},
+		},
+		{
+			name:          "all steps completed",
+			content:       "started install-deps\ncompleted install-deps\nstarted enable-linger\ncompleted enable-linger\n",
+			wantCurrent:   "",
+			wantCompleted: []string{"install-deps", "enable-linger"},
+		},
+		{
+			name:          "repeated step",
+			content:       "started wait-for-quay\ncompleted wait-for-quay\nstarted migrate\ncompleted migrate\nstarted wait-for-quay\n",
+			wantCurrent:   "wait-for-quay",
+			wantCompleted: []string{"wait-for-quay", "migrate"},
+		},
+		{
+			name:          "malformed lines are ignored",
+			content:       "garbage\nstarted install-deps\n\n",
+			wantCurrent:   "install-deps",
+			wantCompleted: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "progress")
+			if err := os.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			current, completed, err := readProgress(file)
+			if err != nil {
+				t.Fatalf("readProgress returned error: %v", err)
+			}
+			if current != tt.wantCurrent {
+				t.Errorf("current step = %q, want %q", current, tt.wantCurrent)
+			}
+			if !reflect.DeepEqual(completed, tt.wantCompleted) {
+				t.Errorf("completed steps = %v, want %v", completed, tt.wantCompleted)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		current, completed, err := readProgress(filepath.Join(t.TempDir(), "missing"))
+		if err != nil || current != "" || completed != nil {
+			t.Errorf("readProgress on missing file = (%q, %v, %v), want empty", current, completed, err)
+		}
+	})
+}
+
+func TestInstallStateRoundTrip(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "quay.example.com"
+
+	state, err := loadInstallState()
+	if err != nil {
+		t.Fatalf("loadInstallState without state file returned error: %v", err)
+	}
+	if state.Status != "" {
+		t.Errorf("empty state status = %q, want empty", state.Status)
+	}
+
+	state, err = beginOperation("install", false)
+	if err != nil {
+		t.Fatalf("beginOperation returned error: %v", err)
+	}
+	if err := os.WriteFile(progressFile(), []byte("started install-deps\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state.finish(statusInterrupted)
+
+	loaded, err := loadInstallState()
+	if err != nil {
+		t.Fatalf("loadInstallState returned error: %v", err)
+	}
+	if loaded.Operation != "install" || loaded.Status != statusInterrupted || loaded.Step != "install-deps" {
+		t.Errorf("loaded state = %+v, want interrupted install at install-deps", loaded)
+	}
+
+	info, err := os.Stat(filepath.Join(targetStateDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("state file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestInstallStateResumable(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   installState
+		wantErr bool
+	}{
+		{"no previous run", installState{}, true},
+		{"previous upgrade", installState{Operation: "upgrade", Status: statusFailed}, true},
+		{"succeeded install", installState{Operation: "install", Status: statusSucceeded, Install: installProgress{Status: statusSucceeded}}, true},
+		{"failed install", installState{Operation: "install", Status: statusFailed, Install: installProgress{Status: statusFailed}}, false},
+		{"interrupted install", installState{Operation: "install", Status: statusInterrupted, Install: installProgress{Status: statusInterrupted}}, false},
+		{"failed install followed by another operation", installState{Operation: "config-set", Status: statusSucceeded, Install: installProgress{Status: statusFailed}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.state.resumable()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resumable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBeginOperationResume(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "quay.example.com"
+
+	state, err := beginOperation("install", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(progressFile(), []byte("started install-deps\ncompleted install-deps\nstarted wait-for-quay\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state.finish(statusFailed)
+
+	state, err = beginOperation("install", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.stepCompleted("install-deps") || state.stepCompleted("wait-for-quay") {
+		t.Errorf("resumed completed steps = %v, want [install-deps]", state.Install.CompletedSteps)
+	}
+	if err := os.WriteFile(progressFile(), []byte("started wait-for-quay\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state.finish(statusFailed)
+
+	// Other operations keep the progress of the failed install
+	state, err = beginOperation("config-set", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.finish(statusSucceeded)
+	state, err = loadInstallState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.resumable(); err != nil || !state.stepCompleted("install-deps") || state.Install.Step != "wait-for-quay" {
+		t.Errorf("install after config-set = %+v, %v, want resumable at wait-for-quay", state.Install, err)
+	}
+
+	state, err = beginOperation("install", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Install.CompletedSteps) != 0 {
+		t.Errorf("new install completed steps = %v, want none", state.Install.CompletedSteps)
+	}
+}
+
+func TestFinishInstallClearsSecrets(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "quay.example.com"
+
+	creds := &installCredentials{
+		InitUser:     "init",
+		InitPassword: "s3cret",
+		InstallFlags: map[string][]string{"db-password": {"dbpass"}},
+		InstallEnv:   map[string]string{"MIRROR_REGISTRY_S3_SECRET_KEY": "s3key"},
+	}
+	if err := creds.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []string{statusFailed, statusSucceeded} {
+		state, err := beginOperation("install", status == statusSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.finish(status)
+		loaded, err := loadCredentials()
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := loaded.InstallFlags != nil || loaded.InstallEnv != nil
+		if kept != (status != statusSucceeded) {
+			t.Errorf("after %s install, install secrets = %v, %v", status, loaded.InstallFlags, loaded.InstallEnv)
+		}
+		if loaded.InitUser != "init" || loaded.InitPassword != "s3cret" {
+			t.Errorf("after %s install, init credentials = %s, %s, want them kept", status, loaded.InitUser, loaded.InitPassword)
+		}
+	}
+}
+
+func TestInstallCredentialsRoundTrip(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "quay.example.com"
+
+	creds := &installCredentials{InitUser: "init", InitPassword: "s3cret", InitToken: "t0ken"}
+	if err := creds.save(); err != nil {
+		t.Fatalf("save returned error: %v", err)
+	}
+	loaded, err := loadCredentials()
+	if err != nil {
+		t.Fatalf("loadCredentials returned error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, creds) {
+		t.Errorf("loaded credentials = %+v, want %+v", loaded, creds)
+	}
+	info, err := os.Stat(filepath.Join(targetStateDir(), "credentials.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("credentials file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestCollectInitToken(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	targetHostname = "quay.example.com"
+
+	state := &installState{}
+	creds := &installCredentials{InitUser: "init", InitPassword: "s3cret"}
+	collectInitToken(state, creds)
+	if creds.InitToken != "" || state.InitTokenUser != "" {
+		t.Fatalf("collectInitToken without a token file set %+v, %+v", creds, state)
+	}
+
+	if err := os.MkdirAll(targetStateDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(initTokenFile(), []byte("t0ken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	collectInitToken(state, creds)
+	if creds.InitToken != "t0ken" || state.InitTokenUser != "init" {
+		t.Errorf("collectInitToken set %+v, %+v", creds, state)
+	}
+	if pathExists(initTokenFile()) {
+		t.Error("the token file was not removed")
+	}
+	if got := storedAPIToken(); got != "t0ken" {
+		t.Errorf("storedAPIToken() = %q, want t0ken", got)
+	}
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// quayServices are the systemd units of an installation, in start order
+var quayServices = []string{"quay-pod.service", "quay-redis.service", "quay-app.service", "quay-repomirror.service"}
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Print the state of the Quay services, the health of Quay and the last installer operation.",
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		status(cobraCmd)
+	},
+}
+
+func init() {
+
+	// Add status command
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	statusCmd.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	statusCmd.Flags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	statusCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	statusCmd.Flags().StringVarP(&quayHostname, "quayHostname", "", "", "The SERVER_HOSTNAME of Quay. This defaults to the value used by the last install, or <targetHostname>:8443")
+	statusCmd.Flags().StringVarP(&apiToken, "token", "", "", "The OAuth access token used to call the Quay API. Can also be set with $MIRROR_REGISTRY_TOKEN. This defaults to the token of the init user stored by install.")
+
+}
+
+func status(cobraCmd *cobra.Command) {
+
+	err := loadSSHKeys()
+	check(err)
+
+	previous, err := loadInstallState()
+	check(err)
+	if !cobraCmd.Flags().Changed("quayRoot") && previous.QuayRoot != "" {
+		quayRoot = previous.QuayRoot
+	}
+	if quayHostname == "" {
+		quayHostname = previous.QuayHostname
+	}
+	if quayHostname == "" {
+		quayHostname = targetHostname + ":8443"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Target:\t%s@%s\n", targetUsername, targetHostname)
+	fmt.Fprintf(w, "Quay:\thttps://%s\n", quayHostname)
+	if previous.Operation != "" {
+		line := fmt.Sprintf("%s %s at %s", previous.Operation, previous.Status, previous.UpdatedAt.Local().Format("2006-01-02 15:04:05"))
+		if previous.Status != statusSucceeded && previous.Step != "" {
+			line += fmt.Sprintf(" during step '%s'", previous.Step)
+		}
+		fmt.Fprintf(w, "Last operation:\t%s\n", line)
+	}
+	if previous.Operation != "install" && previous.resumable() == nil {
+		fmt.Fprintf(w, "Unfinished install:\t%s during step '%s', continue it with install --resume\n", previous.Install.Status, orDash(previous.Install.Step))
+	}
+	fmt.Fprintf(w, "Services:\t%s\n", serviceStates())
+
+	client := newQuayClient(quayHostname, resolveAPIToken())
+	if err := client.do("GET", "/health/instance", nil, nil); err != nil {
+		fmt.Fprintf(w, "Health:\tunhealthy: %s\n", err.Error())
+	} else {
+		fmt.Fprintf(w, "Health:\thealthy\n")
+	}
+
+	if client.token == "" {
+		fmt.Fprintf(w, "API token:\tnone, pass --token to check it\n")
+	} else {
+		var user struct {
+			Username      string `json:"username"`
+			SuperUser     bool   `json:"super_user"`
+			Organizations []struct {
+				Name string `json:"name"`
+			} `json:"organizations"`
+		}
+		if err := client.do("GET", apiPath("user")+"/", nil, &user); err != nil {
+			fmt.Fprintf(w, "API token:\tnot accepted: %s\n", err.Error())
+		} else {
+			role := "user"
+			if user.SuperUser {
+				role = "superuser"
+			}
+			var names []string
+			for _, org := range user.Organizations {
+				names = append(names, org.Name)
+			}
+			fmt.Fprintf(w, "API token:\tvalid for %s (%s)\n", user.Username, role)
+			fmt.Fprintf(w, "Organizations:\t%d %s\n", len(names), strings.Join(names, ", "))
+		}
+	}
+	check(w.Flush())
+}
+
+// serviceStates returns the systemd state of each Quay service on the target
+func serviceStates() string {
+	units := strings.Join(quayServices, " ")
+	script := fmt.Sprintf(`if [ "$(id -u)" = 0 ]; then systemctl is-active %s; else systemctl --user is-active %s; fi`, units, units)
+	// is-active exits with an error when a unit is not active, but still prints every state
+	out, _ := runOnTarget(script, nil)
+	states := outputLines(out)
+	var parts []string
+	for i, unit := range quayServices {
+		state := "unknown"
+		if i < len(states) {
+			state = states[i]
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", strings.TrimSuffix(unit, ".service"), state))
+	}
+	return strings.Join(parts, ", ")
+}
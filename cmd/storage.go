@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Possible values of --storage-backend
+const (
+	storageBackendLocal = "local"
+	storageBackendS3    = "s3"
+)
+
+// storageBackend is where Quay stores image blobs
+var storageBackend string
+
+// s3Endpoint is the URL of the S3-compatible endpoint. Empty means AWS S3.
+var s3Endpoint string
+
+// s3Bucket is the bucket Quay stores image blobs in
+var s3Bucket string
+
+// s3Region is the region of the bucket
+var s3Region string
+
+// s3AccessKey is the access key used to access the bucket
+var s3AccessKey string
+
+// s3SecretKey is the secret key used to access the bucket
+var s3SecretKey string
+
+// s3CACert is the path of the CA certificate that signed the endpoint certificate
+var s3CACert string
+
+// s3StoragePath is the prefix under which Quay stores blobs in the bucket
+var s3StoragePath string
+
+// s3Settings describes the S3 bucket used for blob storage
+type s3Settings struct {
+	Endpoint    string
+	Bucket      string
+	Region      string
+	AccessKey   string
+	SecretKey   string
+	CACert      string
+	StoragePath string
+}
+
+// s3SettingsFromFlags reads the S3 settings from the flags and the environment
+func s3SettingsFromFlags() (*s3Settings, error) {
+	settings := &s3Settings{
+		Endpoint:    s3Endpoint,
+		Bucket:      s3Bucket,
+		Region:      s3Region,
+		AccessKey:   s3AccessKey,
+		SecretKey:   s3SecretKey,
+		CACert:      s3CACert,
+		StoragePath: s3StoragePath,
+	}
+	if settings.AccessKey == "" {
+		settings.AccessKey = os.Getenv("MIRROR_REGISTRY_S3_ACCESS_KEY")
+	}
+	if settings.SecretKey == "" {
+		settings.SecretKey = os.Getenv("MIRROR_REGISTRY_S3_SECRET_KEY")
+	}
+	if settings.Bucket == "" {
+		return nil, errors.New("--s3-bucket is required with --storage-backend s3")
+	}
+	if settings.AccessKey == "" || settings.SecretKey == "" {
+		return nil, errors.New("S3 credentials are required with --storage-backend s3. Supply them with --s3-access-key and --s3-secret-key, or $MIRROR_REGISTRY_S3_ACCESS_KEY and $MIRROR_REGISTRY_S3_SECRET_KEY")
+	}
+	if settings.CACert != "" && !pathExists(settings.CACert) {
+		return nil, errors.New("Could not find S3 CA certificate at " + settings.CACert)
+	}
+	if _, _, _, err := settings.endpoint(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// endpoint returns the host, port and scheme of the S3 endpoint
+func (s *s3Settings) endpoint() (string, int, bool, error) {
+	if s.Endpoint == "" {
+		return "s3.amazonaws.com", 443, true, nil
+	}
+	raw := s.Endpoint
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return "", 0, false, fmt.Errorf("Invalid S3 endpoint %q", s.Endpoint)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", 0, false, fmt.Errorf("Invalid S3 endpoint %q: the scheme must be http or https", s.Endpoint)
+	}
+	secure := u.Scheme == "https"
+	port := 443
+	if !secure {
+		port = 80
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return "", 0, false, fmt.Errorf("Invalid S3 endpoint %q", s.Endpoint)
+		}
+	}
+	return u.Hostname(), port, secure, nil
+}
+
+// quayStorageConfig returns the DISTRIBUTED_STORAGE_CONFIG entry of the bucket.
+// AWS uses the S3 driver, other S3-compatible stores such as MinIO or Ceph RGW
+// use the RadosGW driver which supports custom endpoints over http and https.
+func (s *s3Settings) quayStorageConfig() ([]interface{}, error) {
+	host, port, secure, err := s.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	if s.Endpoint == "" {
+		return []interface{}{"S3Storage", map[string]interface{}{
+			"s3_bucket":     s.Bucket,
+			"s3_region":     s.Region,
+			"s3_access_key": s.AccessKey,
+			"s3_secret_key": s.SecretKey,
+			"storage_path":  s.StoragePath,
+		}}, nil
+	}
+	return []interface{}{"RadosGWStorage", map[string]interface{}{
+		"hostname":     host,
+		"port":         port,
+		"is_secure":    secure,
+		"bucket_name":  s.Bucket,
+		"access_key":   s.AccessKey,
+		"secret_key":   s.SecretKey,
+		"storage_path": s.StoragePath,
+	}}, nil
+}
+
+// validate checks from the installer host that the endpoint is reachable with
+// the given credentials, and that objects can be written to and removed from the bucket.
+func (s *s3Settings) validate(ctx context.Context) error {
+	host, port, secure, err := s.endpoint()
+	if err != nil {
+		return err
+	}
+
+	transport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return err
+	}
+	if s.CACert != "" {
+		pem, err := ioutil.ReadFile(s.CACert)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("No certificate found in " + s.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	client, err := minio.New(net.JoinHostPort(host, strconv.Itoa(port)), &minio.Options{
+		Creds:     credentials.NewStaticV4(s.AccessKey, s.SecretKey, ""),
+		Secure:    secure,
+		Region:    s.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, s.Bucket)
+	if err != nil {
+		return fmt.Errorf("Could not reach S3 bucket %s at %s: %w", s.Bucket, host, err)
+	}
+	if !exists {
+		return fmt.Errorf("S3 bucket %s does not exist at %s", s.Bucket, host)
+	}
+
+	probe := strings.TrimPrefix(path.Join(s.StoragePath, ".mirror-registry-probe"), "/")
+	if _, err := client.PutObject(ctx, s.Bucket, probe, bytes.NewReader([]byte("ok")), 2, minio.PutObjectOptions{}); err != nil {
+		return fmt.Errorf("Could not write to S3 bucket %s: %w", s.Bucket, err)
+	}
+	if err := client.RemoveObject(ctx, s.Bucket, probe, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("Could not delete from S3 bucket %s: %w", s.Bucket, err)
+	}
+	return nil
+}
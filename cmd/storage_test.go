@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestS3SettingsEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		endpoint   string
+		wantHost   string
+		wantPort   int
+		wantSecure bool
+		wantErr    bool
+	}{
+		{"aws", "", "s3.amazonaws.com", 443, true, false},
+		{"host only", "minio.example.com", "minio.example.com", 443, true, false},
+		{"https with port", "https://minio.example.com:9000", "minio.example.com", 9000, true, false},
+		{"http", "http://rgw.example.com", "rgw.example.com", 80, false, false},
+		{"http with port", "http://10.0.0.5:7480", "10.0.0.5", 7480, false, false},
+		{"unsupported scheme", "ftp://minio.example.com", "", 0, false, true},
+		{"missing host", "https://", "", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, secure, err := (&s3Settings{Endpoint: tt.endpoint}).endpoint()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("endpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort || secure != tt.wantSecure {
+				t.Errorf("endpoint() = (%q, %d, %t), want (%q, %d, %t)", host, port, secure, tt.wantHost, tt.wantPort, tt.wantSecure)
+			}
+		})
+	}
+}
+
+func TestS3QuayStorageConfig(t *testing.T) {
+	settings := s3Settings{
+		Bucket:      "quay",
+		Region:      "eu-west-1",
+		AccessKey:   "AKIA",
+		SecretKey:   "secret",
+		StoragePath: "/datastorage/registry",
+	}
+
+	got, err := settings.quayStorageConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"S3Storage", map[string]interface{}{
+		"s3_bucket":     "quay",
+		"s3_region":     "eu-west-1",
+		"s3_access_key": "AKIA",
+		"s3_secret_key": "secret",
+		"storage_path":  "/datastorage/registry",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AWS storage config = %v, want %v", got, want)
+	}
+
+	settings.Endpoint = "http://minio.example.com:9000"
+	got, err = settings.quayStorageConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []interface{}{"RadosGWStorage", map[string]interface{}{
+		"hostname":     "minio.example.com",
+		"port":         9000,
+		"is_secure":    false,
+		"bucket_name":  "quay",
+		"access_key":   "AKIA",
+		"secret_key":   "secret",
+		"storage_path": "/datastorage/registry",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("S3-compatible storage config = %v, want %v", got, want)
+	}
+}
+
+func TestS3SettingsFromFlags(t *testing.T) {
+	origBucket, origAccessKey, origSecretKey := s3Bucket, s3AccessKey, s3SecretKey
+	defer func() { s3Bucket, s3AccessKey, s3SecretKey = origBucket, origAccessKey, origSecretKey }()
+	t.Setenv("MIRROR_REGISTRY_S3_ACCESS_KEY", "")
+	t.Setenv("MIRROR_REGISTRY_S3_SECRET_KEY", "")
+
+	s3Bucket, s3AccessKey, s3SecretKey = "", "", ""
+	if _, err := s3SettingsFromFlags(); err == nil {
+		t.Error("expected an error without a bucket")
+	}
+
+	s3Bucket = "quay"
+	if _, err := s3SettingsFromFlags(); err == nil {
+		t.Error("expected an error without credentials")
+	}
+
+	t.Setenv("MIRROR_REGISTRY_S3_ACCESS_KEY", "AKIA")
+	t.Setenv("MIRROR_REGISTRY_S3_SECRET_KEY", "secret")
+	settings, err := s3SettingsFromFlags()
+	if err != nil {
+		t.Fatalf("s3SettingsFromFlags returned error: %v", err)
+	}
+	if settings.AccessKey != "AKIA" || settings.SecretKey != "secret" {
+		t.Errorf("credentials were not read from the environment: %+v", settings)
+	}
+}
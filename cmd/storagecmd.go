@@ -0,0 +1,495 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// storageReportLimit is the number of repositories listed by storage report
+var storageReportLimit int
+
+// storageCmd represents the storage command
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Report and reclaim the space used by image blobs.",
+}
+
+var storageReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Print the space used per namespace and repository, and the free space of the storage volume.",
+	Run: func(cmd *cobra.Command, args []string) {
+		storageReport(cmd)
+	},
+}
+
+var storageGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Run the Quay garbage collection on every repository and print the space it reclaimed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		storageGC(cmd)
+	},
+}
+
+func init() {
+
+	// Add storage command
+	rootCmd.AddCommand(storageCmd)
+	storageCmd.AddCommand(storageReportCmd)
+	storageCmd.AddCommand(storageGCCmd)
+
+	storageCmd.PersistentFlags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	storageCmd.PersistentFlags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	storageCmd.PersistentFlags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	storageCmd.PersistentFlags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+	storageCmd.PersistentFlags().StringVarP(&quayStorage, "quayStorage", "", "quay-storage", "The folder where quay persistent storage data is saved, used when it cannot be read from the running Quay container. This defaults to a Podman named volume 'quay-storage'.")
+	storageCmd.PersistentFlags().StringVarP(&sqliteStorage, "sqliteStorage", "", "sqlite-storage", "The folder where quay sqlite data is saved, used when it cannot be read from the running Quay container. This defaults to a Podman named volume 'sqlite-storage'.")
+
+	storageReportCmd.Flags().StringVarP(&quayHostname, "quayHostname", "", "", "The SERVER_HOSTNAME of Quay. This defaults to the value used by the last install, or <targetHostname>:8443")
+	storageReportCmd.Flags().StringVarP(&apiToken, "token", "", "", "The OAuth access token used to read the time machine of each organization. Can also be set with $MIRROR_REGISTRY_TOKEN. This defaults to the token of the init user stored by install.")
+	storageReportCmd.Flags().IntVarP(&storageReportLimit, "limit", "n", 20, "The number of repositories to list, largest first. 0 lists all of them")
+	storageGCCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+
+}
+
+// Queries of the storage commands. They only use SQL understood by both SQLite
+// and PostgreSQL. A blob shared by several repositories counts in each of them.
+const (
+	storageTotalsQuery = `SELECT COUNT(*), COALESCE(SUM(image_size), 0) FROM imagestorage WHERE uploading IS NULL OR NOT uploading`
+
+	storageUnreferencedQuery = `SELECT COUNT(*), COALESCE(SUM(s.image_size), 0) FROM imagestorage s
+WHERE (s.uploading IS NULL OR NOT s.uploading)
+AND NOT EXISTS (SELECT 1 FROM manifestblob mb WHERE mb.blob_id = s.id)
+AND NOT EXISTS (SELECT 1 FROM uploadedblob ub WHERE ub.blob_id = s.id)`
+
+	storageRepositoriesQuery = `SELECT u.username, r.name, COUNT(s.id), COALESCE(SUM(s.image_size), 0)
+FROM repository r
+JOIN "user" u ON u.id = r.namespace_user_id
+LEFT JOIN (SELECT DISTINCT repository_id, blob_id FROM manifestblob) b ON b.repository_id = r.id
+LEFT JOIN imagestorage s ON s.id = b.blob_id
+GROUP BY u.username, r.name`
+)
+
+// quayDatabase is the database of the Quay installation on the target
+type quayDatabase struct {
+	uri          string
+	sqliteSource string
+}
+
+// quayDatabaseOnTarget reads the database of Quay from its config.yaml
+func quayDatabaseOnTarget(config []byte) (*quayDatabase, error) {
+	uri, err := configValue(config, "DB_URI")
+	if err != nil {
+		return nil, err
+	}
+	s, ok := uri.(string)
+	if !ok || s == "" {
+		return nil, fmt.Errorf("DB_URI is missing from the Quay config on %s", targetHostname)
+	}
+	db := &quayDatabase{uri: s}
+	if strings.HasPrefix(s, "sqlite:") {
+		_, db.sqliteSource = runningQuayContainer()
+		if err := ensureSqliteCli(); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// query runs a read-only query and returns its rows as strings. SQLite is
+// queried on the target with the sqlite3 CLI, PostgreSQL from this host.
+func (d *quayDatabase) query(query string) ([][]string, error) {
+	if d.sqliteSource != "" {
+		out, err := runSqlite(d.sqliteSource, "", query+";\n")
+		if err != nil {
+			return nil, err
+		}
+		var rows [][]string
+		for _, line := range outputLines(out) {
+			rows = append(rows, strings.Split(line, "|"))
+		}
+		return rows, nil
+	}
+
+	db, _, err := openDatabase(d.uri)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	result, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	columns, err := result.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for result.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := result.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		rows = append(rows, row)
+	}
+	return rows, result.Err()
+}
+
+// blobTotals counts blobs and their size
+type blobTotals struct {
+	count int64
+	size  int64
+}
+
+// queryBlobTotals runs a query returning a blob count and a size
+func (d *quayDatabase) queryBlobTotals(query string) (blobTotals, error) {
+	var totals blobTotals
+	rows, err := d.query(query)
+	if err != nil {
+		return totals, err
+	}
+	if len(rows) != 1 || len(rows[0]) != 2 {
+		return totals, fmt.Errorf("Unexpected result from the Quay database: %q", rows)
+	}
+	if totals.count, err = strconv.ParseInt(rows[0][0], 10, 64); err != nil {
+		return totals, err
+	}
+	totals.size, err = strconv.ParseInt(rows[0][1], 10, 64)
+	return totals, err
+}
+
+// repositoryUsage is the space used by the blobs of a repository
+type repositoryUsage struct {
+	namespace string
+	name      string
+	blobs     int64
+	size      int64
+}
+
+// parseRepositoryUsage reads the rows of storageRepositoriesQuery, largest repository first
+func parseRepositoryUsage(rows [][]string) ([]repositoryUsage, error) {
+	var usage []repositoryUsage
+	for _, row := range rows {
+		if len(row) != 4 {
+			return nil, fmt.Errorf("Unexpected row from the Quay database: %q", row)
+		}
+		repo := repositoryUsage{namespace: row[0], name: row[1]}
+		var err error
+		if repo.blobs, err = strconv.ParseInt(row[2], 10, 64); err != nil {
+			return nil, err
+		}
+		if repo.size, err = strconv.ParseInt(row[3], 10, 64); err != nil {
+			return nil, err
+		}
+		usage = append(usage, repo)
+	}
+	sortRepositoryUsage(usage)
+	return usage, nil
+}
+
+// sortRepositoryUsage sorts by size, then by name
+func sortRepositoryUsage(usage []repositoryUsage) {
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].size != usage[j].size {
+			return usage[i].size > usage[j].size
+		}
+		return usage[i].namespace+"/"+usage[i].name < usage[j].namespace+"/"+usage[j].name
+	})
+}
+
+// namespaceUsage sums the repositories of each namespace, largest namespace first
+func namespaceUsage(repositories []repositoryUsage) []repositoryUsage {
+	var namespaces []repositoryUsage
+	index := map[string]int{}
+	for _, repo := range repositories {
+		i, ok := index[repo.namespace]
+		if !ok {
+			i = len(namespaces)
+			index[repo.namespace] = i
+			namespaces = append(namespaces, repositoryUsage{namespace: repo.namespace})
+		}
+		namespaces[i].blobs += repo.blobs
+		namespaces[i].size += repo.size
+	}
+	sortRepositoryUsage(namespaces)
+	return namespaces
+}
+
+// storageVolume is the filesystem holding the blobs of a local storage backend
+type storageVolume struct {
+	source string
+	path   string
+	used   int64
+	size   int64
+	free   int64
+}
+
+// storageVolumeOnTarget measures the storage volume of Quay, or returns nil when
+// Quay stores blobs in an S3 bucket. The name of the bucket is returned instead.
+func storageVolumeOnTarget(config []byte) (*storageVolume, string, error) {
+	storage, err := configValue(config, "DISTRIBUTED_STORAGE_CONFIG")
+	if err != nil {
+		return nil, "", err
+	}
+	if driver, settings := storageDriver(storage); driver != "LocalStorage" {
+		bucket := settings["s3_bucket"]
+		if bucket == nil {
+			bucket = settings["bucket_name"]
+		}
+		return nil, fmt.Sprintf("%s bucket %v", driver, bucket), nil
+	}
+
+	volume := &storageVolume{source: quayStorageOnTarget()}
+	// Blobs are owned by the Quay user of the container, which rootless Podman maps to a subordinate UID
+	script := fmt.Sprintf(`src=%s
+if podman volume exists "$src" 2>/dev/null; then src=$(podman volume inspect --format '{{.Mountpoint}}' "$src"); fi
+echo "$src"
+if [ "$(id -u)" = 0 ]; then du -sb "$src"; else podman unshare du -sb "$src"; fi | cut -f1
+df -B1 --output=size,avail "$src" | tail -n 1`, targetPath(volume.source))
+	out, err := runOnTarget(script, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	lines := outputLines(out)
+	if len(lines) != 3 {
+		return nil, "", fmt.Errorf("Could not measure %s: %q", volume.source, out)
+	}
+	volume.path = lines[0]
+	values := append([]string{lines[1]}, strings.Fields(lines[2])...)
+	if len(values) != 3 {
+		return nil, "", fmt.Errorf("Unexpected output from df: %q", lines[2])
+	}
+	for i, field := range []*int64{&volume.used, &volume.size, &volume.free} {
+		if *field, err = strconv.ParseInt(values[i], 10, 64); err != nil {
+			return nil, "", err
+		}
+	}
+	return volume, "", nil
+}
+
+// storageDriver returns the driver and settings of the default storage location
+func storageDriver(storage interface{}) (string, map[string]interface{}) {
+	locations, _ := storage.(map[string]interface{})
+	location, _ := locations["default"].([]interface{})
+	if len(location) == 0 {
+		return "", nil
+	}
+	driver, _ := location[0].(string)
+	settings := map[string]interface{}{}
+	if len(location) > 1 {
+		if s, ok := location[1].(map[string]interface{}); ok {
+			settings = s
+		}
+	}
+	return driver, settings
+}
+
+// quayStorageOnTarget returns the volume or folder mounted at /datastorage in
+// the Quay container, or --quayStorage when it cannot be inspected.
+func quayStorageOnTarget() string {
+	format := `{{range .Mounts}}{{if eq .Destination "/datastorage"}}{{if .Name}}{{.Name}}{{else}}{{.Source}}{{end}}{{end}}{{end}}`
+	out, err := runOnTarget("podman inspect --format "+shellQuote(format)+" quay-app", nil)
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		log.Debugf("Could not inspect quay-app container, using %s", quayStorage)
+		return quayStorage
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func storageReport(cobraCmd *cobra.Command) {
+
+	configTarget(cobraCmd)
+
+	config, err := readQuayConfig()
+	check(err)
+	db, err := quayDatabaseOnTarget(config)
+	check(err)
+	volume, bucket, err := storageVolumeOnTarget(config)
+	check(err)
+
+	totals, err := db.queryBlobTotals(storageTotalsQuery)
+	check(err)
+	unreferenced, err := db.queryBlobTotals(storageUnreferencedQuery)
+	check(err)
+	rows, err := db.query(storageRepositoriesQuery)
+	check(err)
+	repositories, err := parseRepositoryUsage(rows)
+	check(err)
+
+	if volume != nil {
+		fmt.Printf("Storage:            %s (%s)\n", volume.source, volume.path)
+		fmt.Printf("Filesystem size:    %s\n", formatBytes(volume.size))
+		fmt.Printf("Free space:         %s\n", formatBytes(volume.free))
+		fmt.Printf("Used by Quay:       %s\n", formatBytes(volume.used))
+	} else {
+		fmt.Printf("Storage:            %s, free space is managed by the object store\n", bucket)
+	}
+	fmt.Printf("Blobs:              %d, %s\n", totals.count, formatBytes(totals.size))
+	fmt.Printf("Unreferenced blobs: %d, %s\n", unreferenced.count, formatBytes(unreferenced.size))
+
+	namespaces := namespaceUsage(repositories)
+	timeMachines := namespaceTimeMachines(namespaces)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if timeMachines != nil {
+		fmt.Fprintln(w, "\nNAMESPACE\tBLOBS\tSIZE\tTIME MACHINE")
+	} else {
+		fmt.Fprintln(w, "\nNAMESPACE\tBLOBS\tSIZE")
+	}
+	for _, namespace := range namespaces {
+		if timeMachines != nil {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", namespace.namespace, namespace.blobs, formatBytes(namespace.size), timeMachines[namespace.namespace])
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", namespace.namespace, namespace.blobs, formatBytes(namespace.size))
+	}
+	fmt.Fprintln(w, "\nREPOSITORY\tBLOBS\tSIZE")
+	for i, repo := range repositories {
+		if storageReportLimit > 0 && i == storageReportLimit {
+			fmt.Fprintf(w, "... and %d more\t\t\n", len(repositories)-i)
+			break
+		}
+		fmt.Fprintf(w, "%s/%s\t%d\t%s\n", repo.namespace, repo.name, repo.blobs, formatBytes(repo.size))
+	}
+	check(w.Flush())
+}
+
+// namespaceTimeMachines reads through the Quay API how long deleted tags are
+// kept in each organization, as their blobs are only collected afterwards.
+// It returns nil when no API token is available, and "-" for user namespaces.
+func namespaceTimeMachines(namespaces []repositoryUsage) map[string]string {
+	token := resolveAPIToken()
+	if token == "" {
+		return nil
+	}
+	if quayHostname == "" {
+		if previous, err := loadInstallState(); err == nil {
+			quayHostname = previous.QuayHostname
+		}
+	}
+	if quayHostname == "" {
+		quayHostname = targetHostname + ":8443"
+	}
+	client := newQuayClient(quayHostname, token)
+	timeMachines := map[string]string{}
+	for _, namespace := range namespaces {
+		var org struct {
+			TagExpiration *int `json:"tag_expiration_s"`
+		}
+		timeMachines[namespace.namespace] = "-"
+		err := client.do("GET", apiPath("organization", namespace.namespace), nil, &org)
+		if err != nil && !isNotFound(err) {
+			log.Debugf("Could not read the time machine of %s: %s", namespace.namespace, err.Error())
+		}
+		if err == nil && org.TagExpiration != nil {
+			timeMachines[namespace.namespace] = formatTagExpiration(*org.TagExpiration)
+		}
+	}
+	return timeMachines
+}
+
+// formatTagExpiration formats seconds as a Quay duration such as 2w, using the largest unit that divides it
+func formatTagExpiration(seconds int) string {
+	units := []struct {
+		suffix string
+		size   int
+	}{{"w", 604800}, {"d", 86400}, {"h", 3600}, {"m", 60}}
+	for _, unit := range units {
+		if seconds > 0 && seconds%unit.size == 0 {
+			return fmt.Sprintf("%d%s", seconds/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// storageGCScript runs the garbage collection of Quay on every repository. It
+// runs in the Quay container, which knows how to reach the database and storage.
+const storageGCScript = `
+import logging
+logging.basicConfig(level=logging.WARNING)
+from app import app
+from data.database import Repository
+from data.model.gc import garbage_collect_repo
+collected = 0
+for repository in Repository.select():
+    if garbage_collect_repo(repository):
+        collected += 1
+print("%d" % collected)
+`
+
+func storageGC(cobraCmd *cobra.Command) {
+
+	configTarget(cobraCmd)
+
+	config, err := readQuayConfig()
+	check(err)
+	db, err := quayDatabaseOnTarget(config)
+	check(err)
+
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("storage-gc")
+	check(err)
+
+	state, err := beginOperation("storage-gc", false)
+	check(err)
+
+	err = func() error {
+		state.startStep("measure")
+		before, err := db.queryBlobTotals(storageTotalsQuery)
+		if err != nil {
+			return err
+		}
+		beforeVolume, _, err := storageVolumeOnTarget(config)
+		if err != nil {
+			return err
+		}
+		state.completeStep("measure")
+
+		state.startStep("gc")
+		log.Info("Running the Quay garbage collection. This may take some time.")
+		out, err := runOnTarget("podman exec -i quay-app python3 -", strings.NewReader(storageGCScript))
+		if err != nil {
+			return err
+		}
+		lines := outputLines(out)
+		if len(lines) > 0 {
+			log.Infof("Garbage collected %s repositories", lines[len(lines)-1])
+		}
+		state.completeStep("gc")
+
+		state.startStep("report")
+		after, err := db.queryBlobTotals(storageTotalsQuery)
+		if err != nil {
+			return err
+		}
+		log.Infof("Removed %d blobs, %s", before.count-after.count, formatBytes(before.size-after.size))
+		if beforeVolume != nil {
+			afterVolume, _, err := storageVolumeOnTarget(config)
+			if err != nil {
+				return err
+			}
+			log.Infof("Reclaimed %s on %s, %s free", formatBytes(beforeVolume.used-afterVolume.used), afterVolume.source, formatBytes(afterVolume.free))
+		}
+		state.completeStep("report")
+		return nil
+	}()
+	finishOperation(ctx, state, err)
+}
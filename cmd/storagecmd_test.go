@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestStorageQueries(t *testing.T) {
+	uri := "sqlite:///" + path.Join(t.TempDir(), "quay.db")
+	db, _, err := openDatabase(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		`CREATE TABLE user (id INTEGER PRIMARY KEY, username VARCHAR(255))`,
+		`CREATE TABLE repository (id INTEGER PRIMARY KEY, namespace_user_id INTEGER, name VARCHAR(255))`,
+		`CREATE TABLE imagestorage (id INTEGER PRIMARY KEY, image_size BIGINT, uploading BOOLEAN)`,
+		`CREATE TABLE manifestblob (id INTEGER PRIMARY KEY, repository_id INTEGER, manifest_id INTEGER, blob_id INTEGER)`,
+		`CREATE TABLE uploadedblob (id INTEGER PRIMARY KEY, repository_id INTEGER, blob_id INTEGER)`,
+		`INSERT INTO user VALUES (1, 'admin'), (2, 'ocp')`,
+		`INSERT INTO repository VALUES (1, 1, 'busybox'), (2, 2, 'release'), (3, 2, 'empty')`,
+		`INSERT INTO imagestorage VALUES (1, 100, 0), (2, 200, 0), (3, 400, NULL), (4, 800, 0), (5, 1600, 1)`,
+		// Blob 1 is shared and referenced twice by busybox, blob 4 is only referenced by an upload
+		`INSERT INTO manifestblob VALUES (1, 1, 1, 1), (2, 1, 2, 1), (3, 1, 2, 2), (4, 2, 3, 1)`,
+		`INSERT INTO uploadedblob VALUES (1, 2, 4)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quay := &quayDatabase{uri: uri}
+	totals, err := quay.queryBlobTotals(storageTotalsQuery)
+	if err != nil || totals != (blobTotals{count: 4, size: 1500}) {
+		t.Errorf("totals = %+v, %v", totals, err)
+	}
+	unreferenced, err := quay.queryBlobTotals(storageUnreferencedQuery)
+	if err != nil || unreferenced != (blobTotals{count: 1, size: 400}) {
+		t.Errorf("unreferenced = %+v, %v", unreferenced, err)
+	}
+
+	rows, err := quay.query(storageRepositoriesQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositories, err := parseRepositoryUsage(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []repositoryUsage{
+		{namespace: "admin", name: "busybox", blobs: 2, size: 300},
+		{namespace: "ocp", name: "release", blobs: 1, size: 100},
+		{namespace: "ocp", name: "empty", blobs: 0, size: 0},
+	}
+	if !reflect.DeepEqual(repositories, want) {
+		t.Errorf("repositories = %+v, want %+v", repositories, want)
+	}
+	namespaces := namespaceUsage(repositories)
+	wantNamespaces := []repositoryUsage{
+		{namespace: "admin", blobs: 2, size: 300},
+		{namespace: "ocp", blobs: 1, size: 100},
+	}
+	if !reflect.DeepEqual(namespaces, wantNamespaces) {
+		t.Errorf("namespaces = %+v, want %+v", namespaces, wantNamespaces)
+	}
+}
+
+func TestStorageDriver(t *testing.T) {
+	tests := []struct {
+		name     string
+		storage  interface{}
+		driver   string
+		settings map[string]interface{}
+	}{
+		{
+			name:     "local",
+			storage:  map[string]interface{}{"default": []interface{}{"LocalStorage", map[string]interface{}{"storage_path": "/datastorage"}}},
+			driver:   "LocalStorage",
+			settings: map[string]interface{}{"storage_path": "/datastorage"},
+		},
+		{
+			name:     "radosgw",
+			storage:  map[string]interface{}{"default": []interface{}{"RadosGWStorage", map[string]interface{}{"bucket_name": "quay"}}},
+			driver:   "RadosGWStorage",
+			settings: map[string]interface{}{"bucket_name": "quay"},
+		},
+		{
+			name:    "missing",
+			storage: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver, settings := storageDriver(tt.storage)
+			if driver != tt.driver || (tt.settings != nil && !reflect.DeepEqual(settings, tt.settings)) {
+				t.Errorf("storageDriver() = %q, %v", driver, settings)
+			}
+		})
+	}
+}
+
+func TestFormatTagExpiration(t *testing.T) {
+	tests := map[int]string{0: "0s", 45: "45s", 5400: "90m", 86400: "1d", 1209600: "2w", 90000: "25h"}
+	for seconds, want := range tests {
+		if got := formatTagExpiration(seconds); got != want {
+			t.Errorf("formatTagExpiration(%d) = %q, want %q", seconds, got, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// targetIsLocal reports whether the target host is the machine running the installer
+func targetIsLocal() bool {
+	return targetHostname == "localhost" || targetHostname == getFQDN() && targetUsername == os.Getenv("USER")
+}
+
+// sshArgs returns the arguments of ssh to run a bash script on the target
+// host, connecting to the port given in --targetHostname, if any
+func sshArgs(script string) []string {
+	args := []string{
+		"-i", sshKey,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "LogLevel=ERROR",
+	}
+	host, port, hasPort := strings.Cut(targetHostname, ":")
+	if hasPort && port != "" {
+		args = append(args, "-p", port)
+	}
+	return append(args, fmt.Sprintf("%s@%s", targetUsername, host), "bash -c "+shellQuote(script))
+}
+
+// runOnTarget runs a bash script on the target host, over SSH for remote
+// targets, and returns its standard output. Standard error is included in the
+// returned error when the script fails.
+func runOnTarget(script string, stdin io.Reader) ([]byte, error) {
+	var cmd *exec.Cmd
+	if targetIsLocal() {
+		cmd = exec.Command("bash", "-c", script)
+	} else {
+		cmd = exec.Command("ssh", sshArgs(script)...)
+	}
+	log.Debug("Running on target: ", script)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.Bytes(), fmt.Errorf("%w: %s", err, msg)
+		}
+		return stdout.Bytes(), err
+	}
+	return stdout.Bytes(), nil
+}
+
+// shellQuote quotes s so that it is passed as a single word to a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// targetPath quotes a path for use in a script run on the target. A leading ~
+// is expanded to the home directory of the target user.
+func targetPath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if p == "~" {
+			return `"$HOME"`
+		}
+		return `"$HOME"` + shellQuote(p[1:])
+	}
+	return shellQuote(p)
+}
+
+// systemctlOnTarget runs a systemctl action on a unit of the target user, or
+// on a system unit when connecting as root. It is a variable so that tests
+// can replace it.
+var systemctlOnTarget = func(action, unit string) error {
+	script := fmt.Sprintf(`if [ "$(id -u)" = 0 ]; then systemctl %s %s; else systemctl --user %s %s; fi`, action, shellQuote(unit), action, shellQuote(unit))
+	_, err := runOnTarget(script, nil)
+	return err
+}
+
+// waitForQuayOnTarget waits up to 3 minutes for Quay to report healthy at https://<hostname>/health/instance
+var waitForQuayOnTarget = func(hostname string) error {
+	script := fmt.Sprintf(`for i in $(seq 1 18); do curl -ksf -o /dev/null %s && exit 0; sleep 10; done; exit 1`, shellQuote("https://"+hostname+"/health/instance"))
+	if _, err := runOnTarget(script, nil); err != nil {
+		return fmt.Errorf("Quay did not become alive at https://%s/health/instance", hostname)
+	}
+	return nil
+}
+
+// unameMachines maps the architectures the installer is built for to the
+// machine names reported by uname -m
+var unameMachines = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// installerMachine returns the machine name, as reported by uname -m, of the
+// hosts the installer binary runs on
+func installerMachine() string {
+	if machine, ok := unameMachines[runtime.GOARCH]; ok {
+		return machine
+	}
+	return runtime.GOARCH
+}
+
+// checkTargetMachine returns an error if the installer binary cannot run on
+// the target host, or in the images pulled for it
+func checkTargetMachine() error {
+	out, err := runOnTarget("uname -m", nil)
+	if err != nil {
+		return fmt.Errorf("Could not read the architecture of %s: %w", targetHostname, err)
+	}
+	if machine := strings.TrimSpace(string(out)); machine != installerMachine() {
+		return fmt.Errorf("The installer is built for %s, but %s is %s. Run the installer built for %s.", installerMachine(), targetHostname, machine, machine)
+	}
+	return nil
+}
+
+// uploadInstaller copies the running installer binary to the target so that
+// it can run there inside a container. The copy is removed when the installer exits.
+func uploadInstaller(name string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(executable)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	remote := path.Join(quayRoot, name)
+	script := fmt.Sprintf(`mkdir -p %s && umask 077 && cat > %s && chmod 700 %s`, targetPath(quayRoot), targetPath(remote), targetPath(remote))
+	if _, err := runOnTarget(script, f); err != nil {
+		return "", fmt.Errorf("Could not copy the installer to %s: %w", targetHostname, err)
+	}
+	onExit(func() {
+		runOnTarget("rm -f "+targetPath(remote), nil)
+	})
+	return remote, nil
+}
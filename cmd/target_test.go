@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"simple", "'simple'"},
+		{"", "''"},
+		{"with space", "'with space'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+	}
+
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"~", `"$HOME"`},
+		{"~/quay-install", `"$HOME"'/quay-install'`},
+		{"/etc/quay-install", "'/etc/quay-install'"},
+		{"~other/dir", "'~other/dir'"},
+	}
+
+	for _, tt := range tests {
+		if got := targetPath(tt.in); got != tt.want {
+			t.Errorf("targetPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	t.Run("expands in the target shell", func(t *testing.T) {
+		t.Setenv("HOME", "/home/test user")
+		out, err := exec.Command("bash", "-c", "echo "+targetPath("~/quay-install")).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(out)); got != "/home/test user/quay-install" {
+			t.Errorf("expanded path = %q, want %q", got, "/home/test user/quay-install")
+		}
+	})
+}
+
+func TestSSHArgs(t *testing.T) {
+	origHostname, origUsername, origKey := targetHostname, targetUsername, sshKey
+	defer func() { targetHostname, targetUsername, sshKey = origHostname, origUsername, origKey }()
+	targetUsername = "quay"
+	sshKey = "/keys/id_rsa"
+
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{"quay.example.com", "-i /keys/id_rsa -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -o LogLevel=ERROR quay@quay.example.com bash -c 'true'"},
+		{"quay.example.com:2222", "-i /keys/id_rsa -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -o LogLevel=ERROR -p 2222 quay@quay.example.com bash -c 'true'"},
+	}
+	for _, tt := range tests {
+		targetHostname = tt.hostname
+		if got := strings.Join(sshArgs("true"), " "); got != tt.want {
+			t.Errorf("sshArgs() with %s = %q, want %q", tt.hostname, got, tt.want)
+		}
+	}
+}
+
+func TestRunOnTargetLocal(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	targetHostname = "localhost"
+
+	out, err := runOnTarget("cat; echo done", strings.NewReader("input\n"))
+	if err != nil {
+		t.Fatalf("runOnTarget returned error: %v", err)
+	}
+	if string(out) != "input\ndone\n" {
+		t.Errorf("runOnTarget output = %q, want %q", out, "input\ndone\n")
+	}
+
+	_, err = runOnTarget("echo boom >&2; exit 2", nil)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("runOnTarget error = %v, want error containing stderr", err)
+	}
+}
@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"path"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -12,12 +14,24 @@ import (
 // autoApprove controls whether or not to prompt user
 var autoApprove bool
 
+// keepData keeps the Quay and SQLite storage on uninstall
+var keepData bool
+
+// keepConfig keeps quayRoot/quay-config on uninstall
+var keepConfig bool
+
+// keepImages keeps the container images on the target on uninstall
+var keepImages bool
+
+// purgeImages removes the Quay, Redis, pause and SQLite images from the target on uninstall
+var purgeImages bool
+
 // uninstallCmd represents the uninstall command
 var uninstallCmd = &cobra.Command{
 	Use:   "uninstall",
 	Short: "uninstall will remove all Quay dependencies.",
 	Run: func(cmd *cobra.Command, args []string) {
-		uninstall()
+		uninstall(cmd)
 	},
 }
 
@@ -30,24 +44,64 @@ func init() {
 	uninstallCmd.Flags().StringVarP(&targetHostname, "targetHostname", "H", "localhost", "The hostname of the target you wish to install Quay to. This defaults to localhost")
 	uninstallCmd.Flags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user you wish to ssh into your remote with. This defaults to the current username")
 	uninstallCmd.Flags().BoolVarP(&askBecomePass, "askBecomePass", "", false, "Whether or not to ask for sudo password during SSH connection.")
+	uninstallCmd.Flags().StringVarP(&becomePassFile, "becomePassFile", "", "", "The path of a file containing the sudo password for the target host. Can also be set with $MIRROR_REGISTRY_BECOME_PASSWORD.")
 	uninstallCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
 	uninstallCmd.Flags().StringVarP(&quayStorage, "quayStorage", "", "quay-storage", "The folder where quay persistent storage data is saved. This defaults to a Podman named volume 'quay-storage'. Root is required to uninstall.")
 	uninstallCmd.Flags().StringVarP(&sqliteStorage, "sqliteStorage", "", "sqlite-storage", "The folder where quay sqlite data is saved. This defaults to a Podman named volume 'sqlite-storage'. Root is required to uninstall.")
 	uninstallCmd.Flags().StringVarP(&additionalArgs, "additionalArgs", "", "", "Additional arguments you would like to append to the ansible-playbook call. Used mostly for development.")
-	uninstallCmd.Flags().BoolVarP(&autoApprove, "autoApprove", "", false, "Skips interactive approval")
+	uninstallCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+	uninstallCmd.Flags().BoolVarP(&autoApprove, "autoApprove", "", false, "Delete the data and configuration without asking. When asked, answering n keeps them as with --keep-data --keep-config.")
+	uninstallCmd.Flags().BoolVarP(&keepData, "keep-data", "", false, "Keep the Quay image storage and the SQLite database.")
+	uninstallCmd.Flags().BoolVarP(&keepConfig, "keep-config", "", false, "Keep the Quay configuration and certificates in <quayRoot>/quay-config.")
+	uninstallCmd.Flags().BoolVarP(&keepImages, "keep-images", "", false, "Keep the container images loaded by the installer on the target and on this host.")
+	uninstallCmd.Flags().BoolVarP(&purgeImages, "purge-images", "", false, "Remove the Quay, Redis, pause and SQLite images from the target.")
 }
 
-func uninstall() {
+func uninstall(cobraCmd *cobra.Command) {
 
 	var err error
 	log.Printf("Uninstall has begun")
 
-	if !autoApprove {
-		question := fmt.Sprintf("Are you sure want to delete quayRoot directory %s and all storage data? [y/n]", quayRoot)
+	if keepImages && purgeImages {
+		check(errors.New("--keep-images and --purge-images cannot be used together"))
+	}
+
+	// Default the storage locations to the ones used by the install
+	previous, err := loadInstallState()
+	check(err)
+	if !cobraCmd.Flags().Changed("quayRoot") && previous.QuayRoot != "" {
+		quayRoot = previous.QuayRoot
+	}
+	if !cobraCmd.Flags().Changed("quayStorage") && previous.QuayStorage != "" {
+		quayStorage = previous.QuayStorage
+	}
+	if !cobraCmd.Flags().Changed("sqliteStorage") && previous.SqliteStorage != "" {
+		sqliteStorage = previous.SqliteStorage
+	}
+
+	images, err := readLoadedImages()
+	check(err)
+	deleted, kept := uninstallPlan(previous, images)
+	fmt.Printf("The following will be deleted from %s:\n", targetHostname)
+	for _, item := range deleted {
+		fmt.Printf("  - %s\n", item)
+	}
+	if len(kept) > 0 {
+		fmt.Println("The following will be kept:")
+		for _, item := range kept {
+			fmt.Printf("  - %s\n", item)
+		}
+	}
+
+	// Answering no keeps the data and configuration and still removes Quay
+	if !autoApprove && !(keepData && keepConfig) {
+		err = requireInteractive("approval", "Re-run with --autoApprove to uninstall without prompting.")
+		check(err)
+		question := "Are you sure you want to delete the data and configuration listed above? Answer n to remove Quay and keep them. [y/n]"
 		fmt.Println(question)
-		autoApprove = getApproval(question)
-		if !autoApprove {
-			log.Info("Skipping deletion of quayRoot.")
+		if !getApproval(question) {
+			log.Info("Keeping the data and configuration, as with --keep-data --keep-config.")
+			keepData, keepConfig = true, true
 		}
 	}
 
@@ -58,17 +112,28 @@ func uninstall() {
 	err = loadSSHKeys()
 	check(err)
 
-	// Set askBecomePass flag if true
-	var askBecomePassFlag string
-	if askBecomePass {
-		askBecomePassFlag = "-K"
-	}
+	// Set the sudo password from a file or the environment, or ask for it if requested
+	becomePassMountFlag, askBecomePassFlag, err := becomePassFlags()
+	check(err)
+
+	// Stop the runner container and record the interruption on SIGINT/SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("uninstall")
+	check(err)
+
+	state, err := beginOperation("uninstall", false)
+	check(err)
 
 	log.Printf("Running uninstall playbook. This may take some time. To see playbook output run the installer with -v (verbose) flag.")
 	podmanCmd := fmt.Sprintf(`podman run `+
-		`--rm --interactive --tty `+
+		runnerTTYFlags()+
 		`--workdir /runner/project `+
 		`--net host `+
+		runnerStateFlags()+
+		becomePassMountFlag+ // optional sudo password file
 		` -v %s:/runner/env/ssh_key `+
 		`-e RUNNER_OMIT_EVENTS=False `+
 		`-e RUNNER_ONLY_FAILED_EVENTS=False `+
@@ -76,20 +141,87 @@ func uninstall() {
 		`-e ANSIBLE_CONFIG=/runner/project/ansible.cfg `+
 		fmt.Sprintf("-e ANSIBLE_NOCOLOR=%t ", noColor)+
 		`--quiet `+
-		`--name ansible_runner_instance `+
+		fmt.Sprintf("--name %s ", runnerContainerName)+
 		fmt.Sprintf("%s ", eeImage)+
-		`ansible-playbook -i %s@%s, --private-key /runner/env/ssh_key uninstall_mirror_appliance.yml -e "quay_root=%s quay_storage=%s sqlite_storage=%s auto_approve=%t" %s %s`,
-		sshKey, targetUsername, strings.Split(targetHostname, ":")[0], quayRoot, quayStorage, sqliteStorage, autoApprove, askBecomePassFlag, additionalArgs)
+		`ansible-playbook -i %s@%s, --private-key /runner/env/ssh_key uninstall_mirror_appliance.yml -e "quay_root=%s quay_storage=%s sqlite_storage=%s keep_data=%t keep_config=%t" %s %s`,
+		sshKey, targetUsername, strings.Split(targetHostname, ":")[0], quayRoot, quayStorage, sqliteStorage, keepData, keepConfig, askBecomePassFlag, additionalArgs)
 
-	log.Debug("Running command: " + podmanCmd)
-	cmd := exec.Command("bash", "-c", podmanCmd)
+	var stdout, stderr io.Writer
 	if verbose {
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
+		stdout = os.Stdout
+		stderr = os.Stderr
 	}
-	cmd.Stdin = os.Stdin
-	err = cmd.Run()
-	check(err)
+	err = runPlaybook(ctx, podmanCmd, stdout, stderr)
+	if err == nil && ctx.Err() == nil && !keepImages {
+		state.startStep("remove-images")
+		if err = removeLoadedImages(purgeImages); err == nil {
+			state.completeStep("remove-images")
+		}
+	}
+	finishOperation(ctx, state, err)
 
 	log.Printf("Quay uninstalled successfully")
 }
+
+// uninstallPlan lists what uninstall deletes from the target and what it keeps
+func uninstallPlan(previous *installState, images []loadedImage) ([]string, []string) {
+	deleted := []string{
+		"the quay-app, quay-repomirror, quay-redis and quay-pod services, the quay-replicate timer and the quay-pod pod",
+		"the redis_pass Podman secret",
+		"lingering of the systemd user session, when not installed as root",
+	}
+	var kept []string
+	plan := func(keep bool, item string) {
+		if keep {
+			kept = append(kept, item)
+		} else {
+			deleted = append(deleted, item)
+		}
+	}
+	storageItem := func(description, location string) string {
+		if strings.HasPrefix(location, "/") {
+			return fmt.Sprintf("%s in the directory %s", description, location)
+		}
+		return fmt.Sprintf("%s in the Podman volume %s", description, location)
+	}
+
+	if previous.StorageBackend == storageBackendS3 {
+		kept = append(kept, "image blobs in the S3 bucket")
+	} else {
+		plan(keepData, storageItem("image storage", quayStorage))
+	}
+	if previous.DatabaseBackend == databaseBackendPostgres {
+		kept = append(kept, "the external PostgreSQL database")
+	} else {
+		plan(keepData, storageItem("the SQLite database", sqliteStorage))
+	}
+	if keepConfig {
+		deleted = append(deleted, fmt.Sprintf("%s, except quay-config", quayRoot))
+		kept = append(kept, fmt.Sprintf("the configuration and certificates in %s", path.Join(quayRoot, "quay-config")))
+	} else {
+		deleted = append(deleted, fmt.Sprintf("%s, including the configuration, certificates and audit log", quayRoot))
+	}
+	var loaded []string
+	for _, image := range images {
+		where := "the target"
+		if image.Host == imageHostInstaller {
+			where = "this host"
+		}
+		loaded = append(loaded, fmt.Sprintf("%s on %s", image.Reference, where))
+	}
+	switch {
+	case purgeImages:
+		deleted = append(deleted, fmt.Sprintf("the images %s on the target, even if another tool loaded them", strings.Join([]string{quayImage, redisImage, pauseImage, sqliteImage}, ", ")))
+		if len(loaded) > 0 {
+			deleted = append(deleted, "the images loaded by the installer: "+strings.Join(loaded, ", "))
+		}
+	case keepImages:
+		kept = append(kept, "the container images")
+	case len(loaded) > 0:
+		deleted = append(deleted, "the images loaded by the installer: "+strings.Join(loaded, ", "))
+		kept = append(kept, "images not loaded by the installer")
+	default:
+		kept = append(kept, "the container images, none of which were recorded as loaded by the installer")
+	}
+	return deleted, kept
+}
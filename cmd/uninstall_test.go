@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUninstallPlan(t *testing.T) {
+	origRoot, origQuay, origSqlite := quayRoot, quayStorage, sqliteStorage
+	origKeepData, origKeepConfig, origKeepImages, origPurge := keepData, keepConfig, keepImages, purgeImages
+	defer func() {
+		quayRoot, quayStorage, sqliteStorage = origRoot, origQuay, origSqlite
+		keepData, keepConfig, keepImages, purgeImages = origKeepData, origKeepConfig, origKeepImages, origPurge
+	}()
+	loaded := []loadedImage{
+		{Reference: "registry.example.com/quay:v3", ID: "abc", Host: imageHostTarget},
+		{Reference: "registry.example.com/ee:v1", ID: "def", Host: imageHostInstaller},
+	}
+	quayRoot, quayStorage, sqliteStorage = "/opt/quay", "mirror-blobs", "/data/sqlite"
+
+	contains := func(items []string, s string) bool {
+		for _, item := range items {
+			if strings.Contains(item, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name                                    string
+		state                                   installState
+		images                                  []loadedImage
+		keepData, keepConfig, keepImages, purge bool
+		wantDeleted, wantKept                   []string
+	}{
+		{
+			name:        "everything",
+			images:      loaded,
+			wantDeleted: []string{"Podman volume mirror-blobs", "directory /data/sqlite", "/opt/quay, including", "quay:v3 on the target", "ee:v1 on this host"},
+			wantKept:    []string{"images not loaded by the installer"},
+		},
+		{
+			name:        "keep data and config",
+			keepData:    true,
+			keepConfig:  true,
+			purge:       true,
+			wantDeleted: []string{"/opt/quay, except quay-config", "even if another tool loaded them"},
+			wantKept:    []string{"mirror-blobs", "/data/sqlite", "/opt/quay/quay-config"},
+		},
+		{
+			name:        "external storage and database",
+			state:       installState{StorageBackend: storageBackendS3, DatabaseBackend: databaseBackendPostgres},
+			images:      loaded,
+			keepImages:  true,
+			wantDeleted: []string{"/opt/quay"},
+			wantKept:    []string{"S3 bucket", "PostgreSQL", "the container images"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepData, keepConfig, keepImages, purgeImages = tt.keepData, tt.keepConfig, tt.keepImages, tt.purge
+			deleted, kept := uninstallPlan(&tt.state, tt.images)
+			for _, want := range tt.wantDeleted {
+				if !contains(deleted, want) {
+					t.Errorf("deleted %q does not mention %q", deleted, want)
+				}
+				if contains(kept, want) {
+					t.Errorf("kept %q mentions %q", kept, want)
+				}
+			}
+			for _, want := range tt.wantKept {
+				if !contains(kept, want) {
+					t.Errorf("kept %q does not mention %q", kept, want)
+				}
+			}
+		})
+	}
+}
@@ -36,11 +36,23 @@ func init() {
 
 	upgradeCmd.Flags().StringVarP(&imageArchivePath, "image-archive", "i", "", "An archive containing images")
 	upgradeCmd.Flags().BoolVarP(&askBecomePass, "askBecomePass", "", false, "Whether or not to ask for sudo password during SSH connection.")
+	upgradeCmd.Flags().StringVarP(&becomePassFile, "becomePassFile", "", "", "The path of a file containing the sudo password for the target host. Can also be set with $MIRROR_REGISTRY_BECOME_PASSWORD.")
 	upgradeCmd.Flags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
 	upgradeCmd.Flags().StringVarP(&quayStorage, "quayStorage", "", "quay-storage", "The folder where quay persistent storage data is saved. This defaults to a Podman named volume 'quay-storage'. Root is required to uninstall.")
 	upgradeCmd.Flags().StringVarP(&sqliteStorage, "sqliteStorage", "", "sqlite-storage", "The folder where quay sqlite data is saved. This defaults to a Podman named volume 'sqlite-storage'. Root is required to uninstall.")
 	upgradeCmd.Flags().StringVarP(&additionalArgs, "additionalArgs", "", "", "Additional arguments you would like to append to the ansible-playbook call. Used mostly for development.")
-
+	upgradeCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+
+	upgradeCmd.Flags().StringVarP(&oidcIssuer, "oidc-issuer", "", "", "The issuer URL of an OIDC provider users can log in with, for example https://keycloak.example.com/realms/quay.")
+	upgradeCmd.Flags().StringVarP(&oidcClientID, "oidc-client-id", "", "", "The ID of the client registered for Quay in the OIDC provider.")
+	upgradeCmd.Flags().StringVarP(&oidcClientSecretFile, "oidc-client-secret-file", "", "", "The path of a file containing the secret of --oidc-client-id. Can also be set with $MIRROR_REGISTRY_OIDC_CLIENT_SECRET.")
+	upgradeCmd.Flags().StringVarP(&oidcLoginScopes, "oidc-login-scopes", "", "openid", "The comma-separated scopes requested when logging in with OIDC. This defaults to openid.")
+	upgradeCmd.Flags().StringVarP(&oidcCACert, "oidc-ca-cert", "", "", "The path to the CA certificate that signed the certificate of the OIDC provider.")
+	upgradeCmd.Flags().StringVarP(&oidcServiceName, "oidc-service-name", "", "Single Sign-On", "The name of the OIDC login button in Quay.")
+	upgradeCmd.Flags().StringVarP(&configOverrideFile, "config-override", "", "", "The path of a YAML file of config.yaml settings that is copied to quayRoot/quay-config/config-overrides.yaml and merged over the generated config.yaml on every install and upgrade.")
+	upgradeCmd.Flags().StringVarP(&httpProxy, "http-proxy", "", "", "The proxy used for HTTP requests by Quay and the installer, for example http://proxy.example.com:3128.")
+	upgradeCmd.Flags().StringVarP(&httpsProxy, "https-proxy", "", "", "The proxy used for HTTPS requests by Quay and the installer, for example http://proxy.example.com:3128.")
+	upgradeCmd.Flags().StringVarP(&noProxy, "no-proxy", "", "", "The comma-separated hosts reached without the proxy. The Quay hostname and the pod-local addresses are always added.")
 	upgradeCmd.Flags().StringVarP(&sslCert, "sslCert", "", "", "The path to the SSL certificate Quay should use")
 	upgradeCmd.Flags().StringVarP(&sslKey, "sslKey", "", "", "The path to the SSL key Quay should use")
 	upgradeCmd.Flags().BoolVarP(&sslCheckSkip, "sslCheckSkip", "", false, "Whether or not to check the certificate hostname against the SERVER_HOSTNAME in config.yaml.")
@@ -63,6 +75,23 @@ func upgrade(cobraCmd *cobra.Command) {
 	quayStorageExplicit := cobraCmd.Flags().Changed("quayStorage")
 	sqliteStorageExplicit := cobraCmd.Flags().Changed("sqliteStorage")
 
+	// Check the config overrides before anything is upgraded
+	var configOverrideMountFlag string
+	if configOverrideFile != "" {
+		_, err = loadConfigOverrides(configOverrideFile)
+		check(err)
+		configOverrideAbs, err := filepath.Abs(configOverrideFile)
+		check(err)
+		configOverrideMountFlag = fmt.Sprintf(" -v %s:/runner/env/config-overrides.yaml:Z ", configOverrideAbs)
+	}
+
+	// Check the OIDC provider before anything is upgraded
+	var oidcMountFlags, oidcVarsArg string
+	if oidcRequested() {
+		oidcMountFlags, oidcVarsArg, err = oidcRunnerFlags()
+		check(err)
+	}
+
 	// Load execution environment
 	err = loadExecutionEnvironment()
 	check(err)
@@ -132,6 +161,7 @@ func upgrade(cobraCmd *cobra.Command) {
 			log.Debug("Importing Pause with command: ", pauseImport)
 			err = pauseImport.Run()
 			check(err)
+			recordLoadedImage(imageHostTarget, pauseImage)
 
 			// Load Redis image
 			redisArchivePath := path.Join(path.Dir(executableDir), "redis.tar")
@@ -145,6 +175,7 @@ func upgrade(cobraCmd *cobra.Command) {
 			log.Debug("Importing Redis with command: ", redisImport)
 			err = redisImport.Run()
 			check(err)
+			recordLoadedImage(imageHostTarget, redisImage)
 
 			// Load Quay image
 			quayArchivePath := path.Join(path.Dir(executableDir), "quay.tar")
@@ -158,6 +189,7 @@ func upgrade(cobraCmd *cobra.Command) {
 			log.Debug("Importing Quay with command: ", quayImport)
 			err = quayImport.Run()
 			check(err)
+			recordLoadedImage(imageHostTarget, quayImage)
 		}
 		log.Infof("Attempting to set SELinux rules on image archive")
 		cmd := exec.Command("chcon", "-Rt", "svirt_sandbox_file_t", imageArchivePath)
@@ -170,11 +202,9 @@ func upgrade(cobraCmd *cobra.Command) {
 		}
 	}
 
-	// Set askBecomePass flag if true
-	var askBecomePassFlag string
-	if askBecomePass {
-		askBecomePassFlag = "-K"
-	}
+	// Set the sudo password from a file or the environment, or ask for it if requested
+	becomePassMountFlag, askBecomePassFlag, err := becomePassFlags()
+	check(err)
 
 	// Set the SSL flag if cert and key are defined
 	var sslCertKeyFlag string
@@ -208,16 +238,45 @@ func upgrade(cobraCmd *cobra.Command) {
 		quayRootExtraVar = fmt.Sprintf("quay_root_default=%s ", quayRoot)
 	}
 
+	// Pass the proxy to the runner, the playbook and the Quay services
+	var proxyFlags, proxyVarsArg string
+	if proxyRequested() {
+		proxyFlags, proxyVarsArg, err = proxyRunnerFlags(quayHostname)
+		check(err)
+	}
+
+	// Hand the installer to the playbook, which updates the copy run by the
+	// replication timer when install set one up, and runs it in the Quay image
+	// to migrate the database of installs still running quay-postgres
+	err = copyInstallerBinary()
+	check(err)
+
+	// Stop the runner container and record the interruption on SIGINT/SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("upgrade")
+	check(err)
+
+	state, err := beginOperation("upgrade", false)
+	check(err)
+
 	// Run playbook
 	log.Printf("Running upgrade playbook. This may take some time. To see playbook output run the installer with -v (verbose) flag.")
 	quayVersion := strings.Split(quayImage, ":")[1]
 	podmanCmd := fmt.Sprintf(`podman run `+
-		`--rm --interactive --tty `+
+		runnerTTYFlags()+
 		`--workdir /runner/project `+
 		`--net host `+
 		imageArchiveMountFlag+ // optional image archive flag
 		sqliteArchiveMountFlag+
 		sslCertKeyFlag+ // optional ssl cert/key flag
+		runnerStateFlags()+
+		becomePassMountFlag+ // optional sudo password file
+		oidcMountFlags+ // optional OIDC settings
+		configOverrideMountFlag+ // optional config overrides
+		proxyFlags+ // optional proxy settings
 		` -v %s:/runner/env/ssh_key `+
 		`-e RUNNER_OMIT_EVENTS=False `+
 		`-e RUNNER_ONLY_FAILED_EVENTS=False `+
@@ -225,18 +284,13 @@ func upgrade(cobraCmd *cobra.Command) {
 		`-e ANSIBLE_CONFIG=/runner/project/ansible.cfg `+
 		fmt.Sprintf("-e ANSIBLE_NOCOLOR=%t ", noColor)+
 		`--quiet `+
-		`--name ansible_runner_instance `+
+		fmt.Sprintf("--name %s ", runnerContainerName)+
 		fmt.Sprintf("%s ", eeImage)+
-		`ansible-playbook -i %s@%s, --private-key /runner/env/ssh_key -e "quay_image=%s quay_version=%s redis_image=%s sqlite_image=%s pause_image=%s %s%slocal_install=%s quay_storage=%s quay_storage_explicit=%s sqlite_storage=%s sqlite_storage_explicit=%s" upgrade_mirror_appliance.yml %s %s`,
-		sshKey, targetUsername, targetHostname, quayImage, quayVersion, redisImage, sqliteImage, pauseImage, quayHostnameExtraVar, quayRootExtraVar, strconv.FormatBool(isLocalInstall()), quayStorage, strconv.FormatBool(quayStorageExplicit), sqliteStorage, strconv.FormatBool(sqliteStorageExplicit), askBecomePassFlag, additionalArgs)
-
-	log.Debug("Running command: " + podmanCmd)
-	cmd := exec.Command("bash", "-c", podmanCmd)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	err = cmd.Run()
-	check(err)
+		`ansible-playbook -i %s@%s, --private-key /runner/env/ssh_key -e "quay_image=%s quay_version=%s redis_image=%s sqlite_image=%s pause_image=%s %s%slocal_install=%s quay_storage=%s quay_storage_explicit=%s sqlite_storage=%s sqlite_storage_explicit=%s installer_arch=%s progress_file=/runner/state/progress loaded_images_file=/runner/state/loaded-images" upgrade_mirror_appliance.yml %s %s %s %s`,
+		sshKey, targetUsername, targetHostname, quayImage, quayVersion, redisImage, sqliteImage, pauseImage, quayHostnameExtraVar, quayRootExtraVar, strconv.FormatBool(isLocalInstall()), quayStorage, strconv.FormatBool(quayStorageExplicit), sqliteStorage, strconv.FormatBool(sqliteStorageExplicit), installerMachine(), oidcVarsArg, proxyVarsArg, askBecomePassFlag, additionalArgs)
+
+	err = runPlaybook(ctx, podmanCmd, os.Stdout, os.Stderr)
+	finishOperation(ctx, state, err)
 
 	log.Printf("Quay upgraded successfully")
 }
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// resetUser is the user whose password is reset
+var resetUser string
+
+// resetPassword is the new password. It is generated when empty.
+var resetPassword string
+
+// userCmd represents the user command
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users of Quay.",
+}
+
+var userResetPasswordCmd = &cobra.Command{
+	Use:   "reset-password",
+	Short: "Set a new password for a user and store it with the credentials of the target.",
+	Run: func(cmd *cobra.Command, args []string) {
+		userResetPassword(cmd)
+	},
+}
+
+func init() {
+
+	// Add user command
+	rootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userResetPasswordCmd)
+
+	userCmd.PersistentFlags().StringVarP(&targetHostname, "targetHostname", "H", getFQDN(), "The hostname of the target you wish to install Quay to. This defaults to $HOST")
+	userCmd.PersistentFlags().StringVarP(&targetUsername, "targetUsername", "u", os.Getenv("USER"), "The user on the target host which will be used for SSH. This defaults to $USER")
+	userCmd.PersistentFlags().StringVarP(&sshKey, "ssh-key", "k", os.Getenv("HOME")+"/.ssh/quay_installer", "The path of your ssh identity key. This defaults to ~/.ssh/quay_installer")
+	userCmd.PersistentFlags().StringVarP(&quayRoot, "quayRoot", "r", "~/quay-install", "The folder where quay persistent data are saved. This defaults to ~/quay-install")
+
+	userResetPasswordCmd.Flags().StringVarP(&resetUser, "user", "", "", "The user whose password is reset. This defaults to the init user of the last install.")
+	userResetPasswordCmd.Flags().StringVarP(&resetPassword, "password", "", "", "The new password. If not specified, this will be randomly generated.")
+	userResetPasswordCmd.Flags().BoolVarP(&breakLock, "break-lock", "", false, "Remove an existing lock on the target left by another run before starting.")
+
+}
+
+// resetPasswordScript changes the password of a user with the Quay code in the
+// quay-app container, which hashes it and signs the user out of every session.
+// The user name and the password are read from standard input.
+const resetPasswordScript = `
+import sys
+from app import app
+from data import model
+username = sys.stdin.readline().rstrip("\n")
+new_password = sys.stdin.readline().rstrip("\n")
+user = model.user.get_user(username)
+if user is None:
+    sys.exit(3)
+model.user.change_password(user, new_password)
+`
+
+func userResetPassword(cobraCmd *cobra.Command) {
+
+	configTarget(cobraCmd)
+
+	creds, err := loadCredentials()
+	check(err)
+	if resetUser == "" {
+		resetUser = creds.InitUser
+	}
+	if resetUser == "" {
+		resetUser = "init"
+	}
+	if strings.ContainsAny(resetUser+resetPassword, "\r\n") {
+		check(errors.New("The user name and the password cannot contain line breaks"))
+	}
+	if resetPassword == "" {
+		resetPassword, err = generatePassword()
+		check(err)
+	}
+	if len(resetPassword) < 8 {
+		check(errors.New("The password must be at least 8 characters long"))
+	}
+
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	// Prevent concurrent runs against the same target
+	err = acquireLock("user-reset-password")
+	check(err)
+
+	state, err := beginOperation("user-reset-password", false)
+	check(err)
+
+	state.startStep("reset-password")
+	log.Infof("Resetting the password of %s on %s", resetUser, targetHostname)
+	err = changeQuayPassword(resetUser, resetPassword)
+	if err == nil {
+		state.completeStep("reset-password")
+		state.startStep("save-credentials")
+		creds.setPassword(resetUser, resetPassword)
+		if err = creds.save(); err == nil {
+			state.completeStep("save-credentials")
+		}
+		// The replication timer pushes as the init user of the install that set it up
+		if err == nil {
+			state.startStep("update-replication")
+			var timerUser string
+			var updated bool
+			timerUser, err = replicationUser()
+			if err == nil && timerUser == resetUser {
+				updated, err = updateReplicationPassword(resetPassword)
+			}
+			if err == nil {
+				state.completeStep("update-replication")
+			}
+			if updated {
+				log.Infof("Updated the password the replication timer pushes with")
+			}
+		}
+	}
+	finishOperation(ctx, state, err)
+
+	log.Printf("The password of %s is now %s", resetUser, resetPassword)
+	log.Printf("It is stored in %s", path.Join(targetStateDir(), "credentials.json"))
+}
+
+// setPassword records the new password of a user. Only the init user recorded
+// by install has its password kept as InitPassword.
+func (c *installCredentials) setPassword(user, password string) {
+	if c.InitUser != "" && user == c.InitUser {
+		c.InitPassword = password
+		return
+	}
+	if c.Passwords == nil {
+		c.Passwords = map[string]string{}
+	}
+	c.Passwords[user] = password
+}
+
+// replicationUser returns the user the replication timer on the target pushes
+// as, read from its unit, or an empty string when the target has no timer
+func replicationUser() (string, error) {
+	script := `if [ "$(id -u)" = 0 ]; then systemctl cat quay-replicate.service; else systemctl --user cat quay-replicate.service; fi 2>/dev/null || true`
+	out, err := runOnTarget(script, nil)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the replication timer on %s: %w", targetHostname, err)
+	}
+	return parseReplicationUser(string(out)), nil
+}
+
+// parseReplicationUser returns the value of --dest-username in the unit of the replication timer
+func parseReplicationUser(unit string) string {
+	fields := strings.Fields(unit)
+	for i, field := range fields {
+		if field == "--dest-username" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// updateReplicationPassword rewrites the password of the init user kept for
+// the replication timer set up by install. It reports whether the target has one.
+func updateReplicationPassword(password string) (bool, error) {
+	file := targetPath(path.Join(quayRoot, "replicate", "dest-password"))
+	script := fmt.Sprintf(`if [ -f %s ]; then umask 077 && cat > %s.new && chmod 600 %s.new && mv %s.new %s && echo updated; fi`, file, file, file, file, file)
+	out, err := runOnTarget(script, strings.NewReader(password))
+	if err != nil {
+		return false, fmt.Errorf("Could not update the password of the replication timer on %s: %w", targetHostname, err)
+	}
+	return strings.TrimSpace(string(out)) == "updated", nil
+}
+
+// changeQuayPassword sets the password of a user in the running Quay container
+func changeQuayPassword(user, password string) error {
+	script := "podman exec -i quay-app python3 -c " + shellQuote(resetPasswordScript)
+	_, err := runOnTarget(script, strings.NewReader(user+"\n"+password+"\n"))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		return fmt.Errorf("Quay on %s has no user named %s", targetHostname, user)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not change the password in the quay-app container, which must be running: %w", err)
+	}
+	return nil
+}
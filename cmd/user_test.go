@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChangeQuayPassword(t *testing.T) {
+	origHostname := targetHostname
+	defer func() { targetHostname = origHostname }()
+	targetHostname = "localhost"
+
+	// A fake podman records its standard input and knows a single user
+	dir := t.TempDir()
+	input := path.Join(dir, "input")
+	fake := "#!/bin/sh\ncat > " + input + "\nhead -n 1 " + input + " | grep -qx init || exit 3\n"
+	if err := ioutil.WriteFile(path.Join(dir, "podman"), []byte(fake), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	if err := changeQuayPassword("init", "n3w-password"); err != nil {
+		t.Fatalf("changeQuayPassword returned error: %v", err)
+	}
+	data, err := ioutil.ReadFile(input)
+	if err != nil || string(data) != "init\nn3w-password\n" {
+		t.Errorf("the container read %q, %v", data, err)
+	}
+
+	err = changeQuayPassword("nobody", "n3w-password")
+	if err == nil || !strings.Contains(err.Error(), "no user named nobody") {
+		t.Errorf("changeQuayPassword for a missing user = %v", err)
+	}
+}
+
+func TestUpdateReplicationPassword(t *testing.T) {
+	origHostname, origQuayRoot := targetHostname, quayRoot
+	defer func() { targetHostname, quayRoot = origHostname, origQuayRoot }()
+	targetHostname = "localhost"
+	quayRoot = t.TempDir()
+
+	file := path.Join(quayRoot, "replicate", "dest-password")
+	if updated, err := updateReplicationPassword("n3w-password"); err != nil || updated {
+		t.Errorf("updateReplicationPassword without replication = %v, %v, want false", updated, err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("dest-password was created without replication: %v", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("old-password"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := updateReplicationPassword("n3w-password"); err != nil || !updated {
+		t.Fatalf("updateReplicationPassword = %v, %v, want true", updated, err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil || string(data) != "n3w-password" {
+		t.Errorf("dest-password = %q, %v, want n3w-password", data, err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("dest-password mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	tests := []struct {
+		name  string
+		creds installCredentials
+		user  string
+		want  installCredentials
+	}{
+		{
+			name:  "init user",
+			creds: installCredentials{InitUser: "init", InitPassword: "old"},
+			user:  "init",
+			want:  installCredentials{InitUser: "init", InitPassword: "n3w-password"},
+		},
+		{
+			name:  "other user",
+			creds: installCredentials{InitUser: "init", InitPassword: "old"},
+			user:  "alice",
+			want:  installCredentials{InitUser: "init", InitPassword: "old", Passwords: map[string]string{"alice": "n3w-password"}},
+		},
+		{
+			name:  "install run from another machine",
+			creds: installCredentials{},
+			user:  "alice",
+			want:  installCredentials{Passwords: map[string]string{"alice": "n3w-password"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.creds.setPassword(tt.user, "n3w-password")
+			if !reflect.DeepEqual(tt.creds, tt.want) {
+				t.Errorf("credentials = %+v, want %+v", tt.creds, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReplicationUser(t *testing.T) {
+	unit := `# /home/quay/.config/systemd/user/quay-replicate.service
+[Service]
+Type=oneshot
+ExecStart=/home/quay/quay-install/replicate/mirror-registry replicate \
+    --source registry.example.com \
+    --dest https://quay.example.com:8443 \
+    --dest-username init \
+    --dest-password-file /home/quay/quay-install/replicate/dest-password \
+    --no-color
+`
+	if got := parseReplicationUser(unit); got != "init" {
+		t.Errorf("parseReplicationUser() = %q, want init", got)
+	}
+	if got := parseReplicationUser(""); got != "" {
+		t.Errorf("parseReplicationUser() without a unit = %q, want empty", got)
+	}
+}
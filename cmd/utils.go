@@ -1,20 +1,238 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sethvargo/go-password/password"
 )
 
 // This variable is set at build time via ldflags
 var sqliteImage string
 
+// runnerContainerName is the name of the ansible-runner container started by
+// this run. It is unique per run so concurrent runs on one machine do not collide.
+var runnerContainerName = fmt.Sprintf("ansible_runner_instance_%d", os.Getpid())
+
+// exitHooks are run, most recent first, before the installer exits
+var exitHooks []func()
+
+// onExit registers a function to run before the installer exits, whether it succeeded or not
+func onExit(f func()) {
+	exitHooks = append(exitHooks, f)
+}
+
+// runExitHooks runs and clears the registered exit hooks
+func runExitHooks() {
+	for len(exitHooks) > 0 {
+		f := exitHooks[len(exitHooks)-1]
+		exitHooks = exitHooks[:len(exitHooks)-1]
+		f()
+	}
+}
+
+// newSignalContext returns a context that is cancelled when the installer receives SIGINT or SIGTERM
+func newSignalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// runPlaybook runs the podman command that starts the ansible-runner container.
+// If ctx is cancelled while the playbook is running, the runner container is
+// stopped gracefully so it does not outlive the installer.
+func runPlaybook(ctx context.Context, podmanCmd string, stdout, stderr io.Writer) error {
+	log.Debug("Running command: " + podmanCmd)
+	cmd := exec.CommandContext(ctx, "bash", "-c", podmanCmd)
+	recap := &recapWriter{out: stdout}
+	cmd.Stdout = recap
+	cmd.Stderr = stderr
+	cmd.Stdin = os.Stdin
+	cmd.Cancel = func() error {
+		stopRunnerContainer()
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 30 * time.Second
+	err := cmd.Run()
+	lastPlaybookStats = recap.stats
+	return err
+}
+
+// isTerminal reports whether f is connected to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// envBool reads a boolean from the environment, defaulting to false
+func envBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
+
+// runnerTTYFlags returns the podman run flags controlling stdin and TTY
+// allocation. A TTY is only requested when the installer itself runs in one,
+// and stdin is not attached at all in non-interactive mode.
+func runnerTTYFlags() string {
+	flags := "--rm "
+	if !nonInteractive {
+		flags += "--interactive "
+	}
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		flags += "--tty "
+	}
+	return flags
+}
+
+// requireInteractive returns an error explaining how to supply an input
+// non-interactively if the installer must not prompt for it.
+func requireInteractive(input, alternative string) error {
+	if nonInteractive {
+		return fmt.Errorf("Refusing to prompt for %s in non-interactive mode. %s", input, alternative)
+	}
+	return nil
+}
+
+// becomePassFlags returns the podman mount flag and the ansible-playbook
+// argument used to supply the sudo password. The password is read from
+// --becomePassFile or $MIRROR_REGISTRY_BECOME_PASSWORD if set, otherwise
+// ansible prompts for it when --askBecomePass is set.
+func becomePassFlags() (string, string, error) {
+	becomePass := os.Getenv("MIRROR_REGISTRY_BECOME_PASSWORD")
+	if becomePassFile != "" {
+		data, err := ioutil.ReadFile(becomePassFile)
+		if err != nil {
+			return "", "", err
+		}
+		becomePass = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if becomePass == "" {
+		if !askBecomePass {
+			return "", "", nil
+		}
+		if err := requireInteractive("the sudo password", "Supply it with --becomePassFile or $MIRROR_REGISTRY_BECOME_PASSWORD."); err != nil {
+			return "", "", err
+		}
+		return "", "-K", nil
+	}
+
+	return runnerVarsFlags("become.json", map[string]string{"ansible_become_password": becomePass})
+}
+
+// runnerVarsFlags writes ansible variables to a private file and returns the
+// podman flag mounting it into the runner container and the ansible-playbook
+// argument loading it.
+func runnerVarsFlags(name string, vars interface{}) (string, string, error) {
+	varsFile, err := writeRunnerVarsFile(name, vars)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf(" -v %s:/runner/env/%s:Z ", varsFile, name), "-e @/runner/env/" + name, nil
+}
+
+// writeRunnerVarsFile writes ansible variables that must not appear on the
+// command line to a private file in the target state directory. The file is
+// removed when the installer exits.
+func writeRunnerVarsFile(name string, vars interface{}) (string, error) {
+	dir := targetStateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return "", err
+	}
+	file := path.Join(dir, name)
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return "", err
+	}
+	onExit(func() {
+		os.Remove(file)
+	})
+	return file, nil
+}
+
+// stopRunnerContainer stops and removes the ansible-runner container if it is still present
+func stopRunnerContainer() {
+	log.Warnf("Stopping %s container", runnerContainerName)
+	stop := exec.Command("podman", "stop", "--ignore", "--time", "10", runnerContainerName)
+	if verbose {
+		stop.Stderr = os.Stderr
+		stop.Stdout = os.Stdout
+	}
+	if err := stop.Run(); err != nil {
+		log.Warnf("Could not stop %s container: %s", runnerContainerName, err.Error())
+	}
+	rm := exec.Command("podman", "rm", "--ignore", "--force", runnerContainerName)
+	if verbose {
+		rm.Stderr = os.Stderr
+		rm.Stdout = os.Stdout
+	}
+	if err := rm.Run(); err != nil {
+		log.Warnf("Could not remove %s container: %s", runnerContainerName, err.Error())
+	}
+}
+
+// runnerStateFlags mounts the target state directory into the runner container
+// so the playbooks can record their progress.
+func runnerStateFlags() string {
+	return fmt.Sprintf(" -v %s:/runner/state:Z ", targetStateDir())
+}
+
+// finishOperation records the outcome of a playbook run in the install state and the audit log.
+// It exits the installer if the run was interrupted or failed.
+func finishOperation(ctx context.Context, state *installState, err error) {
+	collectTargetImages()
+	if ctx.Err() != nil {
+		state.finish(statusInterrupted)
+		recordAudit(state)
+		if state.Step != "" {
+			log.Warnf("The %s was interrupted during step '%s'", state.Operation, state.Step)
+		} else {
+			log.Warnf("The %s was interrupted before the playbook started its first step", state.Operation)
+		}
+		switch state.Operation {
+		case "install":
+			log.Warn("Re-run the install with --resume to continue from this step, or run 'mirror-registry uninstall' to clean up the partial installation.")
+		case "upgrade":
+			log.Warn("Re-run the same upgrade command to complete the upgrade.")
+		case "uninstall":
+			log.Warn("Re-run the same uninstall command to finish removing Quay.")
+		}
+		runExitHooks()
+		os.Exit(130)
+	}
+	if err != nil {
+		state.finish(statusFailed)
+		recordAudit(state)
+		if state.Step != "" {
+			log.Errorf("The %s failed during step '%s'", state.Operation, state.Step)
+		}
+		if state.Operation == "install" {
+			log.Error("Fix the cause of the failure and re-run the install with --resume to continue from this step.")
+		}
+		check(err)
+	}
+	state.finish(statusSucceeded)
+	recordAudit(state)
+}
+
 func loadExecutionEnvironment() error {
 
 	// Ensure execution environment is present
@@ -42,11 +260,17 @@ func loadExecutionEnvironment() error {
 	if err != nil {
 		return err
 	}
+	recordLoadedImage(imageHostInstaller, eeImage)
 	return nil
 }
 
+// imageExists reports whether an image is present in the local podman storage
+func imageExists(image string) bool {
+	return exec.Command("podman", "image", "exists", image).Run() == nil
+}
+
 func isLocalInstall() bool {
-	if targetHostname == "localhost" || targetHostname == getFQDN() && targetUsername == os.Getenv("USER") {
+	if targetIsLocal() {
 		log.Infof("Detected an installation to localhost")
 		return true
 	}
@@ -176,9 +400,15 @@ func pathExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// generatePassword returns a random password of 32 characters including 10 digits
+func generatePassword() (string, error) {
+	return password.Generate(32, 10, 0, false, false)
+}
+
 func check(err error) {
 	if err != nil {
 		log.Errorf("An error occurred: %s", err.Error())
+		runExitHooks()
 		os.Exit(1)
 	}
 }
@@ -211,6 +441,7 @@ func loadSqliteCli() (string, error) {
 		if err != nil {
 			return "", err
 		}
+		recordLoadedImage(imageHostTarget, sqliteImage)
 	}
 	log.Infof("Attempting to set SELinux rules on sqlite archive")
 	cmd := exec.Command("chcon", "-Rt", "svirt_sandbox_file_t", sqliteArchivePath)
@@ -327,12 +558,19 @@ func getApproval(question string) bool {
 	}
 }
 
+// getFQDN returns the fully qualified name of the current host. It falls back
+// to the kernel hostname when hostname -f is not available or fails, as in
+// the Quay image where the installer copies the database of an upgrade.
 func getFQDN() string {
 	fqdn, err := exec.Command("hostname", "-f").Output()
-	if err != nil {
-		errorMessage := "Failed to automatically acquire host FQDN, please set manually with --targetHostname. "
-		log.Fatal(errorMessage, err)
+	if err == nil && strings.TrimSpace(string(fqdn)) != "" {
+		return strings.TrimSpace(string(fqdn))
 	}
-
-	return strings.TrimSuffix(string(fqdn), "\n")
+	hostname, hostErr := os.Hostname()
+	if hostErr != nil {
+		log.Debugf("Failed to automatically acquire host FQDN, please set manually with --targetHostname: %v, %v", err, hostErr)
+		return "localhost"
+	}
+	log.Debugf("Could not run hostname -f, using %s: %v", hostname, err)
+	return hostname
 }
@@ -261,3 +261,94 @@ func TestIsLocalInstall(t *testing.T) {
 		}
 	})
 }
+
+func TestGetFQDNWithoutHostname(t *testing.T) {
+	// The Quay image the installer runs in during an upgrade may not ship hostname
+	t.Setenv("PATH", t.TempDir())
+	want, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getFQDN(); got != want {
+		t.Errorf("getFQDN() = %q, want %q", got, want)
+	}
+}
+
+func TestRunnerTTYFlags(t *testing.T) {
+	orig := nonInteractive
+	defer func() { nonInteractive = orig }()
+
+	// Tests never run with a terminal on both stdin and stdout
+	nonInteractive = false
+	if got := runnerTTYFlags(); got != "--rm --interactive " {
+		t.Errorf("runnerTTYFlags() = %q, want %q", got, "--rm --interactive ")
+	}
+
+	nonInteractive = true
+	if got := runnerTTYFlags(); got != "--rm " {
+		t.Errorf("runnerTTYFlags() in non-interactive mode = %q, want %q", got, "--rm ")
+	}
+}
+
+func TestBecomePassFlags(t *testing.T) {
+	origHostname, origAsk, origFile, origNonInteractive := targetHostname, askBecomePass, becomePassFile, nonInteractive
+	defer func() {
+		targetHostname, askBecomePass, becomePassFile, nonInteractive = origHostname, origAsk, origFile, origNonInteractive
+		runExitHooks()
+	}()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("MIRROR_REGISTRY_BECOME_PASSWORD", "")
+	targetHostname = "quay.example.com"
+	becomePassFile = ""
+
+	t.Run("no sudo password", func(t *testing.T) {
+		askBecomePass, nonInteractive = false, true
+		mount, arg, err := becomePassFlags()
+		if err != nil || mount != "" || arg != "" {
+			t.Errorf("becomePassFlags() = (%q, %q, %v), want empty", mount, arg, err)
+		}
+	})
+
+	t.Run("prompt when interactive", func(t *testing.T) {
+		askBecomePass, nonInteractive = true, false
+		_, arg, err := becomePassFlags()
+		if err != nil || arg != "-K" {
+			t.Errorf("becomePassFlags() arg = %q, err = %v, want -K", arg, err)
+		}
+	})
+
+	t.Run("refuse to prompt when non-interactive", func(t *testing.T) {
+		askBecomePass, nonInteractive = true, true
+		_, _, err := becomePassFlags()
+		if err == nil || !strings.Contains(err.Error(), "--becomePassFile") {
+			t.Errorf("becomePassFlags() error = %v, want error mentioning --becomePassFile", err)
+		}
+	})
+
+	t.Run("password from file", func(t *testing.T) {
+		askBecomePass, nonInteractive = true, true
+		becomePassFile = filepath.Join(t.TempDir(), "pass")
+		if err := os.WriteFile(becomePassFile, []byte("s3cret\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mount, arg, err := becomePassFlags()
+		if err != nil {
+			t.Fatalf("becomePassFlags() returned error: %v", err)
+		}
+		if arg != "-e @/runner/env/become.json" || !strings.Contains(mount, "/runner/env/become.json") {
+			t.Errorf("becomePassFlags() = (%q, %q), want vars file mount", mount, arg)
+		}
+		varsFile := filepath.Join(targetStateDir(), "become.json")
+		data, err := os.ReadFile(varsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != `{"ansible_become_password":"s3cret"}` {
+			t.Errorf("vars file content = %s", data)
+		}
+		info, _ := os.Stat(varsFile)
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("vars file mode = %v, want 0600", info.Mode().Perm())
+		}
+	})
+}